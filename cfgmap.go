@@ -19,10 +19,16 @@ package nagioscfg
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 func (cm CfgMap) SetByUUID(key UUID, val *CfgObj) bool {
@@ -69,6 +75,71 @@ func (cm CfgMap) Get(key string) (val *CfgObj, found bool) {
 	return cm.GetByUUID(u)
 }
 
+// IndexByKey returns a reverse index from each value of the given key to the UUIDs of the objects having that value.
+// The index is a snapshot, so it's up to the caller to rebuild it after adding, deleting or changing objects.
+func (cm CfgMap) IndexByKey(key string) map[string]UUIDs {
+	idx := make(map[string]UUIDs)
+	for k, v := range cm {
+		val, ok := v.Get(key)
+		if !ok {
+			continue
+		}
+		idx[val] = append(idx[val], k)
+	}
+	for val := range idx {
+		sort.Sort(idx[val]) // map iteration order is random, so make the result predictable
+	}
+	return idx
+}
+
+// IndexByName returns an index of all objects by type and name, as returned by CfgObj.GetName, for repeated lookups.
+// If more than one object has the same name, the one with the lowest UUID is indexed. The index is not updated when
+// the map changes, so it must be rebuilt after adding, deleting or renaming objects.
+func (cm CfgMap) IndexByName() NameIndex {
+	ni := make(NameIndex)
+	for _, v := range cm {
+		n, ok := v.GetName()
+		if !ok {
+			continue
+		}
+		_, ok = ni[v.Type]
+		if !ok {
+			ni[v.Type] = make(map[string]*CfgObj)
+		}
+		prev, ok := ni[v.Type][n]
+		if !ok || bytes.Compare(v.UUID.Bytes(), prev.UUID.Bytes()) < 0 {
+			ni[v.Type][n] = v
+		}
+	}
+	return ni
+}
+
+// Lookup returns the object of the given type with the given name
+func (ni NameIndex) Lookup(typ CfgType, name string) (*CfgObj, bool) {
+	co, ok := ni[typ][name]
+	return co, ok
+}
+
+// LookupByName returns the object of the given type with the given name, as returned by CfgObj.GetName.
+// If more than one object matches, the one with the lowest UUID is returned.
+// This searches the whole map, so for more than a few lookups, use IndexByName once and look up in that.
+func (cm CfgMap) LookupByName(typ CfgType, name string) (*CfgObj, bool) {
+	var res *CfgObj
+	for _, v := range cm {
+		if v.Type != typ {
+			continue
+		}
+		n, ok := v.GetName()
+		if !ok || n != name {
+			continue
+		}
+		if res == nil || bytes.Compare(v.UUID.Bytes(), res.UUID.Bytes()) < 0 {
+			res = v
+		}
+	}
+	return res, res != nil
+}
+
 func (cm CfgMap) DelByUUID(key UUID) *CfgObj {
 	val := cm[key]
 	delete(cm, key)
@@ -83,6 +154,66 @@ func (cm CfgMap) Del(key string) *CfgObj {
 	return cm.DelByUUID(u)
 }
 
+// DeleteMatching deletes all objects matching q, and returns the number of objects deleted.
+func (cm CfgMap) DeleteMatching(q *CfgQuery) int {
+	ids := cm.Search(q)
+	if len(ids) == 0 {
+		return 0
+	}
+	deleted := make(map[UUID]bool, len(ids))
+	for i := range ids {
+		_, ok := cm[ids[i]]
+		if ok {
+			delete(cm, ids[i])
+			deleted[ids[i]] = true
+		}
+	}
+	return len(deleted)
+}
+
+// SetWhere sets key to value in all objects matching q, and returns the number of objects changed
+func (cm CfgMap) SetWhere(q *CfgQuery, key, value string) int {
+	ids := cm.Search(q)
+	cos := make(CfgObjs, 0, len(ids))
+	for i := range ids {
+		o, ok := cm[ids[i]]
+		if ok {
+			cos = append(cos, o)
+		}
+	}
+	return cos.SetAll(key, value)
+}
+
+// Each calls fn for each object in the map, in random order, stopping at the first error, which is returned.
+// The keys are collected before the first call, so fn may add or delete objects. Objects deleted before their turn are
+// skipped, and objects added are not visited.
+func (cm CfgMap) Each(fn func(uuid UUID, co *CfgObj) error) error {
+	keys := make(UUIDs, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	return cm.each(keys, fn)
+}
+
+// EachSorted works like Each, but visits the objects in the order given by Keys()
+func (cm CfgMap) EachSorted(fn func(uuid UUID, co *CfgObj) error) error {
+	return cm.each(cm.Keys(), fn)
+}
+
+func (cm CfgMap) each(keys UUIDs, fn func(uuid UUID, co *CfgObj) error) error {
+	for i := range keys {
+		co, ok := cm[keys[i]]
+		if !ok {
+			continue
+		}
+		err := fn(keys[i], co)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (cm CfgMap) SetKeys(ids UUIDs, keys, values []string) int {
 	modcnt := 0
 	if ids == nil || len(ids) == 0 {
@@ -109,6 +240,47 @@ func (cm CfgMap) DelKeys(ids UUIDs, keys []string) int {
 	return delcnt
 }
 
+// RenameKey renames oldKey to newKey in all objects, and returns the number of objects changed
+func (cm CfgMap) RenameKey(oldKey, newKey string) int {
+	cnt := 0
+	for k := range cm {
+		if cm[k].Rename(oldKey, newKey) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// ReplaceInValues replaces matches of rx with repl in the value of key, as rx.ReplaceAllString does, in all objects
+// having key, and returns the number of objects where the value changed. Other directives are left alone, and
+// additive values stay additive.
+func (cm CfgMap) ReplaceInValues(key string, rx *regexp.Regexp, repl string) int {
+	cnt := 0
+	for _, v := range cm {
+		val, ok := v.Get(key)
+		if !ok {
+			continue
+		}
+		nval := rx.ReplaceAllString(val, repl)
+		if nval != val {
+			additive := v.IsAdditive(key)
+			v.Set(key, nval)
+			v.SetAdditive(key, additive)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Clone returns a deep copy of cm, where all objects keep their UUIDs
+func (cm CfgMap) Clone() CfgMap {
+	m := make(CfgMap, len(cm))
+	for k, v := range cm {
+		m[k] = v.CloneKeepUUID()
+	}
+	return m
+}
+
 func (cm CfgMap) Append(c2 CfgMap) error {
 	errcnt := 0
 	for k := range c2 {
@@ -123,6 +295,127 @@ func (cm CfgMap) Append(c2 CfgMap) error {
 	return nil
 }
 
+// mergeKey returns what identifies an object across maps: type plus host_name;service_description for services,
+// and type plus the name from GetName for everything else
+func mergeKey(co *CfgObj) (string, bool) {
+	var name string
+	var ok bool
+	if co.Type == T_SERVICE {
+		name, ok = co.GetUniqueCheckName()
+	}
+	if !ok {
+		name, ok = co.GetName()
+	}
+	if !ok {
+		return "", false
+	}
+	return co.Type.String() + ":" + name, true
+}
+
+// conflictKey returns what Nagios considers the identity of co. That's the same as mergeKey, except that templates
+// are identified by their "name", as a template may share its other names with the objects using it.
+func conflictKey(co *CfgObj) (string, bool) {
+	if co.IsTemplate() {
+		name, ok := co.Get("name")
+		if !ok {
+			return "", false
+		}
+		return co.Type.String() + " template:" + name, true
+	}
+	return mergeKey(co)
+}
+
+// FindConflicts returns groups of objects that Nagios would consider the same object, keyed by type and name,
+// e.g. "service:web01;HTTP" or "host:web01". Only groups with more than one object are returned.
+// Disabled objects are skipped, as they can't conflict with anything.
+func (cm CfgMap) FindConflicts() map[string]UUIDs {
+	groups := make(map[string]UUIDs)
+	for k, v := range cm {
+		if v.Disabled {
+			continue
+		}
+		key, ok := conflictKey(v)
+		if ok {
+			groups[key] = append(groups[key], k)
+		}
+	}
+	for key, ids := range groups {
+		if len(ids) < 2 {
+			delete(groups, key)
+			continue
+		}
+		sort.Sort(ids)
+	}
+	return groups
+}
+
+// Merge adds all objects from other to cm. When an incoming object has the same UUID, or the same type and name
+// as an existing object, onConflict is called to decide what to keep. It may return either of the objects, or a new,
+// merged one, which replaces the existing object. Returning nil drops both. Objects without a name only conflict by UUID.
+// If onConflict is nil, conflicts are left as they are, and reported in the returned error.
+func (cm CfgMap) Merge(other CfgMap, onConflict func(existing, incoming *CfgObj) *CfgObj) error {
+	idx := make(map[string]UUID)
+	for k, v := range cm {
+		key, ok := mergeKey(v)
+		if ok {
+			idx[key] = k
+		}
+	}
+
+	conflicts := 0
+	keys := other.Keys()
+	for i := range keys {
+		incoming := other[keys[i]]
+		key, named := mergeKey(incoming)
+
+		existing, found := cm[keys[i]]
+		if !found && named {
+			var id UUID
+			id, found = idx[key]
+			if found {
+				existing = cm[id]
+			}
+		}
+
+		if !found {
+			cm[keys[i]] = incoming
+			if named {
+				idx[key] = keys[i]
+			}
+			continue
+		}
+
+		if onConflict == nil {
+			conflicts++
+			continue
+		}
+
+		res := onConflict(existing, incoming)
+		delete(cm, existing.UUID)
+		if ekey, ok := mergeKey(existing); ok {
+			delete(idx, ekey)
+		}
+		if res == nil {
+			continue
+		}
+		id := res.UUID
+		if id.Equals(UUID{}) {
+			id = existing.UUID
+			res.UUID = id
+		}
+		cm[id] = res
+		if rkey, ok := mergeKey(res); ok {
+			idx[rkey] = id
+		}
+	}
+
+	if conflicts > 0 {
+		return fmt.Errorf("Unresolved conflicts for %d of the %d given objects %s", conflicts, len(other), dbgStr(true))
+	}
+	return nil
+}
+
+// LongestKey returns the length of the longest key in any object in the map, e.g. for aligning a whole file the same way
 func (cm CfgMap) LongestKey() int {
 	max := 0
 	curmax := 0
@@ -164,7 +457,8 @@ func (cm CfgMap) divertMatchAllKeys(ids UUIDs, rx *regexp.Regexp, keys []string)
 	} else {
 		matches = make(UUIDs, 0, len(ids))
 		for i := range ids {
-			if cm[ids[i]].MatchAllKeys(rx, keys...) {
+			o, ok := cm[ids[i]] // ids may refer to deleted objects
+			if ok && o.MatchAllKeys(rx, keys...) {
 				matches = append(matches, ids[i])
 			}
 		}
@@ -196,7 +490,8 @@ func (cm CfgMap) divertMatchAnyKeys(ids UUIDs, rx *regexp.Regexp, keys []string)
 	} else {
 		matches = make(UUIDs, 0, len(ids))
 		for i := range ids {
-			if cm[ids[i]].MatchAnyKeys(rx, keys...) {
+			o, ok := cm[ids[i]] // ids may refer to deleted objects
+			if ok && o.MatchAnyKeys(rx, keys...) {
 				matches = append(matches, ids[i])
 			}
 		}
@@ -227,7 +522,8 @@ func (cm CfgMap) divertMatchAny(ids UUIDs, rx *regexp.Regexp) UUIDs {
 	} else {
 		matches = make(UUIDs, 0, len(ids))
 		for i := range ids {
-			if cm[ids[i]].MatchAny(rx) {
+			o, ok := cm[ids[i]] // ids may refer to deleted objects
+			if ok && o.MatchAny(rx) {
 				matches = append(matches, ids[i])
 			}
 		}
@@ -247,6 +543,36 @@ func (cm CfgMap) MatchAnySubSet(rx *regexp.Regexp, ids UUIDs) UUIDs {
 }
 
 func (cm CfgMap) divertSearch(subset UUIDs, q *CfgQuery) UUIDs {
+	if len(q.RXs) == 0 && q.hasConds() {
+		// only OR groups etc., so we start out with everything
+		if subset == nil || len(subset) == 0 {
+			subset = cm.Keys()
+		}
+		return cm.filterConds(subset, q)
+	}
+	m := cm.divertSearchRX(subset, q)
+	if !q.hasConds() {
+		return m
+	}
+	return cm.filterConds(m, q)
+}
+
+// filterConds returns the ids whose objects match the conditions of q that are not Keys/RXs
+func (cm CfgMap) filterConds(ids UUIDs, q *CfgQuery) UUIDs {
+	matches := make(UUIDs, 0, len(ids))
+	for i := range ids {
+		o, ok := cm[ids[i]]
+		if ok && q.matchConds(o) {
+			matches = append(matches, ids[i])
+		}
+	}
+	if len(matches) > 0 {
+		return matches
+	}
+	return nil
+}
+
+func (cm CfgMap) divertSearchRX(subset UUIDs, q *CfgQuery) UUIDs {
 	klen := len(q.Keys)
 	rlen := len(q.RXs)
 
@@ -318,7 +644,8 @@ func (cm CfgMap) divertSearch(subset UUIDs, q *CfgQuery) UUIDs {
 	} else {
 		matches = make(UUIDs, 0, len(subset))
 		for k := range subset {
-			if cm[subset[k]].MatchSet(q) {
+			o, ok := cm[subset[k]] // ids may refer to deleted objects
+			if ok && o.MatchSet(q) {
 				//log.Debugf("%q matched %q in subset (in: %s)", subset[k], q, oddebug.DebugInfoMedium(PROJECT_PREFIX))
 				matches = append(matches, subset[k])
 			}
@@ -337,11 +664,88 @@ func (cm CfgMap) divertSearch(subset UUIDs, q *CfgQuery) UUIDs {
 // Given more keys than RXs, it will return all objects that match all RXs on any of the keys.
 // Given more RXs than keys, it will return all objects that match all RXs on all of the keys.
 // Given an equal amount of keys and RXs, it will return all objects that match RX on the value of the corresponding key, in given order.
+// OR groups added via CfgQuery.AddOrGroup are ANDed with the result of the above.
 func (cm CfgMap) Search(q *CfgQuery) UUIDs {
-	if uuidorder != nil {
-		return cm.divertSearch(uuidorder, q) // this should make the search use the order given when config was read
+	return cm.divertSearch(cm.Keys(), q) // this should make the search use the order given when config was read
+}
+
+// SearchObjs works like Search, but returns the matching objects instead of their UUIDs
+func (cm CfgMap) SearchObjs(q *CfgQuery) CfgObjs {
+	ids := cm.Search(q)
+	cos := make(CfgObjs, 0, len(ids))
+	for i := range ids {
+		o, ok := cm[ids[i]]
+		if ok {
+			cos = append(cos, o)
+		}
+	}
+	return cos
+}
+
+// SearchResults works like Search, but returns each match with its object, and the keys that matched
+func (cm CfgMap) SearchResults(q *CfgQuery) []SearchResult {
+	ids := cm.Search(q)
+	res := make([]SearchResult, 0, len(ids))
+	for i := range ids {
+		o, ok := cm[ids[i]]
+		if ok {
+			res = append(res, SearchResult{UUID: ids[i], Obj: o, Matched: q.matchedKeys(o)})
+		}
 	}
-	return cm.divertSearch(nil, q)
+	return res
+}
+
+// Explain returns how many objects each condition in q matches on its own, in the order regexes, key presence and
+// OR group conditions, e.g. to find out which condition makes a query return nothing.
+func (cm CfgMap) Explain(q *CfgQuery) []ConditionResult {
+	klen := len(q.Keys)
+	res := make([]ConditionResult, 0, len(q.RXs)+len(q.orGroups)+len(q.exists)+len(q.absent))
+	count := func(cr ConditionResult, match func(*CfgObj) bool) {
+		for _, o := range cm {
+			if match(o) {
+				cr.Matches++
+			}
+		}
+		res = append(res, cr)
+	}
+
+	for i := range q.RXs {
+		rx := q.RXs[i]
+		cr := ConditionResult{Pattern: rx.String()}
+		switch {
+		case klen == 0:
+			count(cr, func(o *CfgObj) bool { return o.MatchAny(rx) })
+		case q.Balanced():
+			cr.Key = q.Keys[i]
+			count(cr, KeyRX{Key: q.Keys[i], RX: rx}.Match)
+		case klen > len(q.RXs):
+			cr.Key = strings.Join(q.Keys, SEP_LST)
+			count(cr, func(o *CfgObj) bool { return o.MatchAnyKeys(rx, q.Keys...) })
+		default:
+			cr.Key = strings.Join(q.Keys, SEP_LST)
+			count(cr, func(o *CfgObj) bool { return o.MatchAllKeys(rx, q.Keys...) })
+		}
+	}
+	for _, k := range q.exists {
+		key := k
+		count(ConditionResult{Key: key}, func(o *CfgObj) bool {
+			_, ok := o.Props[key]
+			return ok
+		})
+	}
+	for _, k := range q.absent {
+		key := k
+		count(ConditionResult{Key: key, Negate: true}, func(o *CfgObj) bool {
+			_, ok := o.Props[key]
+			return !ok
+		})
+	}
+	for g, group := range q.orGroups {
+		for _, kr := range group {
+			count(ConditionResult{Key: kr.Key, Pattern: kr.RX.String(), Negate: kr.Negate, Group: g + 1}, kr.Match)
+		}
+	}
+	return res
 }
 
 // SearchSubSet searches only the CgObjs with the given UUIDs for matches
@@ -350,6 +754,82 @@ func (cm CfgMap) SearchSubSet(q *CfgQuery, ids UUIDs) UUIDs {
 	return cm.divertSearch(ids, q)
 }
 
+// SearchLimit works like Search, but stops after limit matches. As map iteration order is random, which matches
+// are returned may vary between calls. Use SearchSortedLimit for reproducible results. A limit < 1 means no limit.
+func (cm CfgMap) SearchLimit(q *CfgQuery, limit int) UUIDs {
+	var matches UUIDs
+	for k, v := range cm {
+		if q.Match(v) {
+			matches = append(matches, k)
+			if len(matches) == limit {
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// SearchParallel works like Search, but splits the objects between runtime.NumCPU() goroutines.
+// The compiled regexes in q are shared between them, as they're safe for concurrent use.
+// The result is in no particular order, so sort it if order matters.
+func (cm CfgMap) SearchParallel(q *CfgQuery) UUIDs {
+	keys := make(UUIDs, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	workers := runtime.NumCPU()
+	chunk := (len(keys) + workers - 1) / workers
+	if chunk == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	mchan := make(chan UUIDs)
+	for start := 0; start < len(keys); start += chunk {
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+		wg.Add(1)
+		go func(ids UUIDs) {
+			defer wg.Done()
+			var m UUIDs
+			for i := range ids {
+				if q.Match(cm[ids[i]]) {
+					m = append(m, ids[i])
+				}
+			}
+			mchan <- m
+		}(keys[start:end])
+	}
+
+	go func() {
+		wg.Wait()
+		close(mchan)
+	}()
+
+	var matches UUIDs
+	for m := range mchan {
+		matches = append(matches, m...)
+	}
+	return matches
+}
+
+// SearchSortedLimit works like SearchLimit, but searches objects in the order given by Keys()
+func (cm CfgMap) SearchSortedLimit(q *CfgQuery, limit int) UUIDs {
+	var matches UUIDs
+	keys := cm.Keys()
+	for i := range keys {
+		if q.Match(cm[keys[i]]) {
+			matches = append(matches, keys[i])
+			if len(matches) == limit {
+				break
+			}
+		}
+	}
+	return matches
+}
+
 func (cm CfgMap) FilterType(ts ...CfgType) UUIDs {
 	keys := cm.Keys() // do this to get objects in original order, if possible
 	matches := make(UUIDs, 0, len(keys))
@@ -364,6 +844,248 @@ func (cm CfgMap) FilterType(ts ...CfgType) UUIDs {
 	return nil
 }
 
+// FilterByType returns a new CfgMap with only the objects of the given types. The objects are shared, not copied.
+func (cm CfgMap) FilterByType(ts ...CfgType) CfgMap {
+	m := make(CfgMap)
+	for k, v := range cm {
+		if v.Type.In(ts) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Filter returns a new CfgMap with only the objects for which pred returns true. The objects are shared, not copied.
+func (cm CfgMap) Filter(pred func(*CfgObj) bool) CfgMap {
+	m := make(CfgMap)
+	for k, v := range cm {
+		if pred(v) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Fingerprint returns a hex encoded SHA-256 of the fingerprints of all objects in the map.
+// It changes if any object is added, deleted or changed, but not if objects are just given new UUIDs.
+func (cm CfgMap) Fingerprint() string {
+	fps := make([]string, 0, len(cm))
+	for _, v := range cm {
+		fps = append(fps, v.Fingerprint())
+	}
+	sort.Strings(fps)
+	h := sha256.New()
+	for i := range fps {
+		h.Write([]byte(fps[i]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PartitionTemplates splits cm into templates (objects with "register 0") and live objects.
+// The objects are shared, not copied.
+func (cm CfgMap) PartitionTemplates() (templates, live CfgMap) {
+	templates = make(CfgMap)
+	live = make(CfgMap)
+	for k, v := range cm {
+		if v.IsTemplate() {
+			templates[k] = v
+		} else {
+			live[k] = v
+		}
+	}
+	return
+}
+
+// CountByType returns the number of objects of each type
+func (cm CfgMap) CountByType() map[CfgType]int {
+	cnt := make(map[CfgType]int)
+	for _, v := range cm {
+		cnt[v.Type]++
+	}
+	return cnt
+}
+
+// GroupBy returns the objects grouped by their value for the given key. Objects without the key are skipped.
+func (cm CfgMap) GroupBy(key string) map[string]CfgObjs {
+	groups := make(map[string]CfgObjs)
+	keys := cm.Keys() // do this to get objects in original order, if possible
+	for i := range keys {
+		val, ok := cm[keys[i]].Get(key)
+		if !ok {
+			continue
+		}
+		groups[val] = append(groups[val], cm[keys[i]])
+	}
+	return groups
+}
+
+// GroupByList works like GroupBy, but splits the value on sep, and adds the object to a group for each element
+func (cm CfgMap) GroupByList(key, sep string) map[string]CfgObjs {
+	groups := make(map[string]CfgObjs)
+	keys := cm.Keys()
+	for i := range keys {
+		for _, val := range cm[keys[i]].GetList(key, sep) {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				continue
+			}
+			groups[val] = append(groups[val], cm[keys[i]])
+		}
+	}
+	return groups
+}
+
+// ValidateAll resolves and validates every object, and returns the errors for each object that failed.
+// Disabled objects are not validated.
+func (cm CfgMap) ValidateAll() map[UUID][]error {
+	res := make(map[UUID][]error)
+	idx := cm.templateIndex()
+	for k, v := range cm {
+		if v.Disabled {
+			continue
+		}
+		o, _, err := cm.resolve(v, idx, templateChain(v))
+		if err != nil {
+			res[k] = []error{err}
+			continue
+		}
+		errs := o.Validate()
+		if len(errs) > 0 {
+			res[k] = errs
+		}
+	}
+	return res
+}
+
+// nameIndex returns the set of defined names (host_name for hosts, command_name for commands etc.) per type,
+// not counting disabled objects
+func (cm CfgMap) nameIndex() map[CfgType]map[string]bool {
+	idx := make(map[CfgType]map[string]bool)
+	for _, v := range cm {
+		name, ok := v.Get(v.Type.String() + "_name")
+		if !ok || v.Disabled {
+			continue
+		}
+		_, ok = idx[v.Type]
+		if !ok {
+			idx[v.Type] = make(map[string]bool)
+		}
+		idx[v.Type][name] = true
+	}
+	return idx
+}
+
+// refNames splits a referencing value into the names it refers to
+func refNames(key, val string) []string {
+	if key == "check_command" {
+		val = strings.SplitN(val, SEP_CMD, 2)[0]
+	}
+	val = strings.TrimPrefix(val, "+")
+	names := make([]string, 0, 1)
+	for _, name := range strings.Split(val, SEP_LST) {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "!") // "!" excludes, but should still refer to something defined
+		if name == "" || name == "*" || name == "null" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// CheckReferences checks that all names referred to by "use", "host_name", "hostgroup_name", "contact_groups",
+// "contacts" and "check_command" are defined in the map, and returns an error for each reference that is not.
+// Disabled objects neither define names nor have their references checked.
+func (cm CfgMap) CheckReferences() []RefError {
+	names := cm.nameIndex()
+	tmpls := cm.templateIndex()
+	var errs []RefError
+
+	keys := cm.Keys()
+	for i := range keys {
+		co := cm[keys[i]]
+		if co.Disabled {
+			continue
+		}
+		for _, k := range co.sortedKeys() {
+			var found func(string) bool
+			if k == "use" {
+				found = func(name string) bool {
+					_, ok := tmpls[co.Type][name]
+					return ok
+				}
+			} else {
+				rtype, ok := refKeys[k]
+				if !ok || rtype == co.Type { // e.g. host_name in a host defines, not refers
+					continue
+				}
+				found = func(name string) bool {
+					return names[rtype][name]
+				}
+			}
+			for _, name := range refNames(k, co.Props[k]) {
+				if !found(name) {
+					errs = append(errs, RefError{UUID: keys[i], Key: k, Name: name})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// OrphanServices returns the services with a host_name referring to a host not defined in the map, and no
+// hostgroup_name referring to a defined hostgroup to fall back on. Templates and disabled objects are not checked,
+// and disabled hosts and hostgroups count as not defined.
+// This is a faster, narrower version of CheckReferences for the most common mistake.
+func (cm CfgMap) OrphanServices() CfgObjs {
+	hosts := make(map[string]bool)
+	groups := make(map[string]bool)
+	for _, v := range cm {
+		if v.Disabled {
+			continue
+		}
+		switch v.Type {
+		case T_HOST:
+			if name, ok := v.Get("host_name"); ok {
+				hosts[name] = true
+			}
+		case T_HOSTGROUP:
+			if name, ok := v.Get("hostgroup_name"); ok {
+				groups[name] = true
+			}
+		}
+	}
+
+	orphans := make(CfgObjs, 0)
+	keys := cm.Keys()
+	for i := range keys {
+		co := cm[keys[i]]
+		if co.Type != T_SERVICE || co.IsTemplate() || co.Disabled {
+			continue
+		}
+		missing := false
+		for _, name := range refNames("host_name", co.Props["host_name"]) {
+			if !hosts[name] {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			continue
+		}
+		hasGroup := false
+		for _, name := range refNames("hostgroup_name", co.Props["hostgroup_name"]) {
+			if groups[name] {
+				hasGroup = true
+				break
+			}
+		}
+		if !hasGroup {
+			orphans = append(orphans, co)
+		}
+	}
+	return orphans
+}
+
 // UniqueFileIDs returns a list of files the given objects came from
 func (cm CfgMap) UniqueFileIDs(u UUIDs) []string {
 	if u == nil || len(u) == 0 {
@@ -439,61 +1161,57 @@ func (cm CfgMap) SplitByFileID(sort bool) map[string]UUIDs {
 	return fmap
 }
 
+// SplitByType returns the UUIDs of all objects per type, in the same order as SplitByFileID
+func (cm CfgMap) SplitByType() map[CfgType]UUIDs {
+	tmap := make(map[CfgType]UUIDs)
+	keys := cm.Keys()
+	for k := range keys {
+		ct := cm[keys[k]].Type
+		tmap[ct] = append(tmap[ct], keys[k])
+	}
+	return tmap
+}
+
 func (cm CfgMap) Len() int {
 	return len(cm)
 }
 
-// Keys tries to deliver keys in the order they were read, otherwise it's random
-func (cm CfgMap) Keys() UUIDs {
-	ulen := len(uuidorder)
-	clen := cm.Len()
-	keys := make(UUIDs, clen)
-	i := 0
-	if uuidorder != nil && ulen == clen { // we assume nothing has been added or deleted if length is the same (naive...)
-		copy(keys, uuidorder)
-	} else if uuidorder != nil && ulen > clen { // objects have been deleted since input was read
-		// here we just skip keys that are no longer present
-		for k := range uuidorder {
-			_, ok := cm.GetByUUID(uuidorder[k])
-			if ok {
-				keys[i] = uuidorder[k]
-				i++
-			}
-		}
-	} else { // give up and take Golangs random order
-		for k := range cm {
-			keys[i] = k
-			i++
-		}
+// CanonicalizeOrder calls CanonicalizeOrder on all objects, for reformatting a whole config once, to get stable diffs
+// afterwards
+func (cm CfgMap) CanonicalizeOrder() {
+	for _, v := range cm {
+		v.CanonicalizeOrder()
 	}
+}
 
-	// Can't figure this out in a reliable manner
-	//} else if uuidorder != nil && clen > ulen { // objects have been added since input was read
-	//	for k := range cm {
-	//		idx := uuidorder.IndexOf(k)
-	//		if idx > -1 {
-	//		} else {
-	//		}
-	//	}
-	//}
-	// should still try to keep some order here, by comparing keys if uuidorder is not empty
-	//for k := range cm {
-	//	keys[i] = k
-	//	i++
-	//}
-
-	// 2017-07-24 13:02:10: We have a problem with duplicates getting printed out when saving back,
-	//  so trying to see if it's related to conversion between slices and maps
-	// 2017-07-24 13:22:47 - that was not the problem, as dups still occured with below code
-	//tmpmap := make(map[UUID]int)
-	//tmpkeys := make(UUIDs, 0, len(keys))
-	//for _, v := range keys {
-	//	tmpmap[v] += 1
-	//}
-	//for k := range tmpmap {
-	//	tmpkeys = append(tmpkeys, k)
-	//}
+// NormalizeAll calls Normalize on all objects
+func (cm CfgMap) NormalizeAll() {
+	for _, v := range cm {
+		v.Normalize()
+	}
+}
 
+// Keys returns the UUIDs of all objects, in the order they were read, followed by objects that were not read,
+// e.g. created with NewCfgObj, by UUID. Objects read by several readers are ordered by when each was read.
+func (cm CfgMap) Keys() UUIDs {
+	type seqKey struct {
+		seq uint64
+		key UUID
+	}
+	sk := make([]seqKey, 0, len(cm))
+	for k, v := range cm {
+		sk = append(sk, seqKey{v.readSeq, k})
+	}
+	sort.Slice(sk, func(i, j int) bool {
+		if sk[i].seq != sk[j].seq {
+			return sk[j].seq == 0 || (sk[i].seq != 0 && sk[i].seq < sk[j].seq) // 0 means not read, so last
+		}
+		return bytes.Compare(sk[i].key.Bytes(), sk[j].key.Bytes()) < 0
+	})
+	keys := make(UUIDs, len(sk))
+	for i := range sk {
+		keys[i] = sk[i].key
+	}
 	return keys
 }
 
@@ -614,3 +1332,45 @@ func (cm CfgMap) UnmarshalJSON(b []byte) error {
 
 	return nil
 }
+
+// NewSyncCfgMap returns a SyncCfgMap holding cm, which should not be used directly afterwards. If cm is nil, a new map is created.
+func NewSyncCfgMap(cm CfgMap) *SyncCfgMap {
+	if cm == nil {
+		cm = make(CfgMap)
+	}
+	return &SyncCfgMap{cm: cm}
+}
+
+// Get returns the object with the given UUID
+func (scm *SyncCfgMap) Get(key UUID) (*CfgObj, bool) {
+	scm.RLock()
+	defer scm.RUnlock()
+	return scm.cm.GetByUUID(key)
+}
+
+// Set adds or replaces the object with the given UUID. Returns true if an object was replaced.
+func (scm *SyncCfgMap) Set(key UUID, val *CfgObj) bool {
+	scm.Lock()
+	defer scm.Unlock()
+	return scm.cm.SetByUUID(key, val)
+}
+
+// Delete removes the object with the given UUID, and returns it, or nil if not found
+func (scm *SyncCfgMap) Delete(key UUID) *CfgObj {
+	scm.Lock()
+	defer scm.Unlock()
+	return scm.cm.DelByUUID(key)
+}
+
+func (scm *SyncCfgMap) Len() int {
+	scm.RLock()
+	defer scm.RUnlock()
+	return scm.cm.Len()
+}
+
+// Snapshot returns a deep copy of the current config, that the caller is free to read and modify
+func (scm *SyncCfgMap) Snapshot() CfgMap {
+	scm.RLock()
+	defer scm.RUnlock()
+	return scm.cm.Clone()
+}
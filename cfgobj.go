@@ -18,21 +18,34 @@ package nagioscfg
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 // NewCfgObj returns an initialized CfgObj instance, but without UUID set, as that is a slightly costly operation
 func NewCfgObj(ct CfgType) *CfgObj {
+	return NewCfgObjHint(ct, 0)
+}
+
+// NewCfgObjHint works like NewCfgObj, but allocates room for propsHint properties up front,
+// for when the number of properties to be added is known
+func NewCfgObjHint(ct CfgType, propsHint int) *CfgObj {
 	return &CfgObj{
 		Type:    ct,
-		Props:   make(map[string]string),
+		Props:   make(map[string]string, propsHint),
 		Indent:  DEF_INDENT,
 		Align:   DEF_ALIGN,
-		Comment: "# " + ct.String() + " '%s'",
+		Comment: defaultComment(ct),
 	}
 }
 
@@ -43,13 +56,127 @@ func NewCfgObjWithUUID(ct CfgType) *CfgObj {
 	return o
 }
 
-// Set adds the given key/value to CfgObj.Props, returning true if the key was overwritten, and false if it was added fresh
+// NewCfgObjDeterministic returns a CfgObj with the given properties, and a UUID derived from its Fingerprint,
+// so that identical definitions get the same UUID every time, e.g. for golden file tests.
+// Two such objects with the same properties can not be in the same CfgMap.
+func NewCfgObjDeterministic(ct CfgType, props map[string]string) *CfgObj {
+	o := NewCfgObjHint(ct, len(props))
+	tmp := &CfgObj{Type: ct, Props: props}
+	for _, k := range tmp.sortedKeys() {
+		o.addRaw(k, props[k])
+	}
+	o.UUID = NewUUIDv5(objNamespace, o.Fingerprint())
+	return o
+}
+
+// CloneKeepUUID returns a deep copy of the object, with the same UUID as the original
+func (co *CfgObj) CloneKeepUUID() *CfgObj {
+	o := &CfgObj{
+		Type:       co.Type,
+		UUID:       co.UUID,
+		Indent:     co.Indent,
+		Align:      co.Align,
+		BraceStyle: co.BraceStyle,
+		FileID:     co.FileID,
+		Comment:    co.Comment,
+		Disabled:   co.Disabled,
+		Props:      make(map[string]string, len(co.Props)),
+		keyOrder:   make([]string, len(co.keyOrder)),
+		readSeq:    co.readSeq,
+	}
+	for k, v := range co.Props {
+		o.Props[k] = v
+	}
+	copy(o.keyOrder, co.keyOrder)
+	if co.InlineComments != nil {
+		o.InlineComments = make(map[string]string, len(co.InlineComments))
+		for k, v := range co.InlineComments {
+			o.InlineComments[k] = v
+		}
+	}
+	if co.LeadingComments != nil {
+		o.LeadingComments = make([]string, len(co.LeadingComments))
+		copy(o.LeadingComments, co.LeadingComments)
+	}
+	if co.TimeRanges != nil {
+		o.TimeRanges = make([]TimeRange, len(co.TimeRanges))
+		copy(o.TimeRanges, co.TimeRanges)
+	}
+	if co.Additive != nil {
+		o.Additive = make(map[string]bool, len(co.Additive))
+		for k, v := range co.Additive {
+			o.Additive[k] = v
+		}
+	}
+	return o
+}
+
+// Clone returns a deep copy of the object, with a new UUID
+func (co *CfgObj) Clone() *CfgObj {
+	o := co.CloneKeepUUID()
+	o.UUID = NewUUIDv1()
+	return o
+}
+
+// Touch gives the object a fresh UUID and regenerates its header comment from the current Props,
+// for when a copy has been adapted into a new object
+func (co *CfgObj) Touch() {
+	co.UUID = NewUUIDv1()
+	co.Comment = defaultComment(co.Type)
+	co.generateComment()
+}
+
+// MergeFrom copies the properties of parent into co, the same way properties are inherited from a template.
+// Keys missing in co are added, and if overwrite is true, keys co already has are replaced with the parent value.
+// Additive values in co ("+" prefixed) are always appended to the parent value instead, and are no longer additive
+// after the merge. A "null" value in co is kept unless overwrite is true. "name", "register" and "use" are not copied.
+func (co *CfgObj) MergeFrom(parent *CfgObj, overwrite bool) {
+	for _, k := range parent.originalKeys() {
+		if !isInherited(k) {
+			continue
+		}
+		pval := parent.Props[k]
+		val, exists := co.Props[k]
+		switch {
+		case !exists:
+			co.Set(k, pval)
+		case co.IsAdditive(k):
+			if pval != "" {
+				co.Set(k, pval+SEP_LST+val)
+			}
+			co.SetAdditive(k, false)
+		case overwrite:
+			co.Set(k, pval)
+		}
+	}
+}
+
+// defaultComment returns the comment for new objects, to be filled in with the name by generateComment
+func defaultComment(ct CfgType) string {
+	return "# " + ct.String() + " '%s'"
+}
+
+// Set adds the given key/value to CfgObj.Props, returning true if the key was overwritten, and false if it was added fresh.
+// The new value replaces any inherited value, so the key is no longer additive, see SetAdditive.
+// For the weekdays and dates of a timeperiod, the first entry for that day in TimeRanges is set instead.
 func (co *CfgObj) Set(key, val string) bool {
+	if co.isTimeRangeKey(key) {
+		if i := co.timeRangeIndex(key); i > -1 {
+			co.TimeRanges[i].Ranges = val
+			return true
+		}
+		co.TimeRanges = append(co.TimeRanges, TimeRange{Day: key, Ranges: val})
+		return false
+	}
 	if !IsValidProperty(key) {
 		return false
 	}
 	_, exists := co.Props[key]
 	co.Props[key] = val
+	delete(co.Additive, key)
+	if !exists {
+		co.keyOrder = append(co.keyOrder, key)
+	}
 	return exists // true = key was overwritten, false = key was added
 }
 
@@ -74,26 +201,258 @@ func (co *CfgObj) SetKeys(keys, values []string) int {
 
 // Add adds the given key/value to CfgObj.Props only if the key does not already exist. Returns true if added, false otherwise.
 func (co *CfgObj) Add(key, val string) bool {
-	_, exists := co.Props[key]
+	_, exists := co.Get(key)
 	if exists {
 		return false
 	}
 	return !co.Set(key, val) // Set should return false, as the key doesn't exist yet, so we inverse the result
 }
 
+// AddChecked works like Add, but returns an error if key is not a known directive for the objects type,
+// see IsValidPropertyFor, or if it already exists. Use Add for custom directives.
+func (co *CfgObj) AddChecked(key, val string) error {
+	if !IsValidPropertyFor(key, co.Type) {
+		return fmt.Errorf("Invalid key %q for %s", key, co.Type)
+	}
+	if !co.Add(key, val) {
+		return fmt.Errorf("Key %q already set for %s", key, co.Type)
+	}
+	return nil
+}
+
 // Get returns the value for the given key, if it exists. "found" will be false if no such key exists.
+// For the weekdays and dates of a timeperiod, the ranges of the first entry for that day in TimeRanges are returned.
 func (co *CfgObj) Get(key string) (val string, found bool) {
+	if co.isTimeRangeKey(key) {
+		if i := co.timeRangeIndex(key); i > -1 {
+			return co.TimeRanges[i].Ranges, true
+		}
+		return "", false
+	}
 	val, found = co.Props[key]
 	return val, found
 }
 
+// isTimeRangeKey returns true if key is a weekday or date of a timeperiod, which is kept in TimeRanges, as the reader
+// does for every timeperiod line that is not a known directive
+func (co *CfgObj) isTimeRangeKey(key string) bool {
+	return co.Type == T_TIMEPERIOD && !timeperiodKeys[key]
+}
+
+// timeRangeIndex returns the index of the first entry for day in TimeRanges, or -1 if there is none
+func (co *CfgObj) timeRangeIndex(day string) int {
+	for i := range co.TimeRanges {
+		if co.TimeRanges[i].Day == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// Keys returns the keys of the object in the canonical order given by CfgKeySortOrder, with unknown keys last,
+// sorted alphabetically. This is the order WriteObj uses when sorting.
+func (co *CfgObj) Keys() []string {
+	return co.sortedKeys()
+}
+
+// Values returns the values of the object, in the same order as the keys from Keys
+func (co *CfgObj) Values() []string {
+	keys := co.sortedKeys()
+	vals := make([]string, len(keys))
+	for i := range keys {
+		vals[i] = co.Props[keys[i]]
+	}
+	return vals
+}
+
 // Del deletes the entry with the given key. It returns true if anything was deleted, false otherwise.
+// For the weekdays and dates of a timeperiod, all entries for that day in TimeRanges are deleted.
 func (co *CfgObj) Del(key string) bool {
+	if co.isTimeRangeKey(key) {
+		trs := co.TimeRanges[:0]
+		for _, tr := range co.TimeRanges {
+			if tr.Day != key {
+				trs = append(trs, tr)
+			}
+		}
+		deleted := len(trs) < len(co.TimeRanges)
+		co.TimeRanges = trs
+		return deleted
+	}
 	_, exists := co.Props[key]
 	delete(co.Props, key)
+	delete(co.InlineComments, key)
+	delete(co.Additive, key)
+	if exists {
+		for i := range co.keyOrder {
+			if co.keyOrder[i] == key {
+				co.keyOrder = append(co.keyOrder[:i], co.keyOrder[i+1:]...)
+				break
+			}
+		}
+	}
 	return exists // just signals if there was anything there to be deleted in the first place
 }
 
+// Rename moves the value of oldKey to newKey, keeping its position and any inline comment.
+// Returns false if oldKey does not exist, or if newKey already exists or is not a valid property.
+func (co *CfgObj) Rename(oldKey, newKey string) bool {
+	val, exists := co.Props[oldKey]
+	if !exists {
+		return false
+	}
+	_, exists = co.Props[newKey]
+	if exists || !IsValidProperty(newKey) {
+		return false
+	}
+	co.Props[newKey] = val
+	delete(co.Props, oldKey)
+	for i := range co.keyOrder {
+		if co.keyOrder[i] == oldKey {
+			co.keyOrder[i] = newKey
+			break
+		}
+	}
+	cmt, found := co.InlineComments[oldKey]
+	if found {
+		delete(co.InlineComments, oldKey)
+		co.InlineComments[newKey] = cmt
+	}
+	if co.IsAdditive(oldKey) {
+		delete(co.Additive, oldKey)
+		co.SetAdditive(newKey, true)
+	}
+	return true
+}
+
+// SetAdditive marks the value for key to be appended to the inherited value, written as "+value".
+// Only list directives like contact_groups or hostgroups can be additive. Returns false for any other key.
+func (co *CfgObj) SetAdditive(key string, additive bool) bool {
+	if !additiveKeys[key] {
+		return false
+	}
+	if !additive {
+		delete(co.Additive, key)
+		return true
+	}
+	if co.Additive == nil {
+		co.Additive = make(map[string]bool)
+	}
+	co.Additive[key] = true
+	return true
+}
+
+// IsAdditive returns true if the value for key should be appended to the inherited value
+func (co *CfgObj) IsAdditive(key string) bool {
+	return co.Additive[key]
+}
+
+// addRaw adds a value as written in a config file, where a leading "+" on list directives marks it as additive
+func (co *CfgObj) addRaw(key, val string) bool {
+	additive := additiveKeys[key] && strings.HasPrefix(val, "+")
+	if additive {
+		val = val[1:]
+	}
+	if !co.Add(key, val) {
+		return false
+	}
+	if additive {
+		co.SetAdditive(key, true)
+	}
+	return true
+}
+
+// rawValue returns the value for key as written in a config file, with a leading "+" if additive
+func (co *CfgObj) rawValue(key string) string {
+	if co.IsAdditive(key) {
+		return "+" + co.Props[key]
+	}
+	return co.Props[key]
+}
+
+// SetInlineComment sets the comment to be printed after the value for the given key. An empty comment removes it.
+func (co *CfgObj) SetInlineComment(key, comment string) {
+	if comment == "" {
+		delete(co.InlineComments, key)
+		return
+	}
+	if co.InlineComments == nil {
+		co.InlineComments = make(map[string]string)
+	}
+	co.InlineComments[key] = comment
+}
+
+// GetInlineComment returns the inline comment for the given key, if any
+func (co *CfgObj) GetInlineComment(key string) (string, bool) {
+	cmt, found := co.InlineComments[key]
+	return cmt, found
+}
+
+// propValue returns the value for key as it should be printed, including any inline comment
+func (co *CfgObj) propValue(key string) string {
+	val := quoteValue(escapeValue(co.rawValue(key)))
+	cmt, found := co.InlineComments[key]
+	if !found {
+		return val
+	}
+	return fmt.Sprintf("%s %s %s", val, SEP_ICMT, cmt)
+}
+
+// escapeValue escapes inline comment delimiters in val as "\;", so they are not taken for comments when read back
+func escapeValue(val string) string {
+	return strings.Replace(val, SEP_ICMT, `\`+SEP_ICMT, -1)
+}
+
+// quoteValue puts quotes around values with whitespace that would otherwise be lost when read back,
+// i.e. anything but single spaces between words, outside of quotes
+func quoteValue(val string) string {
+	norm, quoted := collapseSpace(val)
+	if quoted || norm == val {
+		return val
+	}
+	return `"` + val + `"`
+}
+
+// collapseSpace returns val as it would be after being read back, i.e. trimmed and with runs of whitespace
+// outside of quotes replaced by a single space. quoted is true if val has an unterminated quote.
+func collapseSpace(val string) (norm string, quoted bool) {
+	var buf strings.Builder
+	space := false
+	for _, r1 := range val {
+		if r1 == '"' {
+			quoted = !quoted
+		}
+		if !quoted && unicode.IsSpace(r1) {
+			space = true
+			continue
+		}
+		if space && buf.Len() > 0 {
+			buf.WriteRune(' ')
+		}
+		space = false
+		buf.WriteRune(r1)
+	}
+	return buf.String(), quoted
+}
+
+// CanonicalizeOrder changes the stored order of the properties to the Nagios sort order for the objects type,
+// so they are written in that order even when not sorting, e.g. by PrintProps or Print(w, false)
+func (co *CfgObj) CanonicalizeOrder() {
+	co.keyOrder = co.sortedKeys()
+}
+
+// Normalize trims all values, and replaces runs of whitespace outside of quotes with a single space,
+// to avoid differences that would not matter to Nagios
+func (co *CfgObj) Normalize() {
+	for k, v := range co.Props {
+		co.Props[k], _ = collapseSpace(v)
+	}
+	for i := range co.TimeRanges {
+		co.TimeRanges[i].Day, _ = collapseSpace(co.TimeRanges[i].Day)
+		co.TimeRanges[i].Ranges, _ = collapseSpace(co.TimeRanges[i].Ranges)
+	}
+}
+
 func (co *CfgObj) DelKeys(keys []string) int {
 	delcnt := 0
 	for i := range keys {
@@ -125,6 +484,77 @@ func (co *CfgObj) GetList(key, sep string) []string {
 	return strings.Split(val, sep)
 }
 
+// GetListClean works like GetList, but strips a leading "+" from the value, trims whitespace around each
+// element, and drops empty elements, so "+ops, devs , " gives ["ops" "devs"]
+func (co *CfgObj) GetListClean(key, sep string) []string {
+	val, exists := co.Get(key)
+	if !exists {
+		return nil
+	}
+	val = strings.TrimPrefix(strings.TrimSpace(val), "+")
+	lst := make([]string, 0, 1)
+	for _, e := range strings.Split(val, sep) {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			lst = append(lst, e)
+		}
+	}
+	return lst
+}
+
+// GetInt gets the value for key as an int. ok is false if the key is missing or not an integer.
+func (co *CfgObj) GetInt(key string) (int, bool) {
+	val, ok := co.Get(key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(val))
+	return i, err == nil
+}
+
+// GetFloat gets the value for key as a float64. ok is false if the key is missing or not a number.
+func (co *CfgObj) GetFloat(key string) (float64, bool) {
+	val, ok := co.Get(key)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	return f, err == nil
+}
+
+// GetBool gets the value for key as a bool, where Nagios uses 1 for true and 0 for false.
+// ok is false if the key is missing or has any other value.
+func (co *CfgObj) GetBool(key string) (bool, bool) {
+	val, ok := co.Get(key)
+	if !ok {
+		return false, false
+	}
+	switch strings.TrimSpace(val) {
+	case "1":
+		return true, true
+	case "0":
+		return false, true
+	}
+	return false, false
+}
+
+// AppendToList appends values to the list for key, joined with sep. If the key does not exist, it's added.
+// An additive list stays additive.
+func (co *CfgObj) AppendToList(key, sep string, values ...string) {
+	list := co.GetList(key, sep)
+	if len(list) == 1 && list[0] == "" {
+		list = nil
+	}
+	for _, v := range values {
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	additive := co.IsAdditive(key)
+	co.SetList(key, sep, list...)
+	co.SetAdditive(key, additive)
+}
+
 // SetList takes a slice and joins it using the given separator, then sets it as the value for the given key
 func (co *CfgObj) SetList(key, sep string, list ...string) bool {
 	lstr := strings.Join(list, sep)
@@ -178,6 +608,142 @@ func (co *CfgObj) GetCheckCommandArgs() []string {
 	return lst[1:]
 }
 
+// scanMacros calls fn with the start and end index of each macro in s, like $ARG1$ in "-w $ARG1$",
+// where s[start:end] is the macro. Escaped dollar signs ($$) are skipped.
+func scanMacros(s string, fn func(start, end int)) {
+	i := strings.IndexByte(s, '$')
+	for i > -1 && i < len(s)-1 {
+		j := strings.IndexByte(s[i+1:], '$')
+		if j == -1 {
+			return
+		}
+		j += i + 1
+		if j == i+1 {
+			i = j + 1 // $$ is a literal dollar sign
+		} else if strings.IndexFunc(s[i:j], unicode.IsSpace) > -1 {
+			i = j // stray dollar sign, so the closing one might start a macro
+			continue
+		} else {
+			fn(i, j+1)
+			i = j + 1
+		}
+		next := strings.IndexByte(s[i:], '$')
+		if next == -1 {
+			return
+		}
+		i += next
+	}
+}
+
+// CommandMacros returns the distinct macros, like $ARG1$, $USER1$ or $HOSTADDRESS$, used in command_line
+// of a command object, in the order they first appear. Escaped dollar signs ($$) are skipped.
+func (co *CfgObj) CommandMacros() []string {
+	if co.Type != T_COMMAND {
+		return nil
+	}
+	cl, ok := co.Get("command_line") // CfgKeys[12]
+	if !ok {
+		return nil
+	}
+	var macros []string
+	seen := make(map[string]bool)
+	scanMacros(cl, func(start, end int) {
+		tok := cl[start:end]
+		if !seen[tok] {
+			seen[tok] = true
+			macros = append(macros, tok)
+		}
+	})
+	return macros
+}
+
+// ExpandMacros returns command_line of a command object, with $USERn$ macros replaced by their values
+// in resources, as returned by ParseResourceFile. Other macros, and $USERn$ not in resources, are left as is.
+func (co *CfgObj) ExpandMacros(resources map[string]string) string {
+	if co.Type != T_COMMAND {
+		return ""
+	}
+	cl, ok := co.Get("command_line")
+	if !ok {
+		return ""
+	}
+	var buf bytes.Buffer
+	last := 0
+	scanMacros(cl, func(start, end int) {
+		val, ok := resources[cl[start:end]]
+		if !ok || !isUserMacro(cl[start:end]) {
+			return
+		}
+		buf.WriteString(cl[last:start])
+		buf.WriteString(val)
+		last = end
+	})
+	buf.WriteString(cl[last:])
+	return buf.String()
+}
+
+// isUserMacro returns true if macro is on the form $USERn$
+func isUserMacro(macro string) bool {
+	if len(macro) < 7 || !strings.HasPrefix(macro, "$USER") || macro[len(macro)-1] != '$' {
+		return false
+	}
+	for _, r := range macro[5 : len(macro)-1] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CommandExecutable returns the program part of command_line in a command object, without any quotes
+func (co *CfgObj) CommandExecutable() string {
+	if co.Type != T_COMMAND {
+		return ""
+	}
+	cl, ok := co.Get("command_line")
+	if !ok {
+		return ""
+	}
+	cl = strings.TrimSpace(cl)
+	if len(cl) > 1 && (cl[0] == '"' || cl[0] == '\'') {
+		end := strings.IndexByte(cl[1:], cl[0])
+		if end > -1 {
+			return cl[1 : end+1]
+		}
+	}
+	f := strings.Fields(cl)
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
+
+// AddTimeRange appends a weekday or date exception to a timeperiod, e.g. AddTimeRange("day 1", "00:00-24:00").
+// Returns false if the object is not a timeperiod.
+func (co *CfgObj) AddTimeRange(day, ranges string) bool {
+	if co.Type != T_TIMEPERIOD {
+		return false
+	}
+	co.TimeRanges = append(co.TimeRanges, TimeRange{Day: day, Ranges: ranges})
+	return true
+}
+
+// parseTimeRange splits the fields of a timeperiod line into the day part and the time ranges,
+// which start at the first field with a ":", as in "00:00-24:00". Dates never have one.
+func parseTimeRange(fields []string) TimeRange {
+	idx := len(fields) - 1
+	for i := 1; i < len(fields); i++ {
+		if strings.IndexByte(fields[i], ':') > -1 {
+			idx = i
+			break
+		}
+	}
+	return TimeRange{
+		Day:    strings.Join(fields[:idx], " "),
+		Ranges: strings.Join(fields[idx:], " "),
+	}
+}
+
 // GetName tries to return the name for the given object, if set
 func (co *CfgObj) GetName() (string, bool) {
 	key := co.Type.String() + "_name"
@@ -194,6 +760,41 @@ func (co *CfgObj) GetDescription() (string, bool) {
 	return co.Get(key)
 }
 
+// Summary returns a one line description of the object, suitable for log messages,
+// e.g. "service 'PING' on web01" or "host 'web01'"
+func (co *CfgObj) Summary() string {
+	if co.IsTemplate() {
+		name, ok := co.Get("name")
+		if ok {
+			return fmt.Sprintf("%s template '%s'", co.Type.String(), name)
+		}
+	}
+	if co.Type == T_SERVICE {
+		desc, ok := co.GetDescription()
+		if ok {
+			host, ok := co.GetHostname()
+			if !ok {
+				host, ok = co.Get("hostgroup_name")
+			}
+			if ok {
+				return fmt.Sprintf("service '%s' on %s", desc, host)
+			}
+			return fmt.Sprintf("service '%s'", desc)
+		}
+	}
+	name, ok := co.GetName()
+	if ok {
+		return fmt.Sprintf("%s '%s'", co.Type.String(), name)
+	}
+	return fmt.Sprintf("%s %s", co.Type.String(), co.UUID.String())
+}
+
+// IsTemplate returns true if the object has "register 0", meaning it's only a template for other objects
+func (co *CfgObj) IsTemplate() bool {
+	reg, ok := co.Get("register")
+	return ok && strings.TrimSpace(reg) == "0"
+}
+
 // GetUniqueCheckName returns host_name + service_description, just as op5 does for a unique ID in the system
 func (co *CfgObj) GetUniqueCheckName() (id string, ok bool) {
 	hostname, ok := co.GetHostname()
@@ -264,6 +865,51 @@ func (co *CfgObj) MatchAny(rx *regexp.Regexp) bool {
 	return false
 }
 
+// folded caches the case insensitive versions of the last DEF_FOLD_CACHE regexes, by pattern, as the Fold matchers are
+// called once per object
+var folded = struct {
+	sync.Mutex
+	rx    map[string]*regexp.Regexp
+	order []string // oldest first
+}{rx: make(map[string]*regexp.Regexp)}
+
+// foldRX returns a case insensitive version of rx
+func foldRX(rx *regexp.Regexp) *regexp.Regexp {
+	pat := rx.String()
+	folded.Lock()
+	frx, ok := folded.rx[pat]
+	folded.Unlock()
+	if ok {
+		return frx
+	}
+	frx, err := regexp.Compile("(?i)" + pat)
+	if err != nil { // should not happen, as rx is already valid
+		log.Errorf("%q %s", err, dbgStr(true))
+		return rx
+	}
+	folded.Lock()
+	if _, ok = folded.rx[pat]; !ok {
+		if len(folded.order) >= DEF_FOLD_CACHE {
+			delete(folded.rx, folded.order[0])
+			folded.order = folded.order[1:]
+		}
+		folded.rx[pat] = frx
+		folded.order = append(folded.order, pat)
+	}
+	folded.Unlock()
+	return frx
+}
+
+// MatchAllKeysFold does the same as MatchAllKeys, but ignores case
+func (co *CfgObj) MatchAllKeysFold(rx *regexp.Regexp, keys ...string) bool {
+	return co.MatchAllKeys(foldRX(rx), keys...)
+}
+
+// MatchAnyFold does the same as MatchAny, but ignores case
+func (co *CfgObj) MatchAnyFold(rx *regexp.Regexp) bool {
+	return co.MatchAny(foldRX(rx))
+}
+
 // MatchSet returns true if all keys match their respective regexes. Almost like MatchKeys, but with a separate RX for each key
 func (co *CfgObj) MatchSet(q *CfgQuery) bool {
 	if !q.Balanced() {
@@ -295,10 +941,109 @@ func (co *CfgObj) MatchSet(q *CfgQuery) bool {
 	return false
 }
 
+// Diff returns the differences in properties from co to other, sorted by key, followed by the differences in
+// TimeRanges, keyed by day. Keys only in other are DIFF_ADDED, keys only in co are DIFF_REMOVED.
+// Values are compared as written in a config file, so additive values have a leading "+".
+// UUID, FileID and Type are not compared. Use DiffWithType to also compare Type.
+func (co *CfgObj) Diff(other *CfgObj) []PropDiff {
+	keys := make([]string, 0, len(co.Props)+len(other.Props))
+	for k := range co.Props {
+		keys = append(keys, k)
+	}
+	for k := range other.Props {
+		_, exists := co.Props[k]
+		if !exists {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := make([]PropDiff, 0)
+	for _, k := range keys {
+		_, oexists := co.Props[k]
+		_, nexists := other.Props[k]
+		oval, nval := co.rawValue(k), other.rawValue(k)
+		if oexists && !nexists {
+			diffs = append(diffs, PropDiff{Key: k, Old: oval, Change: DIFF_REMOVED})
+		} else if !oexists && nexists {
+			diffs = append(diffs, PropDiff{Key: k, New: nval, Change: DIFF_ADDED})
+		} else if oval != nval {
+			diffs = append(diffs, PropDiff{Key: k, Old: oval, New: nval, Change: DIFF_MODIFIED})
+		}
+	}
+	return append(diffs, diffTimeRanges(co.TimeRanges, other.TimeRanges)...)
+}
+
+// diffTimeRanges returns the differences from old to new, keyed by day. Days occurring more than once are paired in
+// the order they occur, so entries for different days may be reordered without any difference.
+func diffTimeRanges(old, new []TimeRange) []PropDiff {
+	pos := make(map[string][]int) // positions of each day in new
+	for i := range new {
+		pos[new[i].Day] = append(pos[new[i].Day], i)
+	}
+	diffs := make([]PropDiff, 0)
+	seen := make(map[string]int)
+	for _, tr := range old {
+		n := seen[tr.Day]
+		seen[tr.Day]++
+		if n >= len(pos[tr.Day]) {
+			diffs = append(diffs, PropDiff{Key: tr.Day, Old: tr.Ranges, Change: DIFF_REMOVED})
+		} else if nr := new[pos[tr.Day][n]].Ranges; nr != tr.Ranges {
+			diffs = append(diffs, PropDiff{Key: tr.Day, Old: tr.Ranges, New: nr, Change: DIFF_MODIFIED})
+		}
+	}
+	for _, tr := range new {
+		if seen[tr.Day] > 0 {
+			seen[tr.Day]--
+			continue
+		}
+		diffs = append(diffs, PropDiff{Key: tr.Day, New: tr.Ranges, Change: DIFF_ADDED})
+	}
+	return diffs
+}
+
+// Equal returns true if other has the same type, properties and time ranges as co, and both are either disabled or not.
+// A property only equals another if both or neither are additive.
+// UUID, FileID, Indent, Align and Comment are not compared.
+func (co *CfgObj) Equal(other *CfgObj) bool {
+	if co.Type != other.Type || co.Disabled != other.Disabled || len(co.Props) != len(other.Props) || len(co.TimeRanges) != len(other.TimeRanges) {
+		return false
+	}
+	for k, v := range co.Props {
+		ov, ok := other.Props[k]
+		if !ok || ov != v || co.IsAdditive(k) != other.IsAdditive(k) {
+			return false
+		}
+	}
+	return len(diffTimeRanges(co.TimeRanges, other.TimeRanges)) == 0
+}
+
+// EqualStrict does the same as Equal, but also requires UUID and FileID to be the same
+func (co *CfgObj) EqualStrict(other *CfgObj) bool {
+	return co.UUID.Equals(other.UUID) && co.FileID == other.FileID && co.Equal(other)
+}
+
+// DiffWithType does the same as Diff, but also reports a differing Type, as a modification with key "type" first in the list
+func (co *CfgObj) DiffWithType(other *CfgObj) []PropDiff {
+	diffs := co.Diff(other)
+	if co.Type == other.Type {
+		return diffs
+	}
+	td := PropDiff{Key: "type", Old: co.Type.String(), New: other.Type.String(), Change: DIFF_MODIFIED}
+	return append([]PropDiff{td}, diffs...)
+}
+
 // generateComment is set as private, as it makes "unsafe" assumptions about the existing format of the comment
 func (co *CfgObj) generateComment() bool {
+	cmt, success := co.comment()
+	co.Comment = cmt
+	return success
+}
+
+// comment returns the header comment with the name of the object filled in, without changing co.Comment,
+// so it's safe to call while printing. success is false if the object has no name.
+func (co *CfgObj) comment() (cmt string, success bool) {
 	var name string
-	var success bool
 	var is_template bool
 	if co.Type == T_SERVICE {
 		name, success = co.GetDescription()
@@ -309,14 +1054,46 @@ func (co *CfgObj) generateComment() bool {
 	} else {
 		name, success = co.GetName()
 	}
+	cmt = co.Comment
 	if success && strings.Index(co.Comment, "%") > -1 {
 		if is_template {
-			co.Comment = fmt.Sprintf("# %s template '%s'", co.Type.String(), name)
+			cmt = fmt.Sprintf("# %s template '%s'", co.Type.String(), name)
 		} else {
-			co.Comment = fmt.Sprintf(co.Comment, name)
+			cmt = fmt.Sprintf(co.Comment, name)
 		}
 	}
-	return success
+	return cmt, success
+}
+
+// Validate checks that the object has all keys required for its type, and returns an error for each one missing.
+// Templates (register 0) are not checked. Objects using templates should be resolved first, or they will most
+// likely be reported as missing keys they inherit. See CfgMap.ValidateAll.
+func (co *CfgObj) Validate() []error {
+	if !co.Type.Valid() {
+		return []error{fmt.Errorf("Invalid object type: %d", co.Type)}
+	}
+	if co.IsTemplate() {
+		return nil
+	}
+	var errs []error
+	for _, req := range RequiredKeys[co.Type] {
+		alts := strings.Split(req, "|")
+		found := false
+		for i := range alts {
+			_, found = co.Get(alts[i])
+			if found {
+				break
+			}
+		}
+		if !found {
+			if len(alts) > 1 {
+				errs = append(errs, fmt.Errorf("%s %q is missing one of the required keys %q", co.Type.String(), objID(co), alts))
+			} else {
+				errs = append(errs, fmt.Errorf("%s %q is missing required key %q", co.Type.String(), objID(co), req))
+			}
+		}
+	}
+	return errs
 }
 
 // AutoAlign sets the CfgObj alignment/spacing to LongestKey + 2
@@ -327,95 +1104,190 @@ func (co *CfgObj) AutoAlign() int {
 
 // json stuff
 
-func (co *CfgObj) MarshalJSON() ([]byte, error) {
-	// First attempt based on https://gist.github.com/mdwhatcott/8dd2eef0042f7f1c0cd8
-	buf := bytes.NewBufferString("{")
-
-	var pmap = map[string]interface{}{
-		"uuid":   co.UUID.String(),
-		"fileid": co.FileID,
-		"type":   co.Type,
-	}
-
-	for k, v := range pmap {
-		jk, err := json.Marshal(k)
-		if err != nil {
-			return nil, err
-		}
-		jv, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		buf.WriteString(fmt.Sprintf("%s:%s,", string(jk), string(jv)))
-	}
+// cfgObjJSON is the JSON representation of a CfgObj
+type cfgObjJSON struct {
+	Type       json.RawMessage   `json:"type"` // string, or int for data written by older versions
+	Props      map[string]string `json:"props"`
+	TimeRanges []TimeRange       `json:"time_ranges,omitempty"`
+	Disabled   bool              `json:"disabled,omitempty"`
+	UUID       string            `json:"uuid"`
+	FileID     string            `json:"file_id"`
+	OldFID     string            `json:"fileid,omitempty"` // older versions used this key
+}
 
-	// Props
-	prop_k, err := json.Marshal("props")
+func (co *CfgObj) MarshalJSON() ([]byte, error) {
+	jtype, err := json.Marshal(co.Type.String())
 	if err != nil {
 		return nil, err
 	}
-	buf.WriteString(fmt.Sprintf("%s:{", string(prop_k)))
+	props := make(map[string]string, len(co.Props))
+	for k := range co.Props {
+		props[k] = co.rawValue(k)
+	}
+	return json.Marshal(cfgObjJSON{
+		Type:       jtype,
+		Props:      props,
+		TimeRanges: co.TimeRanges,
+		Disabled:   co.Disabled,
+		UUID:       co.UUID.String(),
+		FileID:     co.FileID,
+	})
+}
 
-	// loop through props
-	plen := len(co.Props)
-	cnt := 0
-	for k, v := range co.Props {
-		jkey, err := json.Marshal(k)
-		if err != nil {
-			return nil, err
-		}
-		jval, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		buf.WriteString(fmt.Sprintf("%s:%s", string(jkey), string(jval)))
-		cnt++
-		if cnt < plen {
-			buf.WriteString(",")
+// MarshalYAML implements yaml.Marshaler. The object is written as a mapping with "type" and "props",
+// with props in Nagios sort order for the objects type, to get stable diffs. Disabled objects are included, with
+// "disabled: true", as for JSON.
+func (co *CfgObj) MarshalYAML() (interface{}, error) {
+	keys := co.sortedKeys()
+	props := make(yaml.MapSlice, 0, len(keys))
+	for _, k := range keys {
+		props = append(props, yaml.MapItem{Key: k, Value: co.rawValue(k)})
+	}
+	ms := yaml.MapSlice{
+		{Key: "type", Value: co.Type.String()},
+		{Key: "props", Value: props},
+	}
+	if len(co.TimeRanges) > 0 {
+		trs := make([]yaml.MapSlice, 0, len(co.TimeRanges)) // a sequence, as days may repeat
+		for _, tr := range co.TimeRanges {
+			trs = append(trs, yaml.MapSlice{{Key: "day", Value: tr.Day}, {Key: "ranges", Value: tr.Ranges}})
 		}
+		ms = append(ms, yaml.MapItem{Key: "time_ranges", Value: trs})
 	}
-	buf.WriteString("}}")
-
-	return buf.Bytes(), nil
+	if co.Disabled {
+		ms = append(ms, yaml.MapItem{Key: "disabled", Value: true})
+	}
+	return ms, nil
 }
 
 func (co *CfgObj) UnmarshalJSON(b []byte) error {
-	var tmp map[string]interface{}
+	var tmp cfgObjJSON
 	err := json.Unmarshal(b, &tmp)
 	if err != nil {
 		return err
 	}
 
-	objtype, found := tmp["type"].(float64)
-	if !found {
-		return fmt.Errorf("Unabble to parse object type %s", dbgStr(true))
+	var ct CfgType = T_INVALID
+	var tname string
+	var tnum int
+	if json.Unmarshal(tmp.Type, &tname) == nil {
+		ct = CfgName(tname).Type()
+	} else if json.Unmarshal(tmp.Type, &tnum) == nil {
+		ct = CfgType(tnum)
 	}
-	obj := NewCfgObj(CfgType(objtype))
-	fileid, found := tmp["fileid"].(string)
-	if found {
-		obj.FileID = fileid
+	if !ct.Valid() {
+		return fmt.Errorf("Unable to parse object type %s %s", tmp.Type, dbgStr(true))
 	}
-	uuidstr, found := tmp["uuid"].(string)
-	if found {
-		u, err := UUIDFromString(uuidstr)
-		if err == nil {
-			obj.UUID = u
-		} else {
-			obj.UUID = NewUUIDv1()
-		}
+	obj := NewCfgObj(ct)
+
+	obj.FileID = tmp.FileID
+	if obj.FileID == "" {
+		obj.FileID = tmp.OldFID
+	}
+
+	u, err := UUIDFromString(tmp.UUID)
+	if err == nil {
+		obj.UUID = u
 	} else {
 		obj.UUID = NewUUIDv1()
 	}
 
-	props, found := tmp["props"].(map[string]interface{})
-	if !found {
+	if tmp.Props == nil {
 		return fmt.Errorf("Unable to parse object properties %s", dbgStr(true))
 	}
-	for k, v := range props {
-		obj.Add(k, v.(string))
+	// JSON objects have no order, so we add the properties in Nagios sort order
+	tmpobj := &CfgObj{Type: ct, Props: tmp.Props}
+	for _, k := range tmpobj.sortedKeys() {
+		obj.addRaw(k, tmp.Props[k])
 	}
+	obj.TimeRanges = tmp.TimeRanges
+	obj.Disabled = tmp.Disabled
 
 	*co = *obj
 
 	return nil
 }
+
+// dupKey returns a string that is equal for objects of the same type with identical properties,
+// regardless of UUID, order or formatting
+func (co *CfgObj) dupKey() string {
+	keys := make([]string, 0, len(co.Props))
+	for k := range co.Props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys)+2)
+	parts = append(parts, co.Type.String())
+	if co.Disabled {
+		parts = append(parts, "\x03disabled") // commented out, so not the same as a live copy
+	}
+	for _, k := range keys {
+		parts = append(parts, k+"\x00"+co.rawValue(k))
+	}
+	for _, tr := range co.TimeRanges {
+		parts = append(parts, tr.Day+"\x02"+tr.Ranges)
+	}
+	return strings.Join(parts, "\x01")
+}
+
+// Fingerprint returns a hex encoded SHA-256 of the objects type, properties and whether it's disabled.
+// It does not depend on UUID, FileID, formatting or the order properties were added in.
+func (co *CfgObj) Fingerprint() string {
+	sum := sha256.Sum256([]byte(co.dupKey()))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewLockedCfgObj returns a LockedCfgObj holding co, which should not be used directly afterwards
+func NewLockedCfgObj(co *CfgObj) *LockedCfgObj {
+	return &LockedCfgObj{co: co}
+}
+
+// Get works like CfgObj.Get
+func (lco *LockedCfgObj) Get(key string) (string, bool) {
+	lco.RLock()
+	defer lco.RUnlock()
+	return lco.co.Get(key)
+}
+
+// Set works like CfgObj.Set
+func (lco *LockedCfgObj) Set(key, val string) bool {
+	lco.Lock()
+	defer lco.Unlock()
+	return lco.co.Set(key, val)
+}
+
+// Add works like CfgObj.Add
+func (lco *LockedCfgObj) Add(key, val string) bool {
+	lco.Lock()
+	defer lco.Unlock()
+	return lco.co.Add(key, val)
+}
+
+// Del works like CfgObj.Del
+func (lco *LockedCfgObj) Del(key string) bool {
+	lco.Lock()
+	defer lco.Unlock()
+	return lco.co.Del(key)
+}
+
+// View calls fn with the object, holding a read lock. fn must not modify the object, or keep it after returning.
+func (lco *LockedCfgObj) View(fn func(co *CfgObj)) {
+	lco.RLock()
+	defer lco.RUnlock()
+	fn(lco.co)
+}
+
+// Update calls fn with the object, holding a write lock, for changes that must be done together.
+// fn must not keep the object after returning.
+func (lco *LockedCfgObj) Update(fn func(co *CfgObj)) {
+	lco.Lock()
+	defer lco.Unlock()
+	fn(lco.co)
+}
+
+// Snapshot returns a deep copy of the object, with the same UUID, that the caller is free to read and modify
+func (lco *LockedCfgObj) Snapshot() *CfgObj {
+	lco.RLock()
+	defer lco.RUnlock()
+	return lco.co.CloneKeepUUID()
+}
@@ -18,6 +18,8 @@ package nagioscfg
 
 import (
 	"regexp"
+	"sort"
+	"strconv"
 )
 
 // MatchKeys runs MatchKeys for each obj and returns a collection of CfgObjs that match
@@ -38,6 +40,17 @@ func (cos CfgObjs) MatchKeys(rx *regexp.Regexp, keys ...string) CfgObjs {
 	return nil
 }
 
+// Filter returns a new collection of the objects for which pred returns true, in the same order
+func (cos CfgObjs) Filter(pred func(*CfgObj) bool) CfgObjs {
+	m := make(CfgObjs, 0, len(cos))
+	for i := range cos {
+		if pred(cos[i]) {
+			m = append(m, cos[i])
+		}
+	}
+	return m
+}
+
 // MatchAny runs MatchAny for each obj and returns a collection of CfgObjs that match
 func (cos CfgObjs) MatchAny(rx *regexp.Regexp) CfgObjs {
 	objlen := len(cos)
@@ -78,6 +91,37 @@ func (cos CfgObjs) AutoAlign() int {
 	return align
 }
 
+// SetAll sets key to value in every object, and returns the number of objects changed
+func (cos CfgObjs) SetAll(key, value string) int {
+	if !IsValidProperty(key) {
+		return 0
+	}
+	cnt := 0
+	for i := range cos {
+		old, ok := cos[i].Get(key)
+		if ok && old == value {
+			continue
+		}
+		cos[i].Set(key, value)
+		cnt++
+	}
+	return cnt
+}
+
+// AddAll adds key with value to every object that does not already have the key, and returns the number of objects changed
+func (cos CfgObjs) AddAll(key, value string) int {
+	if !IsValidProperty(key) {
+		return 0
+	}
+	cnt := 0
+	for i := range cos {
+		if cos[i].Add(key, value) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
 // Add appends an object to CfgObjs
 func (cos *CfgObjs) Add(co *CfgObj) {
 	// Should have some duplicate checking here
@@ -104,3 +148,75 @@ func (cos *CfgObjs) DelUUID(u UUID) {
 		}
 	}
 }
+
+// Dedup returns a new CfgObjs where objects of the same type with identical properties have been removed,
+// keeping the first occurrence. UUIDs are not considered, but a disabled object is never a duplicate of a live one.
+func (cos CfgObjs) Dedup() CfgObjs {
+	seen := make(map[string]bool, len(cos))
+	res := make(CfgObjs, 0, len(cos))
+	for i := range cos {
+		key := cos[i].dupKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, cos[i])
+	}
+	return res
+}
+
+// FindDuplicates returns groups of objects that are identical by type and properties, in order of first occurrence.
+// Objects without duplicates are not included.
+func (cos CfgObjs) FindDuplicates() []CfgObjs {
+	groups := make(map[string]CfgObjs)
+	order := make([]string, 0)
+	for i := range cos {
+		key := cos[i].dupKey()
+		_, ok := groups[key]
+		if !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], cos[i])
+	}
+	res := make([]CfgObjs, 0)
+	for _, key := range order {
+		if len(groups[key]) > 1 {
+			res = append(res, groups[key])
+		}
+	}
+	return res
+}
+
+// SortByKey sorts the objects in place by the value of the given key. The sort is stable, and objects where the key
+// is missing or empty are placed last.
+func (cos CfgObjs) SortByKey(key string) {
+	sort.SliceStable(cos, func(i, j int) bool {
+		vi, _ := cos[i].Get(key)
+		vj, _ := cos[j].Get(key)
+		if vi == "" || vj == "" {
+			return vi != "" && vj == ""
+		}
+		return vi < vj
+	})
+}
+
+// SortByKeyNumeric sorts the objects in place by the numeric value of the given key. The sort is stable, and objects
+// where the key is missing or not a number are placed last.
+func (cos CfgObjs) SortByKeyNumeric(key string) {
+	num := func(co *CfgObj) (float64, bool) {
+		v, ok := co.Get(key)
+		if !ok {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	sort.SliceStable(cos, func(i, j int) bool {
+		fi, oki := num(cos[i])
+		fj, okj := num(cos[j])
+		if !oki || !okj {
+			return oki && !okj
+		}
+		return fi < fj
+	})
+}
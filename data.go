@@ -24,6 +24,7 @@ Odd, 2016-08-10 17:51
 import (
 	//"io"
 	"regexp"
+	"sync"
 )
 
 //type WriteMap map[string]CfgMap // used to sort/write out according to FileID
@@ -38,9 +39,25 @@ type CfgType int
 type CfgName string
 type CfgProp string
 type IoState int
+type ChangeKind int
+type BraceStyle int
 type CfgObjs []*CfgObj
 type CfgMap map[UUID]*CfgObj
 
+// LockedCfgObj wraps a CfgObj for use from several goroutines, e.g. an object being edited in the background
+// while being read elsewhere. Only access the object through the methods of LockedCfgObj.
+type LockedCfgObj struct {
+	sync.RWMutex
+	co *CfgObj
+}
+
+// SyncCfgMap wraps a CfgMap for use from several goroutines, e.g. a live config that is refreshed in the
+// background while being read elsewhere. Only access the config through the methods of SyncCfgMap.
+type SyncCfgMap struct {
+	sync.RWMutex
+	cm CfgMap
+}
+
 const PKGNAME string = "nagioscfg"
 const VERSION string = "2017-08-18"
 const PROJECT_PREFIX string = "github.com/vgtmnm/"
@@ -50,8 +67,16 @@ const (
 	DEF_ALIGN  int    = 31
 	SEP_CMD    string = "!"
 	SEP_LST    string = ","
+	SEP_ICMT   string = ";" // inline comment separator used when writing
 )
 
+const DEF_PROGRESS int64 = 1 << 16 // how often, in bytes, Reader.Progress is called
+const DEF_DEFINE string = "define" // keyword starting an object definition
+const DEF_FIELDS int = 6           // initial capacity for the fields of each line read, see Reader.FieldHint
+const DEF_WRITERS_PER_CPU int = 4  // files written at once per CPU when writing several files, see NagiosCfg.WriteConcurrency
+const DIFF_CONTEXT int = 3         // lines of context around each change in unified diffs
+const DEF_FOLD_CACHE int = 64      // case insensitive regexes kept for MatchAnyFold and MatchAllKeysFold, by pattern
+
 const (
 	IO_OBJ_OUT IoState = iota
 	IO_OBJ_BEGIN
@@ -59,6 +84,18 @@ const (
 	IO_OBJ_END
 )
 
+const (
+	DIFF_ADDED ChangeKind = iota
+	DIFF_REMOVED
+	DIFF_MODIFIED
+)
+
+// Where to put the closing brace of an object when writing
+const (
+	BRACE_SAME_AS_INDENT BraceStyle = iota // indented like the directives
+	BRACE_FLUSH_LEFT                       // at the start of the line, matching "define", which is always written flush left
+)
+
 const (
 	T_COMMAND CfgType = iota
 	T_CONTACT
@@ -671,30 +708,244 @@ var CfgKeySortOrder = map[string]map[CfgType]int{
 	},
 }
 
-var uuidorder UUIDs // append to this every time an object is read
+// RequiredKeys holds the required keys for each type, as checked by CfgObj.Validate, according to:
+// https://assets.nagios.com/downloads/nagioscore/docs/nagioscore/3/en/objectdefinitions.html
+// Keys separated by "|" means at least one of them is required.
+// Callers may extend or replace entries to match other Nagios flavours, but this is not concurrency-safe,
+// so it should only be done at init time, before any validation.
+var RequiredKeys = map[CfgType][]string{
+	T_COMMAND: []string{
+		"command_name",
+		"command_line",
+	},
+	T_CONTACT: []string{
+		"contact_name",
+		"host_notifications_enabled",
+		"service_notifications_enabled",
+		"host_notification_period",
+		"service_notification_period",
+		"host_notification_options",
+		"service_notification_options",
+		"host_notification_commands",
+		"service_notification_commands",
+	},
+	T_CONTACTGROUP: []string{
+		"contactgroup_name",
+		"alias",
+	},
+	T_HOST: []string{
+		"host_name",
+		"alias",
+		"address",
+		"max_check_attempts",
+		"check_period",
+		"contacts|contact_groups",
+		"notification_interval",
+		"notification_period",
+	},
+	T_HOSTDEPENDENCY: []string{
+		"dependent_host_name|dependent_hostgroup_name",
+		"host_name|hostgroup_name",
+	},
+	T_HOSTESCALATION: []string{
+		"host_name|hostgroup_name",
+		"contacts|contact_groups",
+		"first_notification",
+		"last_notification",
+		"notification_interval",
+	},
+	T_HOSTEXTINFO: []string{
+		"host_name",
+	},
+	T_HOSTGROUP: []string{
+		"hostgroup_name",
+		"alias",
+	},
+	T_SERVICE: []string{
+		"host_name|hostgroup_name",
+		"service_description",
+		"check_command",
+		"max_check_attempts",
+		"check_interval",
+		"retry_interval",
+		"check_period",
+		"notification_interval",
+		"notification_period",
+		"contacts|contact_groups",
+	},
+	T_SERVICEDEPENDENCY: []string{
+		"dependent_host_name|dependent_hostgroup_name",
+		"dependent_service_description",
+		"host_name|hostgroup_name",
+		"service_description",
+	},
+	T_SERVICEESCALATION: []string{
+		"host_name|hostgroup_name",
+		"service_description",
+		"contacts|contact_groups",
+		"first_notification",
+		"last_notification",
+		"notification_interval",
+	},
+	T_SERVICEEXTINFO: []string{
+		"host_name",
+		"service_description",
+	},
+	T_SERVICEGROUP: []string{
+		"servicegroup_name",
+		"alias",
+	},
+	T_TIMEPERIOD: []string{
+		"timeperiod_name",
+		"alias",
+	},
+}
+
+// Directives referring to other objects, and the type of object they refer to.
+// "use" is handled separately, as it refers to templates of the same type as the referring object.
+var refKeys = map[string]CfgType{
+	"check_command":  T_COMMAND,
+	"contact_groups": T_CONTACTGROUP,
+	"contacts":       T_CONTACT,
+	"host_name":      T_HOST,
+	"hostgroup_name": T_HOSTGROUP,
+}
+
+// Directives where a leading "+" means the value is appended to the inherited value, instead of replacing it
+var additiveKeys = map[string]bool{
+	"contact_groups":       true,
+	"contactgroup_members": true,
+	"contacts":             true,
+	"host_name":            true,
+	"hostgroup_members":    true,
+	"hostgroup_name":       true,
+	"hostgroups":           true,
+	"members":              true,
+	"parents":              true,
+	"servicegroup_members": true,
+	"servicegroups":        true,
+}
+
+// Directives in timeperiod objects that are not a day or date with time ranges, see TimeRange
+var timeperiodKeys = map[string]bool{
+	"alias":           true,
+	"exclude":         true,
+	"name":            true,
+	"register":        true,
+	"timeperiod_name": true,
+	"use":             true,
+}
+
+var readSeq uint64 // last sequence number given to an object read, see CfgMap.Keys. Use sync/atomic.
 
+// CfgObj is a single object definition. Its methods are not safe for concurrent use if any goroutine
+// modifies the object, see LockedCfgObj for that.
 type CfgObj struct {
 	Type    CfgType           `json:"-"`
 	UUID    UUID              `json:"uuid"`
 	Indent  int               `json:"-"`
 	Align   int               `json:"-"`
-	FileID  string            `json:"fileid"`
+	FileID  string            `json:"file_id"`
 	Comment string            `json:"-"`
 	Props   map[string]string `json:"props"`
+	// BraceStyle controls the indentation of the closing brace when printing
+	BraceStyle BraceStyle `json:"-"`
+	// InlineComments holds comments trailing a directive value on the same line, keyed by directive name
+	InlineComments map[string]string `json:"-"`
+	// LeadingComments holds the comment lines directly above the definition in the source, including the comment char
+	LeadingComments []string `json:"-"`
+	// Additive marks directives that had a leading "+", to be appended to the inherited value. Props holds the value without it.
+	Additive map[string]bool `json:"-"`
+	// TimeRanges holds the weekday and date exception entries of a timeperiod, in the order read.
+	// They are kept out of Props, as the same key, e.g. "day", may occur several times.
+	TimeRanges []TimeRange `json:"-"`
+	// Disabled marks an object that was commented out in the source, see Reader.CaptureDisabled. It's written commented out.
+	Disabled bool     `json:"-"`
+	keyOrder []string // keys in the order they were added
+	readSeq  uint64   // when the object was read, relative to all others read, or 0 if not read
+}
+
+// TimeRange is a weekday or date exception in a timeperiod, e.g. "monday 00:00-24:00" or "2009-01-01 00:00-00:00"
+type TimeRange struct {
+	Day     string `json:"day"`               // weekday, date or date range, e.g. "monday", "day 15" or "2009-01-01 - 2009-02-01 / 3"
+	Ranges  string `json:"ranges"`            // the time ranges, e.g. "00:00-09:00,17:00-24:00"
+	Comment string `json:"comment,omitempty"` // inline comment, if any
+}
+
+// PropDiff describes the difference for a single property between two CfgObjs
+type PropDiff struct {
+	Key    string
+	Old    string
+	New    string
+	Change ChangeKind
+}
+
+// KeyRX is a single query condition, matching the value of Key against RX.
+// If Negate is set, the condition is satisfied when the value does NOT match, or the key is missing.
+type KeyRX struct {
+	Key    string
+	RX     *regexp.Regexp
+	Negate bool
+}
+
+// NameIndex maps type and name to objects, see CfgMap.IndexByName
+type NameIndex map[CfgType]map[string]*CfgObj
+
+// SearchResult is a single match from CfgMap.SearchResults
+type SearchResult struct {
+	UUID    UUID
+	Obj     *CfgObj
+	Matched []string // the keys with values matching the query, sorted
+}
+
+// ConditionResult is the number of objects a single condition of a CfgQuery matches on its own, from CfgMap.Explain
+type ConditionResult struct {
+	Key     string // the key the condition applies to, several separated by commas, or empty for any key
+	Pattern string // the regex, empty for conditions on a key being present or absent
+	Negate  bool   // true for conditions from AddKeyNotRX and AddKeyAbsent
+	Group   int    // the OR group the condition belongs to, starting at 1, or 0 if not in a group
+	Matches int
+}
+
+// RefError describes a reference from one object to another object that is not defined
+type RefError struct {
+	UUID UUID   // the object with the reference
+	Key  string // the directive with the reference
+	Name string // the name referred to
+}
+
+// DepNode is a host, or a service on a host, in a DepGraph. Service is empty for hosts.
+type DepNode struct {
+	Host    string
+	Service string
+}
+
+// DepGraph is a directed graph of host and service dependencies, see CfgMap.DependencyGraph.
+// Edges go from master to dependent, i.e. from what is depended upon to what depends on it.
+type DepGraph struct {
+	Warnings   []string                     // dependencies on hosts or services that are not defined
+	dependents map[DepNode]map[DepNode]bool // master -> dependents
+	masters    map[DepNode]map[DepNode]bool // dependent -> masters
 }
 
 type CfgQuery struct {
-	Keys []string
-	RXs  []*regexp.Regexp
+	Keys     []string
+	RXs      []*regexp.Regexp
+	orGroups [][]KeyRX // each group is satisfied if any of its conditions match
+	exists   []string  // keys that must be present, with any value
+	absent   []string  // keys that must not be present
 }
 
 // Top level struct for managing collections of CfgObj
 type NagiosCfg struct {
-	SessionID UUID
-	Config    CfgMap // the full config
-	pipe      bool   // indicator of whether the content came from stdin and should be written to stdout or not
-	matches   UUIDs  // subset of config
-	inorder   UUIDs  // uuids ordered by how they were read in
+	SessionID        UUID
+	Config           CfgMap   // the full config
+	Backup           bool     // keep a .bak of each file overwritten by SaveToOrigin
+	WriteConcurrency int      // max files written at once by SaveToOrigin, 0 for runtime.NumCPU() * DEF_WRITERS_PER_CPU
+	pipe             bool     // indicator of whether the content came from stdin and should be written to stdout or not
+	matches          UUIDs    // subset of config
+	inorder          UUIDs    // uuids ordered by how they were read in
+	history          []CfgMap // previous versions of Config, saved by Apply, restored by Rollback
 }
 
 //type GenericReader interface {
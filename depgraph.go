@@ -0,0 +1,331 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+/*
+Dependency graph of hosts and services, built from hostdependency and servicedependency objects,
+for finding what is affected when something goes down.
+*/
+
+import (
+	"fmt"
+	"sort"
+)
+
+// depBuilder holds what DependencyGraph needs to know about the map while adding edges
+type depBuilder struct {
+	g         *DepGraph
+	hge       *hostgroupExpander
+	defined   map[DepNode]bool     // hosts, and services on each host
+	sgroups   map[string][]DepNode // servicegroup_name -> member services
+	sgDefined map[string]bool      // servicegroups defined by a servicegroup object
+	warned    map[string]bool      // to only warn once for each problem
+}
+
+// String returns the host name, or "host;service" for services
+func (n DepNode) String() string {
+	if n.Service == "" {
+		return n.Host
+	}
+	return n.Host + ";" + n.Service
+}
+
+// DependencyGraph builds a graph from all hostdependency and servicedependency objects in the map, e.g. for finding
+// which checks and notifications are suppressed when a host is down. Hosts and services may be given by name,
+// hostgroup or servicegroup, and a servicedependency without any dependent hosts or servicegroups applies to the
+// same host as the master, like in Nagios. Dependencies are resolved first, and an error is returned if any of
+// them fail to resolve. References to hosts, services or groups that are not defined are left out of the graph,
+// and reported in Warnings. Disabled objects are left out, as Nagios never sees them.
+func (cm CfgMap) DependencyGraph() (*DepGraph, error) {
+	b := &depBuilder{
+		g: &DepGraph{
+			dependents: make(map[DepNode]map[DepNode]bool),
+			masters:    make(map[DepNode]map[DepNode]bool),
+		},
+		hge:       cm.newHostgroupExpander(),
+		defined:   make(map[DepNode]bool),
+		sgroups:   make(map[string][]DepNode),
+		sgDefined: make(map[string]bool),
+		warned:    make(map[string]bool),
+	}
+	idx := cm.templateIndex()
+
+	deps := make(CfgObjs, 0)
+	keys := cm.Keys()
+	for i := range keys {
+		co := cm[keys[i]]
+		if co.IsTemplate() || co.Disabled {
+			continue
+		}
+		switch co.Type {
+		case T_HOST:
+			name, ok := co.Get("host_name")
+			if ok {
+				b.defined[DepNode{Host: name}] = true
+			}
+		case T_SERVICEGROUP:
+			name, ok := co.Get("servicegroup_name")
+			if !ok {
+				continue
+			}
+			b.sgDefined[name] = true
+			members := splitNames(co.Props["members"])
+			for j := 0; j+1 < len(members); j += 2 {
+				b.sgroups[name] = append(b.sgroups[name], DepNode{members[j], members[j+1]})
+			}
+		case T_SERVICE:
+			o, _, err := cm.resolve(co, idx, templateChain(co))
+			if err != nil {
+				b.warn("%s", err)
+				o = co // still the best guess at which hosts it's on
+			}
+			hosts, err := b.hge.serviceHosts(o)
+			if err != nil {
+				b.warn("%s", err)
+				continue
+			}
+			for _, h := range hosts {
+				n := DepNode{h, o.Props["service_description"]}
+				b.defined[n] = true
+				for _, sg := range splitNames(o.Props["servicegroups"]) {
+					b.sgroups[sg] = append(b.sgroups[sg], n)
+				}
+			}
+		case T_HOSTDEPENDENCY, T_SERVICEDEPENDENCY:
+			o, _, err := cm.resolve(co, idx, templateChain(co))
+			if err != nil {
+				return nil, err
+			}
+			deps = append(deps, o)
+		}
+	}
+
+	for _, d := range deps {
+		masters := b.nodes(d, "")
+		_, dhost := d.Get("dependent_host_name")
+		_, dgroup := d.Get("dependent_hostgroup_name")
+		_, dsgroup := d.Get("dependent_servicegroup_name")
+		if d.Type == T_SERVICEDEPENDENCY && !dhost && !dgroup && !dsgroup {
+			// same host dependency
+			for _, m := range masters {
+				for _, s := range splitNames(d.Props["dependent_service_description"]) {
+					b.addEdge(d, m, DepNode{m.Host, s})
+				}
+			}
+			continue
+		}
+		dependents := b.nodes(d, "dependent_")
+		for _, m := range masters {
+			for _, n := range dependents {
+				b.addEdge(d, m, n)
+			}
+		}
+	}
+	return b.g, nil
+}
+
+// warn adds a warning to the graph, unless the same warning has been added already
+func (b *depBuilder) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if b.warned[msg] {
+		return
+	}
+	b.warned[msg] = true
+	b.g.Warnings = append(b.g.Warnings, msg)
+}
+
+// nodes returns the hosts or services on one side of dependency d, from the directives starting with prefix,
+// i.e. "" for the master side, and "dependent_" for the dependent side
+func (b *depBuilder) nodes(d *CfgObj, prefix string) []DepNode {
+	res := make([]DepNode, 0)
+	hosts, err := b.hge.expandHosts(d.Props[prefix+"host_name"], d.Props[prefix+"hostgroup_name"])
+	if err != nil {
+		b.warn("%s %q: %s", d.Type.String(), objID(d), err)
+	}
+	if d.Type == T_HOSTDEPENDENCY {
+		for _, h := range hosts {
+			res = append(res, DepNode{Host: h})
+		}
+		return res
+	}
+	for _, h := range hosts {
+		for _, s := range splitNames(d.Props[prefix+"service_description"]) {
+			res = append(res, DepNode{h, s})
+		}
+	}
+	for _, sg := range splitNames(d.Props[prefix+"servicegroup_name"]) {
+		if !b.sgDefined[sg] {
+			b.warn("%s %q: undefined servicegroup %q", d.Type.String(), objID(d), sg)
+			continue
+		}
+		res = append(res, b.sgroups[sg]...)
+	}
+	return res
+}
+
+// addEdge adds an edge from master to dependent, if both are defined
+func (b *depBuilder) addEdge(d *CfgObj, master, dependent DepNode) {
+	ok := true
+	for _, n := range []DepNode{master, dependent} {
+		if !b.defined[n] {
+			b.warn("%s %q: undefined %s %q", d.Type.String(), objID(d), n.kind(), n)
+			ok = false
+		}
+	}
+	if !ok {
+		return
+	}
+	g := b.g
+	if g.dependents[master] == nil {
+		g.dependents[master] = make(map[DepNode]bool)
+	}
+	g.dependents[master][dependent] = true
+	if g.masters[dependent] == nil {
+		g.masters[dependent] = make(map[DepNode]bool)
+	}
+	g.masters[dependent][master] = true
+}
+
+// kind returns "host" or "service", for messages
+func (n DepNode) kind() string {
+	if n.Service == "" {
+		return "host"
+	}
+	return "service"
+}
+
+// sortDepNodes sorts nodes by host, then service
+func sortDepNodes(nodes []DepNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Host != nodes[j].Host {
+			return nodes[i].Host < nodes[j].Host
+		}
+		return nodes[i].Service < nodes[j].Service
+	})
+}
+
+// Nodes returns all hosts and services with at least one dependency, sorted
+func (g *DepGraph) Nodes() []DepNode {
+	set := make(map[DepNode]bool)
+	for m, deps := range g.dependents {
+		set[m] = true
+		for d := range deps {
+			set[d] = true
+		}
+	}
+	return setToDepNodes(set)
+}
+
+// Ancestors returns everything n depends on, directly or indirectly, sorted
+func (g *DepGraph) Ancestors(n DepNode) []DepNode {
+	return g.walk(n, g.masters)
+}
+
+// Descendants returns everything depending on n, directly or indirectly, sorted.
+// This is what Nagios may suppress checks or notifications for when n has problems.
+func (g *DepGraph) Descendants(n DepNode) []DepNode {
+	return g.walk(n, g.dependents)
+}
+
+// walk returns all nodes reachable from n through edges, not including n itself unless it's part of a cycle
+func (g *DepGraph) walk(n DepNode, edges map[DepNode]map[DepNode]bool) []DepNode {
+	seen := make(map[DepNode]bool)
+	queue := []DepNode{n}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for next := range edges[cur] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return setToDepNodes(seen)
+}
+
+// setToDepNodes returns the nodes in set as a sorted slice
+func setToDepNodes(set map[DepNode]bool) []DepNode {
+	res := make([]DepNode, 0, len(set))
+	for n := range set {
+		res = append(res, n)
+	}
+	sortDepNodes(res)
+	return res
+}
+
+// Cycles returns each group of nodes that depend on each other, directly or indirectly, which Nagios refuses to
+// start with. Each group is sorted, and the groups are sorted by their first node. Returns nil if there are none.
+func (g *DepGraph) Cycles() [][]DepNode {
+	// Tarjan's strongly connected components
+	var cycles [][]DepNode
+	index := make(map[DepNode]int)
+	low := make(map[DepNode]int)
+	onStack := make(map[DepNode]bool)
+	var stack []DepNode
+	next := 0
+
+	var connect func(n DepNode)
+	connect = func(n DepNode) {
+		index[n] = next
+		low[n] = next
+		next++
+		stack = append(stack, n)
+		onStack[n] = true
+		for d := range g.dependents[n] {
+			if _, ok := index[d]; !ok {
+				connect(d)
+				if low[d] < low[n] {
+					low[n] = low[d]
+				}
+			} else if onStack[d] && index[d] < low[n] {
+				low[n] = index[d]
+			}
+		}
+		if low[n] != index[n] {
+			return
+		}
+		var comp []DepNode
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			comp = append(comp, top)
+			if top == n {
+				break
+			}
+		}
+		if len(comp) > 1 || g.dependents[n][n] {
+			sortDepNodes(comp)
+			cycles = append(cycles, comp)
+		}
+	}
+
+	for _, n := range g.Nodes() {
+		if _, ok := index[n]; !ok {
+			connect(n)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool {
+		a, b := cycles[i][0], cycles[j][0]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Service < b.Service
+	})
+	return cycles
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+import (
+	"reflect"
+	"testing"
+)
+
+var depcfgstr string = `define host{
+	host_name router
+	}
+define host{
+	host_name web01
+	hostgroups web
+	}
+define host{
+	host_name web02
+	hostgroups web
+	}
+define host{
+	host_name db01
+	}
+define hostgroup{
+	hostgroup_name web
+	}
+define service{
+	name                generic-service
+	service_description HTTP
+	register            0
+	}
+define service{
+	use            generic-service
+	hostgroup_name web
+	}
+define service{
+	host_name           web01
+	service_description HTTPS
+	}
+define service{
+	host_name           db01
+	service_description MySQL
+	}
+define hostdependency{
+	host_name                router
+	dependent_hostgroup_name web
+	}
+define hostdependency{
+	host_name           router
+	dependent_host_name ghost
+	}
+define servicedependency{
+	host_name                     db01
+	service_description           MySQL
+	dependent_hostgroup_name      web
+	dependent_service_description HTTP
+	}
+define servicedependency{
+	host_name                     web01
+	service_description           HTTP
+	dependent_service_description HTTPS
+	}
+`
+
+func TestDependencyGraph(t *testing.T) {
+	g, err := readTestMap(t, depcfgstr).DependencyGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc := g.Descendants(DepNode{Host: "router"})
+	exp := []DepNode{{Host: "web01"}, {Host: "web02"}}
+	if !reflect.DeepEqual(desc, exp) {
+		t.Errorf("Expected descendants %v, got %v", exp, desc)
+	}
+
+	desc = g.Descendants(DepNode{"db01", "MySQL"})
+	exp = []DepNode{{"web01", "HTTP"}, {"web01", "HTTPS"}, {"web02", "HTTP"}}
+	if !reflect.DeepEqual(desc, exp) {
+		t.Errorf("Expected descendants %v, got %v", exp, desc)
+	}
+
+	anc := g.Ancestors(DepNode{"web01", "HTTPS"})
+	exp = []DepNode{{"db01", "MySQL"}, {"web01", "HTTP"}}
+	if !reflect.DeepEqual(anc, exp) {
+		t.Errorf("Expected ancestors %v, got %v", exp, anc)
+	}
+
+	if len(g.Warnings) != 1 {
+		t.Errorf("Expected 1 warning for the undefined host, got %q", g.Warnings)
+	}
+	if len(g.Nodes()) != 7 {
+		t.Errorf("Expected 7 nodes, got %v", g.Nodes())
+	}
+	if g.Cycles() != nil {
+		t.Errorf("Expected no cycles, got %v", g.Cycles())
+	}
+}
+
+func TestDependencyGraphCycles(t *testing.T) {
+	m := readTestMap(t, `define host{
+	host_name a
+	}
+define host{
+	host_name b
+	}
+define host{
+	host_name c
+	}
+define hostdependency{
+	host_name           a
+	dependent_host_name b
+	}
+define hostdependency{
+	host_name           b
+	dependent_host_name a,c
+	}
+define hostdependency{
+	host_name           c
+	dependent_host_name c
+	}
+`)
+	g, err := m.DependencyGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]DepNode{{{Host: "a"}, {Host: "b"}}, {{Host: "c"}}}
+	if !reflect.DeepEqual(g.Cycles(), exp) {
+		t.Errorf("Expected cycles %v, got %v", exp, g.Cycles())
+	}
+	desc := g.Descendants(DepNode{Host: "a"})
+	if len(desc) != 3 {
+		t.Errorf("Expected a to reach itself, b and c, got %v", desc)
+	}
+
+	o := NewCfgObjWithUUID(T_HOSTDEPENDENCY)
+	o.Set("use", "nosuchtemplate")
+	m[o.UUID] = o
+	_, err = m.DependencyGraph()
+	if err == nil {
+		t.Error("Expected error for dependency with undefined template")
+	}
+}
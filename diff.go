@@ -0,0 +1,244 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+/*
+Line based unified diffs, for previewing what writing config back to files would change.
+Uses the algorithm from "An O(ND) Difference Algorithm and Its Variations" by Eugene W. Myers.
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffOp is a single line in an edit script: ' ' for equal, '-' for deleted and '+' for inserted
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits s into lines, without the line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit script turning a into b
+func diffLines(a, b []string) []diffOp {
+	return myers(a, b)
+}
+
+// myers does the actual diff for diffLines, using the linear space variant from section 4b of the paper, so large
+// files don't need memory proportional to the number of lines times the number of changes
+func myers(a, b []string) []diffOp {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	// compare ints rather than strings
+	ids := make(map[string]int, len(a))
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i := range lines {
+			id, ok := ids[lines[i]]
+			if !ok {
+				id = len(ids)
+				ids[lines[i]] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	max := (len(a)+len(b)+1)/2 + 1
+	md := &myersDiff{
+		a:   a,
+		b:   b,
+		ai:  intern(a),
+		bi:  intern(b),
+		off: max + 1,
+		vf:  make([]int, 2*max+3),
+		vb:  make([]int, 2*max+3),
+		ops: make([]diffOp, 0, len(a)+len(b)),
+	}
+	md.compare(0, len(a), 0, len(b))
+	return md.ops
+}
+
+// myersDiff holds the state for myers, with the V arrays shared by all levels of recursion
+type myersDiff struct {
+	a, b   []string
+	ai, bi []int
+	off    int
+	vf, vb []int
+	ops    []diffOp
+}
+
+// compare appends the edit script turning a[alo:ahi] into b[blo:bhi]
+func (md *myersDiff) compare(alo, ahi, blo, bhi int) {
+	for alo < ahi && blo < bhi && md.ai[alo] == md.bi[blo] {
+		md.ops = append(md.ops, diffOp{' ', md.a[alo]})
+		alo++
+		blo++
+	}
+	suf := 0
+	for alo < ahi-suf && blo < bhi-suf && md.ai[ahi-1-suf] == md.bi[bhi-1-suf] {
+		suf++
+	}
+	ahi -= suf
+	bhi -= suf
+
+	if alo == ahi {
+		for i := blo; i < bhi; i++ {
+			md.ops = append(md.ops, diffOp{'+', md.b[i]})
+		}
+	} else if blo == bhi {
+		for i := alo; i < ahi; i++ {
+			md.ops = append(md.ops, diffOp{'-', md.a[i]})
+		}
+	} else {
+		x, y, u, v := md.middleSnake(alo, ahi, blo, bhi)
+		md.compare(alo, x, blo, y)
+		for i := x; i < u; i++ {
+			md.ops = append(md.ops, diffOp{' ', md.a[i]})
+		}
+		md.compare(u, ahi, v, bhi)
+	}
+
+	for i := ahi; i < ahi+suf; i++ {
+		md.ops = append(md.ops, diffOp{' ', md.a[i]})
+	}
+}
+
+// middleSnake finds the snake in the middle of a shortest edit script for a[alo:ahi] and b[blo:bhi], searching from
+// both ends at once. It returns the start and end of the snake, as positions in a and b.
+func (md *myersDiff) middleSnake(alo, ahi, blo, bhi int) (x0, y0, x1, y1 int) {
+	a, b := md.ai[alo:ahi], md.bi[blo:bhi]
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	off, vf, vb := md.off, md.vf, md.vb
+	vf[off+1] = 0
+	vb[off+1] = 0 // vb holds x counted from the end, so both searches start at 0
+
+	for d := 0; d <= (n+m+1)/2; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1] // down, i.e. insertion
+			} else {
+				x = vf[off+k-1] + 1 // right, i.e. deletion
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			// diagonal k here is diagonal delta-k in the backward search
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && x+vb[off+delta-k] >= n {
+				return alo + sx, blo + sy, alo + x, blo + y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[off+k-1] < vb[off+k+1]) {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[off+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+vf[off+delta-k] >= n {
+				return alo + n - x, blo + m - y, alo + n - sx, blo + m - sy
+			}
+		}
+	}
+	panic("no middle snake found") // can't happen, the searches always meet
+}
+
+// unifiedDiff returns a diff between a and b in unified format, like "diff -u", or "" if they are equal
+func unifiedDiff(aName, bName string, a, b []string, context int) string {
+	ops := diffLines(a, b)
+
+	// line number in a and b before each op
+	apos := make([]int, len(ops)+1)
+	bpos := make([]int, len(ops)+1)
+	for i := range ops {
+		apos[i+1] = apos[i]
+		bpos[i+1] = bpos[i]
+		if ops[i].kind != '+' {
+			apos[i+1]++
+		}
+		if ops[i].kind != '-' {
+			bpos[i+1]++
+		}
+	}
+
+	var buf strings.Builder
+	i := 0
+	for i < len(ops) {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i // last change in the hunk
+		for j := i + 1; j < len(ops) && j-end <= 2*context; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		stop := end + context + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(apos[start], apos[stop]-apos[start]), hunkRange(bpos[start], bpos[stop]-bpos[start]))
+		for _, op := range ops[start:stop] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			buf.WriteByte('\n')
+		}
+		i = stop
+	}
+	return buf.String()
+}
+
+// hunkRange formats the start line and line count of one side of a hunk, the way diff does
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start) // empty ranges refer to the line before
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
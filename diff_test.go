@@ -0,0 +1,75 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := splitLines("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n")
+	b := splitLines("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n")
+	exp := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+`
+	if d := unifiedDiff("a", "b", a, b, 3); d != exp {
+		t.Errorf("Expected:\n%s\nGot:\n%s", exp, d)
+	}
+	if d := unifiedDiff("a", "a", a, a, 3); d != "" {
+		t.Errorf("Expected no diff for equal input, got:\n%s", d)
+	}
+	exp = "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n"
+	if d := unifiedDiff("a", "b", nil, []string{"x", "y"}, 3); d != exp {
+		t.Errorf("Expected:\n%s\nGot:\n%s", exp, d)
+	}
+}
+
+// benchmarkDiffReorder diffs n lines against the same lines in a different order, which is close to the worst case
+func benchmarkDiffReorder(b *testing.B, n int) {
+	a := make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("line %d", i)
+	}
+	r := rand.New(rand.NewSource(1))
+	c := make([]string, n)
+	for i, j := range r.Perm(n) {
+		c[i] = a[j]
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		diffLines(a, c)
+	}
+}
+
+func BenchmarkDiffReorder1k(b *testing.B) { benchmarkDiffReorder(b, 1000) }
+func BenchmarkDiffReorder5k(b *testing.B) { benchmarkDiffReorder(b, 5000) }
@@ -0,0 +1,268 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+/*
+Best effort export of hosts, services and commands to Icinga2 object syntax, to help migrating.
+*/
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// icinga2Attr is an Icinga2 attribute a Nagios directive maps directly to
+type icinga2Attr struct {
+	name string
+	kind byte // 's' string, 'n' number, 'd' duration in minutes, 'b' boolean from 0/1, 'l' list of strings
+}
+
+// icinga2Attrs maps Nagios directives to Icinga2 attributes, for those that need no special handling
+var icinga2Attrs = map[string]icinga2Attr{
+	"action_url":             {"action_url", 's'},
+	"active_checks_enabled":  {"enable_active_checks", 'b'},
+	"address":                {"address", 's'},
+	"address6":               {"address6", 's'},
+	"alias":                  {"display_name", 's'},
+	"check_interval":         {"check_interval", 'd'},
+	"check_period":           {"check_period", 's'},
+	"display_name":           {"display_name", 's'},
+	"event_handler_enabled":  {"enable_event_handler", 'b'},
+	"flap_detection_enabled": {"enable_flapping", 'b'},
+	"hostgroups":             {"groups", 'l'},
+	"icon_image":             {"icon_image", 's'},
+	"icon_image_alt":         {"icon_image_alt", 's'},
+	"is_volatile":            {"volatile", 'b'},
+	"max_check_attempts":     {"max_check_attempts", 'n'},
+	"normal_check_interval":  {"check_interval", 'd'},
+	"notes":                  {"notes", 's'},
+	"notes_url":              {"notes_url", 's'},
+	"notifications_enabled":  {"enable_notifications", 'b'},
+	"passive_checks_enabled": {"enable_passive_checks", 'b'},
+	"process_perf_data":      {"enable_perfdata", 'b'},
+	"retry_check_interval":   {"retry_interval", 'd'},
+	"retry_interval":         {"retry_interval", 'd'},
+	"servicegroups":          {"groups", 'l'},
+}
+
+// icinga2Macros maps Nagios runtime macros to their Icinga2 equivalents
+var icinga2Macros = map[string]string{
+	"$HOSTADDRESS$":  "$address$",
+	"$HOSTALIAS$":    "$host.display_name$",
+	"$HOSTNAME$":     "$host.name$",
+	"$HOSTSTATE$":    "$host.state$",
+	"$SERVICEDESC$":  "$service.name$",
+	"$SERVICESTATE$": "$service.state$",
+}
+
+// icinga2Quote returns s as an Icinga2 string literal
+func icinga2Quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// icinga2Value formats val as an Icinga2 value of the given kind, or returns false if it's not valid for the kind
+func icinga2Value(val string, kind byte) (string, bool) {
+	switch kind {
+	case 'n', 'd':
+		_, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return "", false
+		}
+		if kind == 'd' {
+			return val + "m", true // Nagios intervals are in units of interval_length, 60 seconds by default
+		}
+		return val, true
+	case 'b':
+		switch val {
+		case "0":
+			return "false", true
+		case "1":
+			return "true", true
+		}
+		return "", false
+	case 'l':
+		names := splitNames(val)
+		for i := range names {
+			names[i] = icinga2Quote(names[i])
+		}
+		return "[ " + strings.Join(names, ", ") + " ]", true
+	}
+	return icinga2Quote(val), true
+}
+
+// icinga2Command returns a Nagios command_line as an Icinga2 expression, with the macros in icinga2Macros
+// translated, and $USER1$ replaced by the PluginDir constant
+func icinga2Command(cl string) string {
+	var buf strings.Builder
+	last := 0
+	scanMacros(cl, func(start, end int) {
+		m, ok := icinga2Macros[cl[start:end]]
+		if !ok {
+			return
+		}
+		buf.WriteString(cl[last:start])
+		buf.WriteString(m)
+		last = end
+	})
+	buf.WriteString(cl[last:])
+
+	parts := strings.Split(buf.String(), "$USER1$")
+	expr := make([]string, 0, 2*len(parts))
+	for i := range parts {
+		if i > 0 {
+			expr = append(expr, "PluginDir")
+		}
+		if parts[i] != "" {
+			expr = append(expr, icinga2Quote(parts[i]))
+		}
+	}
+	if len(expr) == 0 {
+		return `""`
+	}
+	return strings.Join(expr, " + ")
+}
+
+// PrintIcinga2 writes a best effort translation of a host, service or command to Icinga2 object syntax.
+// Templates (register 0) become Icinga2 templates, "use" becomes "import", and arguments in check_command become
+// vars.ARG1 etc., which the $ARGn$ macros in the command refer to. Services on more than one host, or on
+// hostgroups, become apply rules. Commands become CheckCommands, as there's no telling how they are used.
+// Directives without an Icinga2 equivalent are written as comments, to be dealt with by hand. Disabled objects are
+// written commented out.
+// Returns an error for other types, and for objects without a name.
+func (co *CfgObj) PrintIcinga2(w io.Writer) error {
+	var itype string
+	switch co.Type {
+	case T_HOST:
+		itype = "Host"
+	case T_SERVICE:
+		itype = "Service"
+	case T_COMMAND:
+		itype = "CheckCommand"
+	default:
+		return fmt.Errorf("No Icinga2 translation for %s objects", co.Type)
+	}
+
+	handled := map[string]bool{"use": true, "register": true}
+	keyword := "object"
+	name, ok := co.Get("name")
+	if co.IsTemplate() {
+		keyword = "template"
+		handled["name"] = true
+	} else {
+		name, ok = co.GetName()
+		if co.Type == T_SERVICE {
+			name, ok = co.GetDescription()
+		}
+	}
+	if !ok || name == "" {
+		return fmt.Errorf("Unable to translate %s without a name to Icinga2", co.Type)
+	}
+
+	var body []string
+	add := func(format string, args ...interface{}) {
+		body = append(body, fmt.Sprintf(format, args...))
+	}
+	for _, t := range co.GetListClean("use", SEP_LST) {
+		add("import %s", icinga2Quote(t))
+	}
+
+	switch co.Type {
+	case T_HOST:
+		handled["host_name"] = true
+	case T_SERVICE:
+		handled["service_description"] = true
+		hosts := splitNames(co.Props["host_name"])
+		groups := splitNames(co.Props["hostgroup_name"])
+		if keyword == "object" && (len(hosts) != 1 || len(groups) > 0 || strings.HasPrefix(hosts[0], "!")) {
+			keyword = "apply"
+		}
+		if keyword != "template" {
+			handled["host_name"] = true
+			handled["hostgroup_name"] = true
+		}
+		if keyword == "object" {
+			add("host_name = %s", icinga2Quote(hosts[0]))
+		}
+		if keyword == "apply" {
+			for _, h := range hosts {
+				if strings.HasPrefix(h, "!") {
+					add("ignore where host.name == %s", icinga2Quote(h[1:]))
+				} else {
+					add("assign where host.name == %s", icinga2Quote(h))
+				}
+			}
+			for _, g := range groups {
+				if strings.HasPrefix(g, "!") {
+					add("ignore where %s in host.groups", icinga2Quote(g[1:]))
+				} else {
+					add("assign where %s in host.groups", icinga2Quote(g))
+				}
+			}
+		}
+	case T_COMMAND:
+		handled["command_name"] = true
+		if cl, ok := co.Get("command_line"); ok {
+			handled["command_line"] = true
+			add("command = %s", icinga2Command(cl))
+		}
+	}
+
+	for _, k := range co.sortedKeys() {
+		if handled[k] {
+			continue
+		}
+		val := co.Props[k]
+		switch k {
+		case "check_command", "event_handler":
+			args := strings.Split(val, SEP_CMD)
+			attr := "check_command"
+			if k == "event_handler" {
+				attr = "event_command"
+			}
+			add("%s = %s", attr, icinga2Quote(args[0]))
+			for i := 1; i < len(args); i++ {
+				add("vars.ARG%d = %s", i, icinga2Quote(args[i]))
+			}
+			continue
+		}
+		attr, ok := icinga2Attrs[k]
+		if ok {
+			ival, valid := icinga2Value(val, attr.kind)
+			if valid {
+				add("%s = %s", attr.name, ival)
+				continue
+			}
+		}
+		add("// %s %s", k, val) // no equivalent, or a value we can't translate
+	}
+
+	prefix := ""
+	if co.Disabled {
+		prefix = "// " // commented out, like WriteObj does
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s%s %s %s {\n", prefix, keyword, itype, icinga2Quote(name))
+	for i := range body {
+		fmt.Fprintf(&buf, "%s  %s\n", prefix, body[i])
+	}
+	buf.WriteString(prefix + "}\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
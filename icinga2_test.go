@@ -0,0 +1,126 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintIcinga2(t *testing.T) {
+	tests := []struct {
+		ct    CfgType
+		props map[string]string
+		exp   string
+	}{
+		{
+			T_HOST,
+			map[string]string{
+				"host_name":             "web01",
+				"use":                   "generic-host",
+				"alias":                 "Web \"one\"",
+				"address":               "10.0.0.1",
+				"hostgroups":            "web,prod",
+				"check_interval":        "5",
+				"notifications_enabled": "0",
+				"contact_groups":        "admins",
+			},
+			`object Host "web01" {
+  import "generic-host"
+  display_name = "Web \"one\""
+  address = "10.0.0.1"
+  groups = [ "web", "prod" ]
+  check_interval = 5m
+  // contact_groups admins
+  enable_notifications = false
+}
+`,
+		},
+		{
+			T_SERVICE,
+			map[string]string{
+				"host_name":           "web01",
+				"service_description": "HTTP",
+				"check_command":       "check_http!80!/index.html",
+				"max_check_attempts":  "three",
+			},
+			`object Service "HTTP" {
+  host_name = "web01"
+  check_command = "check_http"
+  vars.ARG1 = "80"
+  vars.ARG2 = "/index.html"
+  // max_check_attempts three
+}
+`,
+		},
+		{
+			T_SERVICE,
+			map[string]string{
+				"host_name":           "web01,!web02",
+				"hostgroup_name":      "web",
+				"service_description": "PING",
+			},
+			`apply Service "PING" {
+  assign where host.name == "web01"
+  ignore where host.name == "web02"
+  assign where "web" in host.groups
+}
+`,
+		},
+		{
+			T_SERVICE,
+			map[string]string{
+				"name":     "generic-service",
+				"register": "0",
+			},
+			`template Service "generic-service" {
+}
+`,
+		},
+		{
+			T_COMMAND,
+			map[string]string{
+				"command_name": "check_http",
+				"command_line": "$USER1$/check_http -H $HOSTADDRESS$ -p $ARG1$",
+			},
+			`object CheckCommand "check_http" {
+  command = PluginDir + "/check_http -H $address$ -p $ARG1$"
+}
+`,
+		},
+	}
+	for i, tt := range tests {
+		co := NewCfgObj(tt.ct)
+		for k, v := range tt.props {
+			co.Set(k, v)
+		}
+		var sb strings.Builder
+		if err := co.PrintIcinga2(&sb); err != nil {
+			t.Fatalf("Test %d: %s", i, err)
+		}
+		if sb.String() != tt.exp {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tt.exp, sb.String())
+		}
+	}
+
+	if err := NewCfgObj(T_CONTACT).PrintIcinga2(&strings.Builder{}); err == nil {
+		t.Error("Expected error for unsupported type")
+	}
+	if err := NewCfgObj(T_HOST).PrintIcinga2(&strings.Builder{}); err == nil {
+		t.Error("Expected error for host without a name")
+	}
+}
@@ -27,7 +27,10 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/oddlid/oddebug"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -50,6 +53,31 @@ func NewNagiosCfg() *NagiosCfg {
 	}
 }
 
+// Apply runs fn on a copy of the config, and replaces the config with the copy only if fn returns nil.
+// The previous config is saved, and can be restored with Rollback.
+func (nc *NagiosCfg) Apply(fn func(cm CfgMap) error) error {
+	cm := nc.Config.Clone()
+	err := fn(cm)
+	if err != nil {
+		return err
+	}
+	nc.history = append(nc.history, nc.Config)
+	nc.Config = cm
+	return nil
+}
+
+// Rollback restores the config from before the last successful Apply. Returns false if there is nothing to restore.
+func (nc *NagiosCfg) Rollback() bool {
+	hlen := len(nc.history)
+	if hlen == 0 {
+		return false
+	}
+	nc.Config = nc.history[hlen-1]
+	nc.history[hlen-1] = nil
+	nc.history = nc.history[:hlen-1]
+	return true
+}
+
 func (nc *NagiosCfg) LoadFiles(files ...string) error {
 	mfr := NewMultiFileReader(files...)
 	defer mfr.Close()
@@ -59,10 +87,35 @@ func (nc *NagiosCfg) LoadFiles(files ...string) error {
 		cm[o.UUID] = o
 	}
 	nc.Config = cm
+	nc.inorder = mfr.Order()
 	nc.pipe = false
 	return nil // can change later if we use another way to read to map
 }
 
+// LoadFromMainConfig returns a new NagiosCfg with all objects from the files listed in a main config file like
+// nagios.cfg, see MainConfigFiles. It's an error if any of the listed files can't be opened.
+func LoadFromMainConfig(path string) (*NagiosCfg, error) {
+	files, err := MainConfigFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		fi, err := os.Stat(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("%s: cfg_file is a directory", files[i])
+		}
+	}
+	nc := NewNagiosCfg()
+	err = nc.LoadFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
 //func (nc *NagiosCfg) LoadFiles(files ...string) error {
 //	// Testing a variant that does not read via channels in parallell
 //	// Only for debugging duplicate entries @2017-07-24 18:58:16
@@ -94,6 +147,7 @@ func (nc *NagiosCfg) LoadFiles(files ...string) error {
 func (nc *NagiosCfg) LoadStdin() (err error) {
 	rdr := NewReader(os.Stdin)
 	nc.Config, err = rdr.ReadAllMap("")
+	nc.inorder = rdr.Order()
 	nc.pipe = true // indicator that all content came from stdin and that we don't have any FileIDs
 	return err
 }
@@ -127,12 +181,56 @@ func (nc *NagiosCfg) Search(q *CfgQuery) UUIDs {
 	return nc.matches
 }
 
+// Order returns the UUIDs of the config in the order they were read, or as given by CfgMap.Keys if not loaded from input
+func (nc *NagiosCfg) Order() UUIDs {
+	if nc.inorder == nil {
+		return nc.Config.Keys()
+	}
+	return nc.inorder
+}
+
+// SourceFiles returns the sorted list of files the objects in Config came from, i.e. the files SaveToOrigin would write
+func (nc *NagiosCfg) SourceFiles() []string {
+	files := nc.Config.UniqueFileIDs(nil)
+	sort.Strings(files)
+	return files
+}
+
+// ObjectsInFile returns the objects in Config with the given file as FileID, in the order they were read, followed
+// by any added since. Relative paths are made absolute first, like the FileIDs set by LoadFiles.
+func (nc *NagiosCfg) ObjectsInFile(path string) CfgObjs {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	res := make(CfgObjs, 0)
+	seen := make(map[UUID]bool)
+	add := func(co *CfgObj) {
+		if co.FileID == path || co.FileID == abs {
+			res = append(res, co)
+		}
+	}
+	for _, k := range nc.Order() {
+		co, ok := nc.Config[k]
+		if ok {
+			seen[k] = true
+			add(co)
+		}
+	}
+	for k, co := range nc.Config {
+		if !seen[k] {
+			add(co)
+		}
+	}
+	return res
+}
+
 func (nc *NagiosCfg) InverseResults() UUIDs {
 	if nc.matches.Empty() {
-		return uuidorder // if previous search yielded nothing, then everything is the inverse
+		return nc.Order() // if previous search yielded nothing, then everything is the inverse
 	}
 	inv := make(UUIDs, 0, nc.Config.Len()-nc.matches.Len())
-	for _, v := range uuidorder {
+	for _, v := range nc.Order() {
 		if !v.In(nc.matches) { // this is probably slow
 			inv = append(inv, v)
 		}
@@ -190,6 +288,33 @@ func (ct CfgType) Valid() bool {
 	return ct >= T_COMMAND && ct < T_INVALID
 }
 
+// IsValid is the same as Valid
+func (ct CfgType) IsValid() bool {
+	return ct.Valid()
+}
+
+// AllCfgTypes returns all valid types, in the order they are defined
+func AllCfgTypes() []CfgType {
+	types := make([]CfgType, 0, T_INVALID)
+	for ct := T_COMMAND; ct < T_INVALID; ct++ {
+		types = append(types, ct)
+	}
+	return types
+}
+
+// Plural returns the plural of the type name, e.g. "services" or "hostdependencies", as used for the file names of
+// WriteByType. Returns "unknown" for invalid types.
+func (ct CfgType) Plural() string {
+	if !ct.Valid() {
+		return "unknown"
+	}
+	name := ct.String()
+	if strings.HasSuffix(name, "y") {
+		return name[:len(name)-1] + "ies"
+	}
+	return name + "s"
+}
+
 // String returns the string representation of the CfgType
 func (ct CfgType) String() string {
 	if !ct.Valid() {
@@ -207,6 +332,24 @@ func (ct CfgType) In(types []CfgType) bool {
 	return false
 }
 
+// String returns the string representation of the ChangeKind
+func (ck ChangeKind) String() string {
+	switch ck {
+	case DIFF_ADDED:
+		return "added"
+	case DIFF_REMOVED:
+		return "removed"
+	case DIFF_MODIFIED:
+		return "modified"
+	}
+	return "INVALID_CHANGE"
+}
+
+// Error returns the RefError as a nicely formatted string
+func (re RefError) Error() string {
+	return fmt.Sprintf("%s: %s refers to undefined object %q", re.UUID, re.Key, re.Name)
+}
+
 // Type returns the int (CfgType) value for the given CfgName, or -1 if not valid
 func (cn CfgName) Type() CfgType {
 	for i := range CfgTypes {
@@ -228,6 +371,23 @@ func IsValidProperty(key string) bool {
 	return ok
 }
 
+// IsValidPropertyFor returns true if key is a known directive for objects of type ct, according to CfgKeySortOrder.
+// The template directives "name", "use" and "register" are valid for all types.
+func IsValidPropertyFor(key string, ct CfgType) bool {
+	if !IsValidProperty(key) {
+		return false
+	}
+	switch key {
+	case "name", "use", "register":
+		return true
+	}
+	pos, ok := CfgKeySortOrder[key][ct]
+	if ct == T_SERVICEDEPENDENCY && pos == 99 {
+		return false // only there for alignment in CfgKeySortOrder
+	}
+	return ok
+}
+
 func ValidCfgNames() []string {
 	l := len(CfgTypes)
 	s := make([]string, l)
@@ -242,18 +402,6 @@ func ValidCfgNames() []string {
 //	return ok
 //}
 
-// size returns the runtime bytes size for the given objects map ( to calculate objs from input file size). Only for debugging.
-/*
-func (co *CfgObj) size() int {
-	var size int
-	for k, v := range co.Props {
-		size += co.Indent + (co.Align - len(k)) + len(v)
-	}
-	size += 64 // approx buffer for comments etc.
-	return size
-}
-*/
-
 func NewCfgQuery() *CfgQuery {
 	return &CfgQuery{
 		Keys: make([]string, 0, 2),
@@ -301,6 +449,286 @@ func (cq *CfgQuery) AddKeyRX(key, re string) bool {
 	return cq.AddRX(re) && cq.AddKey(key)
 }
 
+// NewKeyRX compiles re and returns a KeyRX for use in an OR group
+func NewKeyRX(key, re string) (KeyRX, error) {
+	if !IsValidProperty(key) {
+		return KeyRX{}, fmt.Errorf("Invalid key: %q %s", key, dbgStr(true))
+	}
+	rx, err := regexp.Compile(re)
+	if err != nil {
+		return KeyRX{}, err
+	}
+	return KeyRX{Key: key, RX: rx}, nil
+}
+
+// Match returns true if co has the key, and its value matches the regex.
+// For negated conditions, it returns true if the key is missing or the value does not match.
+func (kr KeyRX) Match(co *CfgObj) bool {
+	v, ok := co.Get(kr.Key)
+	if !ok {
+		return kr.Negate
+	}
+	return kr.RX.MatchString(v) != kr.Negate
+}
+
+// AddKeyNotRX adds a negated condition, excluding objects where the value for key matches re.
+// Objects missing the key are not excluded. Negated conditions are ANDed with all other conditions.
+func (cq *CfgQuery) AddKeyNotRX(key, re string) bool {
+	kr, err := NewKeyRX(key, re)
+	if err != nil {
+		log.Errorf("%q %s", err, dbgStr(true))
+		return false
+	}
+	kr.Negate = true
+	cq.orGroups = append(cq.orGroups, []KeyRX{kr})
+	return true
+}
+
+// AddOrGroup adds a group of conditions where only one needs to match.
+// Precedence: each OR group is evaluated on its own, and the result is ANDed with all other groups
+// and with the conditions added via AddKeyRX/AddKey/AddRX. E.g. adding (A), then the group (B, C) gives: A AND (B OR C).
+func (cq *CfgQuery) AddOrGroup(conds ...KeyRX) bool {
+	if len(conds) == 0 {
+		log.Errorf("Empty OR group %s", dbgStr(true))
+		return false
+	}
+	for i := range conds {
+		if conds[i].RX == nil || !IsValidProperty(conds[i].Key) {
+			log.Errorf("Invalid condition in OR group: %q %s", conds[i].Key, dbgStr(true))
+			return false
+		}
+	}
+	cq.orGroups = append(cq.orGroups, conds)
+	return true
+}
+
+// AddKeyExists adds a condition that the key must be present, with any value, even an empty one
+func (cq *CfgQuery) AddKeyExists(key string) bool {
+	if !IsValidProperty(key) {
+		log.Errorf("Invalid key: %q %s", key, dbgStr(true))
+		return false
+	}
+	cq.exists = append(cq.exists, key)
+	return true
+}
+
+// AddKeyAbsent adds a condition that the key must not be present
+func (cq *CfgQuery) AddKeyAbsent(key string) bool {
+	if !IsValidProperty(key) {
+		log.Errorf("Invalid key: %q %s", key, dbgStr(true))
+		return false
+	}
+	cq.absent = append(cq.absent, key)
+	return true
+}
+
+// hasConds returns true if the query has any conditions besides Keys/RXs
+func (cq *CfgQuery) hasConds() bool {
+	return len(cq.orGroups) > 0 || len(cq.exists) > 0 || len(cq.absent) > 0
+}
+
+// matchConds checks co against all conditions besides Keys/RXs
+func (cq *CfgQuery) matchConds(co *CfgObj) bool {
+	for _, k := range cq.exists {
+		if _, ok := co.Props[k]; !ok {
+			return false
+		}
+	}
+	for _, k := range cq.absent {
+		if _, ok := co.Props[k]; ok {
+			return false
+		}
+	}
+	for _, group := range cq.orGroups {
+		matched := false
+		for i := range group {
+			if group[i].Match(co) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Match checks a single object against the query, with the same semantics as CfgMap.Search
+func (cq *CfgQuery) Match(co *CfgObj) bool {
+	klen := len(cq.Keys)
+	rlen := len(cq.RXs)
+	if rlen == 0 {
+		return cq.hasConds() && cq.matchConds(co)
+	}
+	for i := range cq.RXs {
+		var ok bool
+		if klen == 0 {
+			ok = co.MatchAny(cq.RXs[i])
+		} else if klen > rlen {
+			ok = co.MatchAnyKeys(cq.RXs[i], cq.Keys...)
+		} else if rlen > klen {
+			ok = co.MatchAllKeys(cq.RXs[i], cq.Keys...)
+		} else {
+			ok = co.MatchSet(cq)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return cq.matchConds(co)
+}
+
+// matchedKeys returns the keys of co with values that satisfy a positive condition in the query
+func (cq *CfgQuery) matchedKeys(co *CfgObj) []string {
+	found := make(map[string]bool)
+	match := func(key string, rx *regexp.Regexp) {
+		v, ok := co.Get(key)
+		if ok && rx.MatchString(v) {
+			found[key] = true
+		}
+	}
+	for i, rx := range cq.RXs {
+		if len(cq.Keys) == 0 {
+			for k := range co.Props {
+				match(k, rx)
+			}
+		} else if cq.Balanced() {
+			match(cq.Keys[i], rx)
+		} else {
+			for _, k := range cq.Keys {
+				match(k, rx)
+			}
+		}
+	}
+	for _, group := range cq.orGroups {
+		for _, kr := range group {
+			if !kr.Negate {
+				match(kr.Key, kr.RX)
+			}
+		}
+	}
+	for _, k := range cq.exists {
+		if _, ok := co.Props[k]; ok {
+			found[k] = true
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyRXJSON is the JSON representation of a KeyRX
+type keyRXJSON struct {
+	Key     string `json:"key"`
+	Pattern string `json:"pattern"`
+	Negate  bool   `json:"negate"`
+}
+
+// cfgQueryJSON is the JSON representation of a CfgQuery.
+// Balanced queries are stored as a list of conditions, unbalanced ones as separate lists of keys and patterns.
+type cfgQueryJSON struct {
+	Conditions []KeyRX   `json:"conditions,omitempty"`
+	Keys       []string  `json:"keys,omitempty"`
+	Patterns   []string  `json:"patterns,omitempty"`
+	Groups     [][]KeyRX `json:"groups,omitempty"`
+	Exists     []string  `json:"exists,omitempty"`
+	Absent     []string  `json:"absent,omitempty"`
+}
+
+func (kr KeyRX) MarshalJSON() ([]byte, error) {
+	pattern := ""
+	if kr.RX != nil {
+		pattern = kr.RX.String()
+	}
+	return json.Marshal(keyRXJSON{Key: kr.Key, Pattern: pattern, Negate: kr.Negate})
+}
+
+func (kr *KeyRX) UnmarshalJSON(data []byte) error {
+	var kj keyRXJSON
+	err := json.Unmarshal(data, &kj)
+	if err != nil {
+		return err
+	}
+	nkr, err := NewKeyRX(kj.Key, kj.Pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid condition for key %q with pattern %q: %s", kj.Key, kj.Pattern, err)
+	}
+	nkr.Negate = kj.Negate
+	*kr = nkr
+	return nil
+}
+
+func (cq CfgQuery) MarshalJSON() ([]byte, error) {
+	var qj cfgQueryJSON
+	if cq.Balanced() {
+		qj.Conditions = make([]KeyRX, len(cq.Keys))
+		for i := range cq.Keys {
+			qj.Conditions[i] = KeyRX{Key: cq.Keys[i], RX: cq.RXs[i]}
+		}
+	} else {
+		qj.Keys = cq.Keys
+		qj.Patterns = make([]string, len(cq.RXs))
+		for i := range cq.RXs {
+			qj.Patterns[i] = cq.RXs[i].String()
+		}
+	}
+	qj.Groups = cq.orGroups
+	qj.Exists = cq.exists
+	qj.Absent = cq.absent
+	return json.Marshal(qj)
+}
+
+func (cq *CfgQuery) UnmarshalJSON(data []byte) error {
+	var qj cfgQueryJSON
+	err := json.Unmarshal(data, &qj)
+	if err != nil {
+		return err
+	}
+	q := NewCfgQuery()
+	for _, kr := range qj.Conditions {
+		if kr.Negate {
+			return fmt.Errorf("Negated condition for key %q must be in a group", kr.Key)
+		}
+		q.Keys = append(q.Keys, kr.Key)
+		q.RXs = append(q.RXs, kr.RX)
+	}
+	for _, key := range qj.Keys {
+		if !IsValidProperty(key) {
+			return fmt.Errorf("Invalid key: %q", key)
+		}
+		q.Keys = append(q.Keys, key)
+	}
+	for _, pattern := range qj.Patterns {
+		rx, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %q: %s", pattern, err)
+		}
+		q.RXs = append(q.RXs, rx)
+	}
+	for _, group := range qj.Groups {
+		if len(group) == 0 {
+			return fmt.Errorf("Empty group in query")
+		}
+		q.orGroups = append(q.orGroups, group)
+	}
+	for _, key := range qj.Exists {
+		if !q.AddKeyExists(key) {
+			return fmt.Errorf("Invalid key: %q", key)
+		}
+	}
+	for _, key := range qj.Absent {
+		if !q.AddKeyAbsent(key) {
+			return fmt.Errorf("Invalid key: %q", key)
+		}
+	}
+	*cq = *q
+	return nil
+}
+
 // for debugging only
 //func findDups(u UUIDs) UUIDs {
 //	var ret UUIDs
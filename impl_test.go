@@ -17,14 +17,17 @@
 package nagioscfg
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"regexp"
-	"testing"
 	"strings"
+	"sync"
+	"testing"
 )
 
 var co = NewCfgObj(T_SERVICE)
@@ -121,6 +124,32 @@ func TestLongestKey(t *testing.T) {
 	}
 }
 
+func TestLongestKeyCollection(t *testing.T) {
+	cm := readTestMap(t, `define host{
+	host_name web01
+	}
+define service{
+	host_name                     web01
+	service_description           HTTP
+	notification_period           24x7
+	}
+`)
+	exp := len("service_description")
+	if cm.LongestKey() != exp {
+		t.Errorf("Expected CfgMap.LongestKey %d, got %d", exp, cm.LongestKey())
+	}
+	cos := make(CfgObjs, 0, len(cm))
+	for _, v := range cm {
+		cos = append(cos, v)
+	}
+	if cos.LongestKey() != exp {
+		t.Errorf("Expected CfgObjs.LongestKey %d, got %d", exp, cos.LongestKey())
+	}
+	if (CfgObjs{}).LongestKey() != 0 || (CfgMap{}).LongestKey() != 0 {
+		t.Error("Expected 0 for empty collections")
+	}
+}
+
 func TestSetList(t *testing.T) {
 	exists := co.SetList(keys[4], SEP_CMD, cmd...)
 	if exists {
@@ -149,6 +178,22 @@ func TestGetList(t *testing.T) {
 	}
 }
 
+func TestGetListClean(t *testing.T) {
+	o := NewCfgObj(T_SERVICE)
+	o.Set("contact_groups", "+ops, devs , ,")
+	lst := o.GetListClean("contact_groups", SEP_LST)
+	if !reflect.DeepEqual(lst, []string{"ops", "devs"}) {
+		t.Errorf("Expected [ops devs], got %q", lst)
+	}
+	o.Set("contact_groups", " , ")
+	if lst = o.GetListClean("contact_groups", SEP_LST); lst == nil || len(lst) != 0 {
+		t.Errorf("Expected empty list, got %q", lst)
+	}
+	if o.GetListClean("contacts", SEP_LST) != nil {
+		t.Error("Expected nil for missing key")
+	}
+}
+
 func TestGetCheckCommand(t *testing.T) {
 	lst := co.GetCheckCommand()
 	if lst == nil {
@@ -263,6 +308,27 @@ func TestGenerateComment(t *testing.T) {
 
 }
 
+func TestTouch(t *testing.T) {
+	tmpl := NewCfgObjWithUUID(T_SERVICE)
+	tmpl.Set("host_name", "web01")
+	tmpl.Set("service_description", "HTTP")
+	tmpl.generateComment()
+
+	co := tmpl.CloneKeepUUID()
+	co.Set("service_description", "HTTPS")
+	co.Touch()
+	if co.UUID.Equals(tmpl.UUID) {
+		t.Error("Expected a new UUID after Touch")
+	}
+	exp := "# service 'HTTPS'"
+	if co.Comment != exp {
+		t.Errorf("Expected comment %q, got %q", exp, co.Comment)
+	}
+	if tmpl.Comment != "# service 'HTTP'" {
+		t.Errorf("Original comment changed to %q", tmpl.Comment)
+	}
+}
+
 func TestPrintPropsSorted(t *testing.T) {
 	objstr := `#comment 
 define service{
@@ -282,6 +348,64 @@ define service{
 	co.PrintPropsSorted(os.Stdout, "%s = %s\n")
 }
 
+func TestCanonicalizeOrder(t *testing.T) {
+	m := readTestMap(t, `define service{
+	contacts            odd
+	service_description PigInABlanket
+	host_name           pighost04
+	}
+`)
+	var before, after bytes.Buffer
+	for _, co := range m {
+		co.PrintProps(&before, "%s %s\n")
+	}
+	if before.String() != "contacts odd\nservice_description PigInABlanket\nhost_name pighost04\n" {
+		t.Errorf("Expected PrintProps in read order, got %q", before.String())
+	}
+
+	m.CanonicalizeOrder()
+	for _, co := range m {
+		co.PrintProps(&after, "%s %s\n")
+		var sorted bytes.Buffer
+		co.PrintPropsSorted(&sorted, "%s %s\n")
+		if after.String() != sorted.String() {
+			t.Errorf("Expected PrintProps %q to match PrintPropsSorted %q", after.String(), sorted.String())
+		}
+		co.Set("notes", "added later")
+		if co.originalKeys()[len(co.Props)-1] != "notes" {
+			t.Error("Expected keys added after CanonicalizeOrder to come last")
+		}
+	}
+}
+
+func TestKeysValues(t *testing.T) {
+	co := NewCfgObj(T_SERVICE)
+	co.Set("contacts", "odd")
+	co.Set("service_description", "PigInABlanket")
+	co.Set("host_name", "pighost04")
+	co.Props["_zeta"] = "z" // unknown keys can only be put in directly
+	co.Props["_alpha"] = "a"
+
+	keys := co.Keys()
+	vals := co.Values()
+	if len(keys) != 5 || len(vals) != 5 {
+		t.Fatalf("Expected 5 keys and values, got %d and %d", len(keys), len(vals))
+	}
+	for i := 1; i < 3; i++ {
+		if CfgKeySortOrder[keys[i-1]][T_SERVICE] > CfgKeySortOrder[keys[i]][T_SERVICE] {
+			t.Errorf("Expected known keys in canonical order, got %v", keys)
+		}
+	}
+	if keys[3] != "_alpha" || keys[4] != "_zeta" {
+		t.Errorf("Expected unknown keys last, sorted, got %v", keys)
+	}
+	for i := range keys {
+		if vals[i] != co.Props[keys[i]] {
+			t.Errorf("Value %q for %q does not match %q", vals[i], keys[i], co.Props[keys[i]])
+		}
+	}
+}
+
 func BenchmarkPrintProps(b *testing.B) {
 	objstr := `#comment 
 define service{
@@ -413,6 +537,12 @@ func BenchmarkNewCfgObj(b *testing.B) {
 	}
 }
 
+func BenchmarkNewCfgObjHint(b *testing.B) {
+	for i := 0; i <= b.N; i++ {
+		NewCfgObjHint(T_SERVICE, 16)
+	}
+}
+
 func BenchmarkNewCfgObjWithUUID(b *testing.B) {
 	for i := 0; i <= b.N; i++ {
 		NewCfgObjWithUUID(T_SERVICE)
@@ -541,3 +671,1465 @@ func TestCfgMapSearch(t *testing.T) {
 		m[u[i]].Print(os.Stdout, true)
 	}
 }
+
+func TestClone(t *testing.T) {
+	o := NewCfgObjWithUUID(T_HOST)
+	o.Add("host_name", "gris")
+	o.Add("alias", "Gris")
+	o.FileID = "/tmp/hosts.cfg"
+
+	c := o.Clone()
+	if c.UUID.Equals(o.UUID) {
+		t.Error("Clone should have a new UUID")
+	}
+	if c.FileID != o.FileID || c.Type != o.Type || c.Align != o.Align {
+		t.Error("Clone should have the same FileID, Type and Align as the original")
+	}
+	c.Set("host_name", "hund")
+	c.Add("address", "127.0.0.1")
+	c.Del("alias")
+	if o.Props["host_name"] != "gris" || len(o.Props) != 2 {
+		t.Errorf("Modifying the clone changed the original: %v", o.Props)
+	}
+
+	k := o.CloneKeepUUID()
+	if !k.UUID.Equals(o.UUID) {
+		t.Error("CloneKeepUUID should keep the UUID")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	o1 := NewCfgObj(T_HOST)
+	o1.Add("host_name", "gris")
+	o1.Add("alias", "Gris")
+	o1.Add("address", "10.0.0.1")
+	o2 := o1.Clone()
+	o2.Del("alias")
+	o2.Set("address", "10.0.0.2")
+	o2.Add("notes", "oink")
+
+	exp := []PropDiff{
+		{Key: "address", Old: "10.0.0.1", New: "10.0.0.2", Change: DIFF_MODIFIED},
+		{Key: "alias", Old: "Gris", Change: DIFF_REMOVED},
+		{Key: "notes", New: "oink", Change: DIFF_ADDED},
+	}
+	diffs := o1.Diff(o2)
+	if !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("Expected %v, got %v", exp, diffs)
+	}
+
+	o2.Type = T_HOSTEXTINFO
+	if len(o1.Diff(o2)) != 3 {
+		t.Error("Diff should not compare Type")
+	}
+	diffs = o1.DiffWithType(o2)
+	if len(diffs) != 4 || diffs[0].Key != "type" {
+		t.Errorf("DiffWithType should report differing type first, got %v", diffs)
+	}
+	if len(o1.Diff(o1.Clone())) != 0 {
+		t.Error("Clone should not differ from original")
+	}
+}
+
+func TestDiffTimeRanges(t *testing.T) {
+	o1 := NewCfgObj(T_TIMEPERIOD)
+	o1.Add("timeperiod_name", "workhours")
+	o1.AddTimeRange("monday", "09:00-17:00")
+	o1.AddTimeRange("tuesday", "09:00-17:00")
+	o1.AddTimeRange("day 1", "00:00-24:00")
+	o2 := o1.Clone()
+	o2.TimeRanges[1].Ranges = "10:00-17:00"
+	o2.TimeRanges = append(o2.TimeRanges[:2], TimeRange{Day: "day 1", Ranges: "00:00-12:00"})
+	o2.AddTimeRange("wednesday", "09:00-17:00")
+
+	exp := []PropDiff{
+		{Key: "tuesday", Old: "09:00-17:00", New: "10:00-17:00", Change: DIFF_MODIFIED},
+		{Key: "day 1", Old: "00:00-24:00", New: "00:00-12:00", Change: DIFF_MODIFIED},
+		{Key: "wednesday", New: "09:00-17:00", Change: DIFF_ADDED},
+	}
+	diffs := o1.Diff(o2)
+	if !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("Expected %v, got %v", exp, diffs)
+	}
+	if o1.Equal(o2) {
+		t.Error("Expected objects with differing time ranges to not be Equal")
+	}
+
+	// reordering days is no difference, but repeated days are paired in order
+	o3 := o1.Clone()
+	o3.TimeRanges[0], o3.TimeRanges[1] = o3.TimeRanges[1], o3.TimeRanges[0]
+	if len(o1.Diff(o3)) != 0 || !o1.Equal(o3) {
+		t.Errorf("Expected reordered days to not differ, got %v", o1.Diff(o3))
+	}
+	o3.AddTimeRange("day 1", "00:00-01:00")
+	exp = []PropDiff{{Key: "day 1", New: "00:00-01:00", Change: DIFF_ADDED}}
+	if diffs = o1.Diff(o3); !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("Expected %v, got %v", exp, diffs)
+	}
+	exp = []PropDiff{{Key: "day 1", Old: "00:00-01:00", Change: DIFF_REMOVED}}
+	if diffs = o3.Diff(o1); !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("Expected %v, got %v", exp, diffs)
+	}
+}
+
+var querycfgstr string = `define service{
+	host_name           db_dummy_gso
+	service_description Oracle mutex
+	check_command       vgt_oracle_mutex!1
+	}
+define service{
+	host_name           db_dummy_test
+	service_description Oracle sessions
+	check_command       vgt_oracle_sessions!1
+	}
+define service{
+	host_name           web01
+	service_description HTTP
+	check_command       check_http
+	}
+`
+
+func TestSearchOrGroup(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	a, _ := NewKeyRX("host_name", `^web`)
+	b, _ := NewKeyRX("service_description", `mutex`)
+
+	// only an OR group
+	q := NewCfgQuery()
+	if !q.AddOrGroup(a, b) {
+		t.Fatal("Failed to add OR group")
+	}
+	u := m.Search(q)
+	if len(u) != 2 {
+		t.Errorf("Expected 2 matches for OR group, got %d", len(u))
+	}
+
+	// AND combined with OR
+	q = NewCfgQuery()
+	q.AddKeyRX("check_command", `^vgt_oracle`)
+	q.AddOrGroup(a, b)
+	u = m.Search(q)
+	if len(u) != 1 {
+		t.Fatalf("Expected 1 match for AND + OR, got %d", len(u))
+	}
+	if m[u[0]].Props["service_description"] != "Oracle mutex" {
+		t.Errorf("Wrong object matched: %v", m[u[0]].Props)
+	}
+
+	// two OR groups are ANDed
+	c, _ := NewKeyRX("host_name", `test`)
+	q = NewCfgQuery()
+	q.AddOrGroup(a, b)
+	q.AddOrGroup(c)
+	if u = m.Search(q); u != nil {
+		t.Errorf("Expected no matches, got %d", len(u))
+	}
+}
+
+func TestSearchKeyNotRX(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+
+	q := NewCfgQuery()
+	q.AddKeyRX("check_command", `vgt_oracle`)
+	if !q.AddKeyNotRX("host_name", `test`) {
+		t.Fatal("Failed to add negated condition")
+	}
+	u := m.Search(q)
+	if len(u) != 1 || m[u[0]].Props["host_name"] != "db_dummy_gso" {
+		t.Errorf("Expected only db_dummy_gso to match, got %d matches", len(u))
+	}
+
+	// a missing key does not exclude anything
+	q = NewCfgQuery()
+	q.AddKeyNotRX("notes", `.*`)
+	u = m.Search(q)
+	if len(u) != 3 {
+		t.Errorf("Expected 3 matches, got %d", len(u))
+	}
+}
+
+func TestExplain(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+
+	q := NewCfgQuery()
+	q.AddKeyRX("check_command", `^vgt_oracle`)
+	q.AddKeyRX("host_name", `^web`)
+	q.AddKeyAbsent("notes")
+	q.AddKeyNotRX("host_name", `test`)
+	if u := m.Search(q); u != nil {
+		t.Fatalf("Expected no matches, got %d", len(u))
+	}
+
+	exp := []ConditionResult{
+		{Key: "check_command", Pattern: `^vgt_oracle`, Matches: 2},
+		{Key: "host_name", Pattern: `^web`, Matches: 1},
+		{Key: "notes", Negate: true, Matches: 3},
+		{Key: "host_name", Pattern: `test`, Negate: true, Group: 1, Matches: 2},
+	}
+	res := m.Explain(q)
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("Expected:\n%+v\ngot:\n%+v", exp, res)
+	}
+
+	// unbalanced, no keys
+	q = NewCfgQuery()
+	q.AddRX(`Oracle`)
+	q.AddRX(`!1$`)
+	res = m.Explain(q)
+	if len(res) != 2 || res[0].Key != "" || res[0].Matches != 2 || res[1].Matches != 2 {
+		t.Errorf("Unexpected result for RXs without keys: %+v", res)
+	}
+}
+
+func TestMatchFold(t *testing.T) {
+	o := NewCfgObj(T_SERVICE)
+	o.Add("host_name", "DB_Dummy_GSO")
+	o.Add("service_description", "Oracle Mutex")
+	rx := regexp.MustCompile(`db_dummy`)
+
+	if o.MatchAny(rx) || o.MatchAllKeys(rx, "host_name") {
+		t.Error("Case sensitive match should fail")
+	}
+	if !o.MatchAnyFold(rx) {
+		t.Error("MatchAnyFold should match")
+	}
+	if !o.MatchAllKeysFold(regexp.MustCompile(`(MUTEX|gso)$`), "host_name", "service_description") {
+		t.Error("MatchAllKeysFold should match")
+	}
+	if foldRX(rx) != foldRX(regexp.MustCompile(`db_dummy`)) {
+		t.Error("Expected the folded regex to be compiled once per pattern")
+	}
+
+	// only the last DEF_FOLD_CACHE patterns are kept
+	first := foldRX(regexp.MustCompile(`^fold0$`))
+	for i := 1; i <= DEF_FOLD_CACHE; i++ {
+		foldRX(regexp.MustCompile(fmt.Sprintf(`^fold%d$`, i)))
+	}
+	folded.Lock()
+	n := len(folded.rx)
+	folded.Unlock()
+	if n != DEF_FOLD_CACHE {
+		t.Errorf("Expected %d cached regexes, got %d", DEF_FOLD_CACHE, n)
+	}
+	if foldRX(regexp.MustCompile(`^fold0$`)) == first {
+		t.Error("Expected the oldest pattern to be dropped from the cache")
+	}
+}
+
+func BenchmarkMatchAnyFold(b *testing.B) {
+	o := NewCfgObj(T_SERVICE)
+	o.Add("host_name", "DB_Dummy_GSO")
+	o.Add("service_description", "Oracle Mutex")
+	rx := regexp.MustCompile(`oracle (mutex|sessions)`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.MatchAnyFold(rx)
+	}
+}
+
+func TestFilterByType(t *testing.T) {
+	m := readTestMap(t, cfgobjstr)
+	svcs := m.FilterByType(T_SERVICE)
+	if svcs.Len() != 2 {
+		t.Errorf("Expected 2 services, got %d", svcs.Len())
+	}
+	if m.Len() != 3 {
+		t.Error("FilterByType should not modify the original map")
+	}
+	cnt := m.CountByType()
+	if cnt[T_SERVICE] != 2 || cnt[T_COMMAND] != 1 || cnt[T_HOST] != 0 {
+		t.Errorf("Unexpected count: %v", cnt)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	pred := func(co *CfgObj) bool {
+		return strings.HasPrefix(co.Props["host_name"], "db_")
+	}
+	f := m.Filter(pred)
+	if f.Len() != 2 || m.Len() != 3 {
+		t.Errorf("Expected 2 of 3 objects, got %d of %d", f.Len(), m.Len())
+	}
+	keys := m.Keys()
+	cos := CfgObjs{m[keys[2]], m[keys[0]], m[keys[1]]}
+	fcos := cos.Filter(pred)
+	if len(fcos) != 2 || fcos[0] != cos[1] || fcos[1] != cos[2] {
+		t.Errorf("Expected filtered objects in the original order, got %v", fcos)
+	}
+	if n := len(cos.Filter(func(*CfgObj) bool { return false })); n != 0 {
+		t.Errorf("Expected no objects, got %d", n)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	m := readTestMap(t, `define host{
+	host_name  web01
+	hostgroups web, linux
+	}
+define host{
+	host_name  db01
+	hostgroups linux
+	}
+define service{
+	host_name           web01
+	service_description HTTP
+	}
+define service{
+	host_name           web01
+	service_description PING
+	}
+`)
+	g := m.GroupBy("host_name")
+	if len(g["web01"]) != 3 || len(g["db01"]) != 1 {
+		t.Errorf("Unexpected groups: %v", g)
+	}
+	g = m.FilterByType(T_SERVICE).GroupBy("host_name")
+	if len(g) != 1 || len(g["web01"]) != 2 {
+		t.Errorf("Unexpected service groups: %v", g)
+	}
+	g = m.GroupByList("hostgroups", SEP_LST)
+	if len(g) != 2 || len(g["linux"]) != 2 || len(g["web"]) != 1 {
+		t.Errorf("Unexpected hostgroup groups: %v", g)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	o := NewCfgObj(T_COMMAND)
+	o.Add("command_name", "check_gris")
+	errs := o.Validate()
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %d: %v", len(errs), errs)
+	}
+	t.Log(errs[0])
+	o.Add("command_line", "/bin/true")
+	if errs = o.Validate(); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	o = NewCfgObj(T_SERVICEEXTINFO)
+	o.Add("service_description", "PING")
+	if errs = o.Validate(); len(errs) != 1 {
+		t.Errorf("Expected 1 error, got %v", errs)
+	}
+	o.Add("register", "0")
+	if errs = o.Validate(); len(errs) != 0 {
+		t.Errorf("Templates should not be validated, got %v", errs)
+	}
+}
+
+func TestRequiredKeysCustom(t *testing.T) {
+	orig := RequiredKeys[T_COMMAND]
+	defer func() { RequiredKeys[T_COMMAND] = orig }()
+	RequiredKeys[T_COMMAND] = append([]string{"op5_owner"}, orig...)
+
+	o := NewCfgObj(T_COMMAND)
+	o.Add("command_name", "check_gris")
+	o.Add("command_line", "/bin/true")
+	errs := o.Validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "op5_owner") {
+		t.Errorf("Expected error for custom required key, got %v", errs)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	m := readTestMap(t, `define hostgroup{
+	name     generic-hostgroup
+	alias    Generic
+	register 0
+	}
+define hostgroup{
+	use            generic-hostgroup
+	hostgroup_name linux
+	}
+define hostgroup{
+	hostgroup_name windows
+	}
+`)
+	res := m.ValidateAll()
+	if len(res) != 1 {
+		t.Fatalf("Expected errors for 1 object, got %d: %v", len(res), res)
+	}
+	for k := range res {
+		if m[k].Props["hostgroup_name"] != "windows" {
+			t.Errorf("Unexpected object failed validation: %v", m[k].Props)
+		}
+	}
+}
+
+func TestCheckReferences(t *testing.T) {
+	m := readTestMap(t, `define host{
+	host_name web01
+	}
+define contactgroup{
+	contactgroup_name ops
+	}
+define command{
+	command_name check_http
+	}
+define service{
+	use                 generic-service
+	host_name           web01, web02
+	service_description HTTP
+	check_command       check_http!80
+	contact_groups      ops,devs
+	}
+`)
+	errs := m.CheckReferences()
+	exp := map[string]string{
+		"generic-service": "use",
+		"web02":           "host_name",
+		"devs":            "contact_groups",
+	}
+	if len(errs) != len(exp) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(exp), len(errs), errs)
+	}
+	for _, e := range errs {
+		if exp[e.Name] != e.Key {
+			t.Errorf("Unexpected reference error: %s", e)
+		}
+	}
+}
+
+func TestOrphanServices(t *testing.T) {
+	m := readTestMap(t, `define host{
+	host_name web01
+	}
+define hostgroup{
+	hostgroup_name web
+	}
+define service{
+	host_name           web01
+	service_description ok
+	}
+define service{
+	host_name           web01,web02
+	service_description orphan
+	}
+define service{
+	host_name           web02
+	hostgroup_name      web
+	service_description grouped
+	}
+define service{
+	host_name           web03
+	hostgroup_name      nosuchgroup
+	service_description badgroup
+	}
+define service{
+	name                tmpl
+	host_name           web04
+	register            0
+	}
+`)
+	orphans := m.OrphanServices()
+	if len(orphans) != 2 {
+		t.Fatalf("Expected 2 orphans, got %d: %v", len(orphans), orphans)
+	}
+	for _, co := range orphans {
+		desc := co.Props["service_description"]
+		if desc != "orphan" && desc != "badgroup" {
+			t.Errorf("Unexpected orphan %q", desc)
+		}
+	}
+}
+
+func TestDisabledObjects(t *testing.T) {
+	m := readTestMap(t, `define host{
+	name     generic-host
+	register 0
+	}
+define host{
+	host_name web01
+	}
+define host{
+	use       generic-host
+	host_name web02
+	}
+define service{
+	host_name           web01
+	service_description HTTP
+	}
+define service{
+	host_name           web03
+	service_description gone
+	}
+`)
+	tmpl := findByKey(m, "name", "generic-host")
+	var web01 *CfgObj
+	for _, co := range m {
+		if co.Type == T_HOST && co.Props["host_name"] == "web01" {
+			web01 = co // the service has the same host_name
+		}
+	}
+	gone := findByKey(m, "service_description", "gone")
+	tmpl.Disabled = true
+	web01.Disabled = true
+	gone.Disabled = true
+
+	live := web01.Clone()
+	live.Disabled = false
+	if live.Fingerprint() == web01.Fingerprint() {
+		t.Error("Expected disabling an object to change its fingerprint")
+	}
+	if len(CfgObjs{web01, live}.Dedup()) != 2 {
+		t.Error("Expected a disabled object not to be a duplicate of a live one")
+	}
+	m2 := m.Clone()
+	m2[live.UUID] = live
+	if len(m2.FindConflicts()) != 0 {
+		t.Error("Expected no conflict with a disabled object")
+	}
+
+	// web02 uses a disabled template, and HTTP is on a disabled host. Nothing is checked for "gone".
+	refs := m.CheckReferences()
+	if len(refs) != 2 {
+		t.Fatalf("Expected 2 reference errors, got %v", refs)
+	}
+	for _, re := range refs {
+		if re.Name != "generic-host" && re.Name != "web01" {
+			t.Errorf("Unexpected reference error %v", re)
+		}
+	}
+	orphans := m.OrphanServices()
+	if len(orphans) != 1 || orphans[0].Props["service_description"] != "HTTP" {
+		t.Errorf("Expected only HTTP to be an orphan, got %v", orphans)
+	}
+	errs := m.ValidateAll()
+	if _, ok := errs[gone.UUID]; ok {
+		t.Error("Expected disabled objects not to be validated")
+	}
+	if _, ok := errs[findByKey(m, "host_name", "web02").UUID]; !ok {
+		t.Error("Expected an error for using a disabled template")
+	}
+
+	var sb strings.Builder
+	if err := web01.PrintIcinga2(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != "// object Host \"web01\" {\n// }\n" {
+		t.Errorf("Expected disabled object commented out, got:\n%s", sb.String())
+	}
+}
+
+func TestAddChecked(t *testing.T) {
+	o := NewCfgObj(T_SERVICE)
+	if err := o.AddChecked("check_command", "check_ping"); err != nil {
+		t.Error(err)
+	}
+	if err := o.AddChecked("use", "generic-service"); err != nil {
+		t.Error(err)
+	}
+	if err := o.AddChecked("check_comand", "check_ping"); err == nil {
+		t.Error("Expected error for misspelled key")
+	}
+	if err := o.AddChecked("members", "web01"); err == nil {
+		t.Error("Expected error for key not valid for services")
+	}
+	if err := o.AddChecked("check_command", "check_http"); err == nil {
+		t.Error("Expected error for existing key")
+	}
+	if o.Props["check_command"] != "check_ping" || len(o.Props) != 2 {
+		t.Errorf("Unexpected props after AddChecked: %v", o.Props)
+	}
+
+	sd := NewCfgObj(T_SERVICEDEPENDENCY)
+	if err := sd.AddChecked("2d_coords", "1,1"); err == nil {
+		t.Error("Expected error for alignment only key in servicedependency")
+	}
+	if err := sd.AddChecked("register", "0"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplaceInValues(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	rx := regexp.MustCompile(`^vgt_`)
+	n := m.ReplaceInValues("check_command", rx, "new_")
+	if n != 2 {
+		t.Errorf("Expected 2 objects changed, got %d", n)
+	}
+	for _, v := range m {
+		cmd := v.Props["check_command"]
+		if strings.HasPrefix(cmd, "vgt_") || (cmd != "check_http" && !strings.HasPrefix(cmd, "new_oracle")) {
+			t.Errorf("Unexpected check_command after replace: %q", cmd)
+		}
+		if strings.HasPrefix(v.Props["service_description"], "new_") {
+			t.Errorf("Other keys should not be changed: %q", v.Props["service_description"])
+		}
+	}
+	if m.ReplaceInValues("check_command", rx, "new_") != 0 {
+		t.Error("Expected no changes when nothing matches")
+	}
+	if m.ReplaceInValues("notes", regexp.MustCompile(`.*`), "x") != 0 {
+		t.Error("Expected objects without the key to be left alone")
+	}
+}
+
+func TestRename(t *testing.T) {
+	o := NewCfgObj(T_SERVICE)
+	o.Add("host_name", "web01")
+	o.Add("check_interval", "5")
+	if o.Rename("retry_interval", "max_check_attempts") {
+		t.Error("Renaming a non-existing key should fail")
+	}
+	if o.Rename("check_interval", "host_name") {
+		t.Error("Renaming to an existing key should fail")
+	}
+	if !o.Rename("check_interval", "retry_interval") {
+		t.Fatal("Rename failed")
+	}
+	val, ok := o.Get("retry_interval")
+	if !ok || val != "5" {
+		t.Errorf("Expected retry_interval = 5, got %q", val)
+	}
+	_, ok = o.Get("check_interval")
+	if ok {
+		t.Error("Old key should be removed")
+	}
+
+	m := readTestMap(t, querycfgstr)
+	cnt := m.RenameKey("check_command", "event_handler")
+	if cnt != 3 {
+		t.Errorf("Expected 3 objects changed, got %d", cnt)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	mk := func(ct CfgType, kv ...string) *CfgObj {
+		o := NewCfgObj(ct)
+		for i := 0; i < len(kv); i += 2 {
+			o.Add(kv[i], kv[i+1])
+		}
+		o.UUID = NewUUIDv1()
+		return o
+	}
+	cos := CfgObjs{
+		mk(T_HOST, "host_name", "a", "address", "10.0.0.1"),
+		mk(T_HOST, "address", "10.0.0.1", "host_name", "a"),
+		mk(T_HOSTGROUP, "host_name", "a", "address", "10.0.0.1"),
+		mk(T_HOST, "host_name", "b", "address", "10.0.0.2"),
+		mk(T_HOST, "host_name", "a", "address", "10.0.0.1"),
+	}
+
+	dd := cos.Dedup()
+	if len(dd) != 3 {
+		t.Fatalf("Expected 3 objects after Dedup, got %d", len(dd))
+	}
+	if dd[0] != cos[0] || dd[1] != cos[2] || dd[2] != cos[3] {
+		t.Errorf("Dedup did not keep first occurrences in order")
+	}
+
+	dups := cos.FindDuplicates()
+	if len(dups) != 1 {
+		t.Fatalf("Expected 1 group of duplicates, got %d", len(dups))
+	}
+	if len(dups[0]) != 3 || dups[0][0] != cos[0] || dups[0][1] != cos[1] || dups[0][2] != cos[4] {
+		t.Errorf("Unexpected duplicate group: %v", dups[0])
+	}
+}
+
+func TestSortByKey(t *testing.T) {
+	mk := func(name, interval string) *CfgObj {
+		o := NewCfgObj(T_SERVICE)
+		if name != "" {
+			o.Add("service_description", name)
+		}
+		if interval != "" {
+			o.Add("check_interval", interval)
+		}
+		return o
+	}
+	cos := CfgObjs{mk("c", "10"), mk("", "2"), mk("a", "x"), mk("b", ""), mk("a", "1.5")}
+
+	byName := make(CfgObjs, len(cos))
+	copy(byName, cos)
+	byName.SortByKey("service_description")
+	exp := CfgObjs{cos[2], cos[4], cos[3], cos[0], cos[1]}
+	for i := range exp {
+		if byName[i] != exp[i] {
+			t.Errorf("SortByKey: unexpected object at index %d", i)
+		}
+	}
+
+	byNum := make(CfgObjs, len(cos))
+	copy(byNum, cos)
+	byNum.SortByKeyNumeric("check_interval")
+	exp = CfgObjs{cos[4], cos[1], cos[0], cos[2], cos[3]}
+	for i := range exp {
+		if byNum[i] != exp[i] {
+			t.Errorf("SortByKeyNumeric: unexpected object at index %d", i)
+		}
+	}
+}
+
+func TestIndexByKey(t *testing.T) {
+	cm := readTestMap(t, querycfgstr)
+	idx := cm.IndexByKey("host_name")
+	for name, ids := range idx {
+		for _, id := range ids {
+			val, _ := cm[id].Get("host_name")
+			if val != name {
+				t.Errorf("Index for %q contains object with host_name %q", name, val)
+			}
+		}
+	}
+	total := 0
+	for _, ids := range idx {
+		total += len(ids)
+	}
+	if total != cm.Len() {
+		t.Errorf("Expected %d indexed objects, got %d", cm.Len(), total)
+	}
+
+	h := NewCfgObj(T_HOST)
+	h.Add("host_name", "web01")
+	h.UUID = NewUUIDv1()
+	cm[h.UUID] = h
+	o, ok := cm.LookupByName(T_HOST, "web01")
+	if !ok || o != h {
+		t.Errorf("LookupByName did not find host web01")
+	}
+	_, ok = cm.LookupByName(T_HOSTGROUP, "web01")
+	if ok {
+		t.Errorf("LookupByName should not match other types")
+	}
+
+	ni := cm.IndexByName()
+	if o, ok = ni.Lookup(T_HOST, "web01"); !ok || o != h {
+		t.Errorf("IndexByName did not find host web01")
+	}
+	if _, ok = ni.Lookup(T_HOSTGROUP, "web01"); ok {
+		t.Errorf("IndexByName should not match other types")
+	}
+}
+
+func benchmarkNameMap(n int) CfgMap {
+	cm := make(CfgMap, n)
+	for i := 0; i < n; i++ {
+		h := NewCfgObjWithUUID(T_HOST)
+		h.Add("host_name", fmt.Sprintf("host%d", i))
+		cm[h.UUID] = h
+	}
+	return cm
+}
+
+func BenchmarkLookupByName(b *testing.B) {
+	cm := benchmarkNameMap(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cm.LookupByName(T_HOST, fmt.Sprintf("host%d", i%10000))
+	}
+}
+
+func BenchmarkNameIndexLookup(b *testing.B) {
+	ni := benchmarkNameMap(10000).IndexByName()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ni.Lookup(T_HOST, fmt.Sprintf("host%d", i%10000))
+	}
+}
+
+func TestCfgQueryJSON(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+
+	q := NewCfgQuery()
+	q.AddKeyRX("check_command", `vgt_oracle`)
+	q.AddKeyNotRX("host_name", `test`)
+	data, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `{"key":"host_name","pattern":"test","negate":true}`) {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+
+	q2 := &CfgQuery{}
+	err = json.Unmarshal(data, q2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Search(q), m.Search(q2)) {
+		t.Errorf("Search results differ after round trip of %s", data)
+	}
+
+	// unbalanced
+	q = NewCfgQuery()
+	q.AddKey("host_name")
+	q.AddKey("service_description")
+	q.AddRX(`HTTP`)
+	data, _ = json.Marshal(q)
+	q2 = &CfgQuery{}
+	err = json.Unmarshal(data, q2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Search(q), m.Search(q2)) {
+		t.Errorf("Search results differ after round trip of %s", data)
+	}
+
+	err = json.Unmarshal([]byte(`{"conditions":[{"key":"host_name","pattern":"db_(","negate":false}]}`), q2)
+	if err == nil || !strings.Contains(err.Error(), "db_(") {
+		t.Errorf("Expected error for invalid pattern, got %v", err)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	q := NewCfgQuery()
+	q.AddKeyRX("host_name", `^db_`)
+
+	u := m.SearchLimit(q, 1)
+	if len(u) != 1 {
+		t.Fatalf("Expected 1 match, got %d", len(u))
+	}
+	if !u[0].In(m.Search(q)) {
+		t.Errorf("SearchLimit returned an object not matched by Search")
+	}
+	u = m.SearchLimit(q, 0)
+	if len(u) != 2 {
+		t.Errorf("Expected 2 matches without limit, got %d", len(u))
+	}
+
+	u1 := m.SearchSortedLimit(q, 1)
+	u2 := m.SearchSortedLimit(q, 1)
+	if len(u1) != 1 || !u1[0].Equals(u2[0]) {
+		t.Errorf("Expected reproducible results from SearchSortedLimit")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	mkhost := func(name, addr string) *CfgObj {
+		o := NewCfgObjWithUUID(T_HOST)
+		o.Add("host_name", name)
+		o.Add("address", addr)
+		return o
+	}
+	a1 := mkhost("web01", "10.0.0.1")
+	a2 := mkhost("db01", "10.0.0.2")
+	cm := CfgMap{a1.UUID: a1, a2.UUID: a2}
+
+	b1 := mkhost("web01", "10.0.1.1") // conflicts by name
+	b2 := mkhost("db01", "10.0.1.2")  // conflicts by name, will be dropped
+	b3 := mkhost("app01", "10.0.1.3") // no conflict
+	other := CfgMap{b1.UUID: b1, b2.UUID: b2, b3.UUID: b3}
+
+	err := cm.Merge(other, func(existing, incoming *CfgObj) *CfgObj {
+		hn, _ := existing.Get("host_name")
+		if hn == "db01" {
+			return nil
+		}
+		return incoming
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Len() != 2 {
+		t.Errorf("Expected 2 objects after merge, got %d", cm.Len())
+	}
+	o, ok := cm.LookupByName(T_HOST, "web01")
+	if !ok || o != b1 {
+		t.Errorf("Expected incoming web01 to win")
+	}
+	_, ok = cm.LookupByName(T_HOST, "db01")
+	if ok {
+		t.Errorf("Expected db01 to be dropped")
+	}
+	_, ok = cm[b3.UUID]
+	if !ok {
+		t.Errorf("Expected app01 to be added")
+	}
+
+	err = cm.Merge(CfgMap{a1.UUID: mkhost("web01", "x")}, nil)
+	if err == nil {
+		t.Errorf("Expected error for unresolved conflict")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	o1 := NewCfgObjWithUUID(T_HOST)
+	o1.Add("host_name", "web01")
+	o1.Add("address", "10.0.0.1")
+	o2 := o1.Clone()
+	o2.FileID = "/etc/nagios/hosts.cfg"
+	o2.Align = 40
+
+	if !o1.Equal(o2) {
+		t.Errorf("Expected clone to be Equal")
+	}
+	if o1.EqualStrict(o2) {
+		t.Errorf("Expected clone with new UUID to not be EqualStrict")
+	}
+	if !o1.EqualStrict(o1.CloneKeepUUID()) {
+		t.Errorf("Expected clone with same UUID to be EqualStrict")
+	}
+
+	o2.Add("alias", "Web server") // differing length
+	if o1.Equal(o2) || o2.Equal(o1) {
+		t.Errorf("Expected objects with differing number of props to not be Equal")
+	}
+	o2.Del("alias")
+	o2.Del("address")
+	o2.Add("alias", "10.0.0.1") // same length, but one-sided keys
+	if o1.Equal(o2) || o2.Equal(o1) {
+		t.Errorf("Expected objects with different keys to not be Equal")
+	}
+
+	o3 := o1.Clone()
+	o3.Type = T_HOSTGROUP
+	if o1.Equal(o3) {
+		t.Errorf("Expected objects of different type to not be Equal")
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	ids := m.Keys()
+	q := NewCfgQuery()
+	q.AddKeyRX("host_name", `^db_`)
+
+	n := m.DeleteMatching(q)
+	if n != 2 {
+		t.Errorf("Expected 2 objects deleted, got %d", n)
+	}
+	if m.Len() != 1 {
+		t.Errorf("Expected 1 object left, got %d", m.Len())
+	}
+	for _, id := range ids {
+		_, ok := m[id]
+		if !ok && id.In(m.Keys()) {
+			t.Errorf("Deleted UUID %s still in Keys", id)
+		}
+	}
+	if m.DeleteMatching(q) != 0 {
+		t.Errorf("Expected nothing deleted on second run")
+	}
+}
+
+func TestPartitionTemplates(t *testing.T) {
+	m := readTestMap(t, tmplcfgstr)
+	tmpls, live := m.PartitionTemplates()
+	if tmpls.Len()+live.Len() != m.Len() {
+		t.Errorf("Expected %d objects in total, got %d", m.Len(), tmpls.Len()+live.Len())
+	}
+	if tmpls.Len() == 0 || live.Len() == 0 {
+		t.Fatalf("Expected both templates and live objects, got %d and %d", tmpls.Len(), live.Len())
+	}
+	for _, v := range tmpls {
+		if !v.IsTemplate() {
+			t.Errorf("Non-template in templates: %s", objID(v))
+		}
+	}
+	for _, v := range live {
+		if v.IsTemplate() {
+			t.Errorf("Template in live objects: %s", objID(v))
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	svc := NewCfgObj(T_SERVICE)
+	svc.Add("host_name", "web01")
+	svc.Add("service_description", "PING")
+	if s := svc.Summary(); s != "service 'PING' on web01" {
+		t.Errorf("Unexpected summary: %q", s)
+	}
+	if s := svc.String(); !strings.Contains(s, "define service{\n") || !strings.Contains(s, "service_description") {
+		t.Errorf("Unexpected String(): %q", s)
+	}
+	if s := fmt.Sprintf("%v", svc); s != svc.String() {
+		t.Errorf("Expected %%v to use String()")
+	}
+
+	tmpl := NewCfgObj(T_HOST)
+	tmpl.Add("name", "generic-host")
+	tmpl.Add("register", "0")
+	if s := tmpl.Summary(); s != "host template 'generic-host'" {
+		t.Errorf("Unexpected summary: %q", s)
+	}
+
+	h := NewCfgObj(T_HOST)
+	h.Add("host_name", "db01")
+	if s := h.Summary(); s != "host 'db01'" {
+		t.Errorf("Unexpected summary: %q", s)
+	}
+}
+
+func TestGetTyped(t *testing.T) {
+	o := NewCfgObj(T_SERVICE)
+	o.Add("max_check_attempts", "3")
+	o.Add("check_interval", "2.5")
+	o.Add("active_checks_enabled", "1")
+	o.Add("passive_checks_enabled", "0")
+	o.Add("notes", "yes")
+
+	if i, ok := o.GetInt("max_check_attempts"); !ok || i != 3 {
+		t.Errorf("GetInt: got %d, %v", i, ok)
+	}
+	if _, ok := o.GetInt("check_interval"); ok {
+		t.Errorf("GetInt should fail for non-integer")
+	}
+	if f, ok := o.GetFloat("check_interval"); !ok || f != 2.5 {
+		t.Errorf("GetFloat: got %f, %v", f, ok)
+	}
+	if b, ok := o.GetBool("active_checks_enabled"); !ok || !b {
+		t.Errorf("GetBool: got %v, %v", b, ok)
+	}
+	if b, ok := o.GetBool("passive_checks_enabled"); !ok || b {
+		t.Errorf("GetBool: got %v, %v", b, ok)
+	}
+	if _, ok := o.GetBool("notes"); ok {
+		t.Errorf("GetBool should fail for non-boolean")
+	}
+	if _, ok := o.GetInt("retry_interval"); ok {
+		t.Errorf("GetInt should fail for missing key")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	o1 := NewCfgObjWithUUID(T_HOST)
+	o1.Add("host_name", "web01")
+	o1.Add("address", "10.0.0.1")
+	o2 := NewCfgObjWithUUID(T_HOST)
+	o2.Add("address", "10.0.0.1")
+	o2.Add("host_name", "web01")
+	o2.FileID = "/etc/nagios/hosts.cfg"
+
+	if o1.Fingerprint() != o2.Fingerprint() {
+		t.Errorf("Expected same fingerprint regardless of order, UUID and FileID")
+	}
+	if len(o1.Fingerprint()) != 64 {
+		t.Errorf("Expected hex encoded SHA-256, got %q", o1.Fingerprint())
+	}
+	cm1 := CfgMap{o1.UUID: o1}
+	cm2 := CfgMap{o2.UUID: o2}
+	if cm1.Fingerprint() != cm2.Fingerprint() {
+		t.Errorf("Expected same map fingerprint")
+	}
+
+	o2.Set("address", "10.0.0.2")
+	if o1.Fingerprint() == o2.Fingerprint() {
+		t.Errorf("Expected different fingerprint after change")
+	}
+	if cm1.Fingerprint() == cm2.Fingerprint() {
+		t.Errorf("Expected different map fingerprint after change")
+	}
+	o3 := o1.Clone()
+	o3.Type = T_HOSTGROUP
+	if o1.Fingerprint() == o3.Fingerprint() {
+		t.Errorf("Expected different fingerprint for different type")
+	}
+}
+
+func TestSearchParallel(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	for i := 0; i < 100; i++ {
+		o := NewCfgObjWithUUID(T_SERVICE)
+		o.Add("host_name", fmt.Sprintf("db_extra%d", i))
+		o.Add("service_description", "PING")
+		m[o.UUID] = o
+	}
+	q := NewCfgQuery()
+	q.AddKeyRX("host_name", `^db_`)
+
+	u := m.SearchParallel(q).Sorted()
+	exp := m.SearchLimit(q, 0).Sorted()
+	if len(u) != 102 || !reflect.DeepEqual(u, exp) {
+		t.Errorf("Expected %d matches, got %d", len(exp), len(u))
+	}
+	if len(CfgMap{}.SearchParallel(q)) != 0 {
+		t.Errorf("Expected no matches in empty map")
+	}
+}
+
+func TestSetAll(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	cos := make(CfgObjs, 0, m.Len())
+	for _, v := range m {
+		cos = append(cos, v)
+	}
+	if n := cos.AddAll("notes", "added"); n != 3 {
+		t.Errorf("Expected 3 objects changed by AddAll, got %d", n)
+	}
+	if n := cos.AddAll("notes", "again"); n != 0 {
+		t.Errorf("Expected 0 objects changed by second AddAll, got %d", n)
+	}
+	if n := cos.SetAll("bogus_key", "x"); n != 0 {
+		t.Errorf("Expected invalid key to change nothing, got %d", n)
+	}
+
+	q := NewCfgQuery()
+	q.AddKeyRX("check_command", `vgt_oracle`)
+	if n := m.SetWhere(q, "notifications_enabled", "1"); n != 2 {
+		t.Errorf("Expected 2 objects changed by SetWhere, got %d", n)
+	}
+	if n := m.SetWhere(q, "notifications_enabled", "1"); n != 0 {
+		t.Errorf("Expected 0 objects changed on second SetWhere, got %d", n)
+	}
+	if n := cos.SetAll("notifications_enabled", "0"); n != 3 {
+		t.Errorf("Expected 3 objects changed by SetAll, got %d", n)
+	}
+}
+
+func TestSearchObjs(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	q := NewCfgQuery()
+	q.AddKeyRX("check_command", `vgt_oracle`)
+	kr1, _ := NewKeyRX("host_name", `gso`)
+	kr2, _ := NewKeyRX("service_description", `mutex`)
+	q.AddOrGroup(kr1, kr2)
+
+	cos := m.SearchObjs(q)
+	if len(cos) != 1 || cos[0].Props["host_name"] != "db_dummy_gso" {
+		t.Fatalf("Expected db_dummy_gso only, got %d objects", len(cos))
+	}
+	res := m.SearchResults(q)
+	if len(res) != 1 || res[0].Obj != cos[0] || !res[0].UUID.Equals(cos[0].UUID) {
+		t.Fatalf("Unexpected results: %+v", res)
+	}
+	exp := []string{"check_command", "host_name", "service_description"}
+	if !reflect.DeepEqual(res[0].Matched, exp) {
+		t.Errorf("Expected matched keys %v, got %v", exp, res[0].Matched)
+	}
+}
+
+func TestEach(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	visited := 0
+	err := m.Each(func(u UUID, co *CfgObj) error {
+		visited++
+		if co.Props["host_name"] != "web01" {
+			delete(m, u)
+		}
+		n := NewCfgObjWithUUID(T_HOST) // added objects are not visited
+		m[n.UUID] = n
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visited != 3 || m.Len() != 4 {
+		t.Errorf("Expected 3 visits and 4 objects left, got %d and %d", visited, m.Len())
+	}
+
+	stop := fmt.Errorf("stop")
+	visited = 0
+	err = m.EachSorted(func(u UUID, co *CfgObj) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("Expected EachSorted to stop at first error, got %v after %d visits", err, visited)
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	add := func(ct CfgType, kv ...string) *CfgObj {
+		o := NewCfgObjWithUUID(ct)
+		for i := 0; i < len(kv); i += 2 {
+			o.Add(kv[i], kv[i+1])
+		}
+		m[o.UUID] = o
+		return o
+	}
+	s := add(T_SERVICE, "host_name", "web01", "service_description", "HTTP", "check_command", "check_https")
+	h1 := add(T_HOST, "host_name", "web01")
+	h2 := add(T_HOST, "host_name", "web01", "alias", "dup")
+	add(T_HOST, "name", "web01", "register", "0") // template, does not conflict with the host
+	add(T_COMMAND, "command_name", "check_http")
+
+	c := m.FindConflicts()
+	if len(c) != 2 {
+		t.Fatalf("Expected 2 conflicts, got %d: %v", len(c), c)
+	}
+	if ids := c["service:web01;HTTP"]; len(ids) != 2 || !s.UUID.In(ids) {
+		t.Errorf("Expected service conflict, got %v", ids)
+	}
+	if ids := c["host:web01"]; len(ids) != 2 || !h1.UUID.In(ids) || !h2.UUID.In(ids) {
+		t.Errorf("Expected host conflict, got %v", ids)
+	}
+}
+
+func TestApply(t *testing.T) {
+	nc := NewNagiosCfg()
+	nc.Config = readTestMap(t, querycfgstr)
+	orig := nc.Config
+
+	err := nc.Apply(func(cm CfgMap) error {
+		for _, v := range cm {
+			v.Set("notes", "changed")
+		}
+		return fmt.Errorf("abort")
+	})
+	if err == nil {
+		t.Fatal("Expected error from Apply")
+	}
+	for _, v := range nc.Config {
+		if _, ok := v.Get("notes"); ok {
+			t.Fatalf("Aborted edit leaked into config")
+		}
+	}
+
+	err = nc.Apply(func(cm CfgMap) error {
+		for _, v := range cm {
+			v.Set("notes", "changed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range nc.Config {
+		if v.Props["notes"] != "changed" {
+			t.Errorf("Expected edit to be applied")
+		}
+	}
+	for _, v := range orig {
+		if _, ok := v.Get("notes"); ok {
+			t.Errorf("Expected original objects to be untouched")
+		}
+	}
+
+	if !nc.Rollback() {
+		t.Fatal("Expected Rollback to succeed")
+	}
+	for _, v := range nc.Config {
+		if _, ok := v.Get("notes"); ok {
+			t.Errorf("Expected Rollback to restore original config")
+		}
+	}
+	if nc.Rollback() {
+		t.Errorf("Expected nothing more to roll back")
+	}
+}
+
+func TestSyncCfgMap(t *testing.T) {
+	scm := NewSyncCfgMap(readTestMap(t, querycfgstr))
+	if scm.Len() != 3 {
+		t.Fatalf("Expected 3 objects, got %d", scm.Len())
+	}
+
+	var wg sync.WaitGroup
+	ids := make(UUIDs, 50)
+	for i := range ids {
+		co := NewCfgObjWithUUID(T_HOST)
+		ids[i] = co.UUID
+		wg.Add(2)
+		go func(co *CfgObj) {
+			defer wg.Done()
+			scm.Set(co.UUID, co)
+		}(co)
+		go func() {
+			defer wg.Done()
+			snap := scm.Snapshot()
+			snap.Len()
+		}()
+	}
+	wg.Wait()
+	if scm.Len() != 53 {
+		t.Errorf("Expected 53 objects, got %d", scm.Len())
+	}
+
+	snap := scm.Snapshot()
+	if co := scm.Delete(ids[0]); co == nil {
+		t.Errorf("Expected to delete %s", ids[0])
+	}
+	if _, ok := scm.Get(ids[0]); ok {
+		t.Errorf("Expected %s to be gone", ids[0])
+	}
+	if _, ok := snap[ids[0]]; !ok {
+		t.Errorf("Expected snapshot to be unaffected by Delete")
+	}
+}
+
+func TestCommandMacros(t *testing.T) {
+	tests := []struct {
+		cl     string
+		macros []string
+		exe    string
+	}{
+		{"$USER1$/check_http -H $HOSTADDRESS$ -u $ARG1$ -w $ARG2$ -c $ARG2$", []string{"$USER1$", "$HOSTADDRESS$", "$ARG1$", "$ARG2$"}, "$USER1$/check_http"},
+		{"/usr/bin/printf \"%b\" \"cost: $$5 for $HOSTNAME$\"", []string{"$HOSTNAME$"}, "/usr/bin/printf"},
+		{"echo $ stray $ARG1$$ARG2$", []string{"$ARG1$", "$ARG2$"}, "echo"},
+		{"'/opt/my plugins/check_x' $ARG1$", []string{"$ARG1$"}, "/opt/my plugins/check_x"},
+		{"/bin/true", nil, "/bin/true"},
+	}
+	for _, tt := range tests {
+		o := NewCfgObj(T_COMMAND)
+		o.Add("command_name", "test")
+		o.Add("command_line", tt.cl)
+		if m := o.CommandMacros(); !reflect.DeepEqual(m, tt.macros) {
+			t.Errorf("Expected macros %v from %q, got %v", tt.macros, tt.cl, m)
+		}
+		if exe := o.CommandExecutable(); exe != tt.exe {
+			t.Errorf("Expected executable %q from %q, got %q", tt.exe, tt.cl, exe)
+		}
+	}
+	if co.CommandMacros() != nil || co.CommandExecutable() != "" {
+		t.Error("Expected nothing from a non-command object")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	var o *CfgObj
+	for _, v := range m {
+		o = v
+		break
+	}
+	o.Set("alias", "  web   server\t01 ")
+	o.Set("notes", `  a  "b   c"   d `)
+	m.NormalizeAll()
+	if v := o.Props["alias"]; v != "web server 01" {
+		t.Errorf("Expected %q, got %q", "web server 01", v)
+	}
+	if v := o.Props["notes"]; v != `a "b   c" d` {
+		t.Errorf("Expected spaces within quotes to be kept, got %q", v)
+	}
+}
+
+func TestAllCfgTypes(t *testing.T) {
+	types := AllCfgTypes()
+	if len(types) != len(CfgTypes) {
+		t.Fatalf("Expected %d types, got %d", len(CfgTypes), len(types))
+	}
+	plurals := map[CfgType]string{
+		T_COMMAND:           "commands",
+		T_CONTACT:           "contacts",
+		T_CONTACTGROUP:      "contactgroups",
+		T_HOST:              "hosts",
+		T_HOSTDEPENDENCY:    "hostdependencies",
+		T_HOSTESCALATION:    "hostescalations",
+		T_HOSTEXTINFO:       "hostextinfos",
+		T_HOSTGROUP:         "hostgroups",
+		T_SERVICE:           "services",
+		T_SERVICEDEPENDENCY: "servicedependencies",
+		T_SERVICEESCALATION: "serviceescalations",
+		T_SERVICEEXTINFO:    "serviceextinfos",
+		T_SERVICEGROUP:      "servicegroups",
+		T_TIMEPERIOD:        "timeperiods",
+	}
+	for _, ct := range types {
+		if !ct.IsValid() {
+			t.Errorf("Expected %d to be valid", ct)
+		}
+		if ct.Plural() != plurals[ct] {
+			t.Errorf("Expected plural %q for %s, got %q", plurals[ct], ct, ct.Plural())
+		}
+	}
+	if T_INVALID.IsValid() || T_INVALID.Plural() != "unknown" {
+		t.Error("Expected T_INVALID to be invalid, with plural \"unknown\"")
+	}
+}
+
+func TestSearchKeyExists(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	for _, co := range m {
+		if co.Props["host_name"] == "web01" {
+			co.Set("event_handler", "")
+		}
+	}
+
+	q := NewCfgQuery()
+	if !q.AddKeyExists("event_handler") {
+		t.Fatal("Failed to add exists condition")
+	}
+	u := m.Search(q)
+	if len(u) != 1 || m[u[0]].Props["host_name"] != "web01" {
+		t.Errorf("Expected only web01 to have event_handler, got %v", u)
+	}
+	res := m.SearchResults(q)
+	if len(res) != 1 || !reflect.DeepEqual(res[0].Matched, []string{"event_handler"}) {
+		t.Errorf("Expected event_handler as matched key, got %v", res)
+	}
+
+	q = NewCfgQuery()
+	q.AddKeyAbsent("event_handler")
+	q.AddKeyRX("check_command", `^vgt_oracle`)
+	if u = m.Search(q); len(u) != 2 {
+		t.Errorf("Expected 2 matches without event_handler, got %d", len(u))
+	}
+
+	if q.AddKeyExists("no_such_key") {
+		t.Error("Expected invalid key to be rejected")
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q2 := NewCfgQuery()
+	if err = json.Unmarshal(b, q2); err != nil {
+		t.Fatal(err)
+	}
+	if u2 := m.Search(q2); !reflect.DeepEqual(u2, u) {
+		t.Errorf("Expected same result after JSON round trip (%s), got %v", b, u2)
+	}
+}
+
+func TestLockedCfgObj(t *testing.T) {
+	o := NewCfgObj(T_HOST)
+	o.Add("host_name", "web01")
+	lco := NewLockedCfgObj(o)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			lco.Set("notes", fmt.Sprintf("edit %d", i))
+			lco.Update(func(co *CfgObj) {
+				co.Del("alias")
+				co.Add("alias", "web")
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			lco.Get("notes")
+			lco.View(func(co *CfgObj) {
+				co.Print(ioutil.Discard, true)
+			})
+		}()
+	}
+	wg.Wait()
+
+	snap := lco.Snapshot()
+	if v, _ := lco.Get("alias"); v != "web" || snap.Props["alias"] != "web" {
+		t.Errorf("Expected alias \"web\", got %q", v)
+	}
+	snap.Set("alias", "changed")
+	if v, _ := lco.Get("alias"); v != "web" {
+		t.Error("Expected snapshot to be a copy")
+	}
+	if !lco.Del("alias") || lco.Add("host_name", "web02") {
+		t.Error("Expected Del and Add to work like on CfgObj")
+	}
+}
+
+// run with -race, as printing used to fill in the header comment of the object
+func TestLockedCfgObjParallelView(t *testing.T) {
+	o := NewCfgObj(T_HOST)
+	o.Add("host_name", "web01")
+	lco := NewLockedCfgObj(o)
+
+	outs := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lco.View(func(co *CfgObj) {
+				var buf bytes.Buffer
+				co.Print(&buf, true)
+				outs[i] = buf.String()
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i := range outs {
+		if outs[i] != outs[0] || !strings.HasPrefix(outs[i], "# host 'web01'\n") {
+			t.Errorf("Unexpected output from View %d:\n%s", i, outs[i])
+		}
+	}
+}
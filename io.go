@@ -25,40 +25,106 @@ See: https://golang.org/LICENSE
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"container/list"
+	"context"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // A ParseError is returned for parsing errors.
 // The first line is 1.  The first column is 0.
 type ParseError struct {
+	File   string // File being parsed, empty if not reading from a file
+	Line   int    // Line where the error occurred
+	Column int    // Column (rune index) where the error occurred
+	Err    error  // The actual error
+}
+
+// Error returns the error as a nicely formatted string
+func (e *ParseError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:line %d, column %d: %s", e.File, e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+}
+
+// A WriteError is returned when writing config objects fails.
+// Line and Column refer to the position in the output. The first line is 1.  The first column is 0.
+type WriteError struct {
 	Line   int   // Line where the error occurred
 	Column int   // Column (rune index) where the error occurred
 	Err    error // The actual error
 }
 
 // Error returns the error as a nicely formatted string
-func (e *ParseError) Error() string {
-	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write: line %d, column %d: %s", e.Line, e.Column, e.Err)
 }
 
 // These are the errors that can be returned in ParseError.Error
 var (
-	ErrNoValue = errors.New("only key given where key/value expected")
-	ErrUnknown = errors.New("unknown parsing error")
+	ErrNoValue   = errors.New("only key given where key/value expected")
+	ErrUnknown   = errors.New("unknown parsing error")
+	ErrNotClosed = errors.New("object not closed before next define")
+	ErrOddSpace  = errors.New("non-ASCII whitespace")
+	ErrQuote     = errors.New("unterminated quote")
+	ErrKeyword   = errors.New("unexpected keyword before object type")
 )
 
 type Reader struct {
-	Comment   rune
+	Comment       rune
+	InlineComment rune // delimiter for comments trailing a value, 0 to disable
+	Lenient       bool // if true, objects with parse errors are skipped instead of aborting, see Errors()
+	// NormalizeSpaces makes zero width spaces and BOMs separate fields, like other whitespace,
+	// and records the location of all non-ASCII whitespace, see Warnings()
+	NormalizeSpaces bool
+	// DefineKeyword is the keyword starting an object definition, "define" by default, e.g. "object" for some preprocessors
+	DefineKeyword string
+	// StripTrailingSemicolon removes a single ";" from the end of values, outside of quotes. Only needed if InlineComment is not ';'.
+	StripTrailingSemicolon bool
+	// DuplicateKeys holds a ParseError for each directive that was ignored because the object already had it.
+	// They are also included in Warnings().
+	DuplicateKeys []ParseError
+	// CaptureDisabled makes Read return objects that are commented out line by line, with CfgObj.Disabled set,
+	// instead of keeping the lines as comments for the next object
+	CaptureDisabled bool
+	// FieldHint is the initial capacity for the fields of each line, DEF_FIELDS by default.
+	// Raising it avoids reallocations for configs with many fields per line, e.g. long unquoted command lines.
+	FieldHint int
+	// Progress, if set, is called with the total number of bytes read, every time another DEF_PROGRESS bytes are read
+	Progress  func(bytesRead int64)
+	nbytes    int64
+	order     UUIDs // UUIDs of objects read, in the order they were read
+	peeked    bool  // whether peekObj and peekErr hold the result of reading ahead in Peek
+	peekObj   *CfgObj
+	peekErr   error
+	file      string   // set by FileReader, for error messages
+	errs      []error  // parse errors skipped in Lenient mode
+	comments  []string // comment lines read since the last blank line or object
+	warns     []error  // non-ASCII whitespace found when NormalizeSpaces is set
+	objcnt    map[CfgType]int
+	elapsed   time.Duration
+	fieldCols []int // start column of each field on the current line
+	lineTabs  bool  // whether tabs were seen before the value on the current line
+	braceCol  int   // column of the last closing brace
+	escaped   bool  // whether the last rune was a backslash escaping the next one
+	shellLine bool  // whether the current line is a command_line, where quotes are left to the shell
 	line      int
 	inputline int // separate counter that should match the line number from input
 	column    int
@@ -66,36 +132,142 @@ type Reader struct {
 	r         *bufio.Reader
 }
 
+// ReadStats holds statistics about what a Reader has read so far
+type ReadStats struct {
+	Files       int // number of files, for MultiFileReader
+	LinesRead   int
+	ObjectsRead int
+	ByType      map[CfgType]int
+	Duration    time.Duration // total time spent in Read
+}
+
+// ReadResult is what ReadChanResults delivers: either an object or an error
+type ReadResult struct {
+	Obj *CfgObj
+	Err error
+}
+
 type FileReader struct {
 	*Reader
-	f *os.File
+	f  *os.File
+	gz *gzip.Reader // set if the file is gzip compressed
 }
 
 type MultiFileReader []*FileReader
 
+// Writer writes CfgObjs in Nagios format. It's the counterpart of Reader.
+// Indent and Align are used for every object written, unless the object has changed
+// its own Indent/Align from the package defaults, and Override is not set.
+type Writer struct {
+	Indent   int  // indent used for objects that have not overridden it
+	Align    int  // alignment used for objects that have not overridden it
+	Sorted   bool // whether WriteAll prints properties in Nagios sort order
+	Override bool // use Indent and Align for all objects, ignoring their own settings
+	Regen    bool // always write a generated comment, instead of the objects LeadingComments
+	// LineEnding is written at the end of every line, "\n" by default. Set it to "\r\n" for CRLF.
+	LineEnding string
+	linePrefix string // written at the start of every line, for writing disabled objects
+	line       int
+	column     int
+	w          *bufio.Writer
+}
+
 func _debug(args ...interface{}) {
 	fmt.Println(args)
 }
 
 func NewReader(rr io.Reader) *Reader {
 	return &Reader{
-		Comment: '#',
-		r:       bufio.NewReader(rr),
+		Comment:       '#',
+		InlineComment: rune(SEP_ICMT[0]),
+		DefineKeyword: DEF_DEFINE,
+		FieldHint:     DEF_FIELDS,
+		r:             bufio.NewReader(rr),
 	}
 }
 
+// isGzip reports whether the file is gzip compressed, judging by its name or its first bytes
+func isGzip(path string, br *bufio.Reader) bool {
+	if strings.HasSuffix(path, ".gz") {
+		return true
+	}
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// NewFileReader opens the file at path for reading. Gzip compressed files are decompressed transparently.
 func NewFileReader(path string) *FileReader {
 	file, err := os.Open(path)
 	if err != nil {
 		log.Errorf("%q %s", err, dbgStr(true))
 		return nil
 	}
-	fr := &FileReader{}
-	fr.Reader = NewReader(file)
-	fr.f = file
+	fr := &FileReader{f: file}
+	br := bufio.NewReader(file)
+	if isGzip(path, br) {
+		fr.gz, err = gzip.NewReader(br)
+		if err != nil {
+			log.Errorf("%s: %q %s", path, err, dbgStr(true))
+			file.Close()
+			return nil
+		}
+		fr.Reader = NewReader(fr.gz)
+	} else {
+		fr.Reader = NewReader(br)
+	}
+	fr.Reader.file = path
 	return fr
 }
 
+// ReaderOption changes a setting of a Reader. See NewMultiFileReaderWith.
+type ReaderOption func(*Reader)
+
+// WithComment sets the rune marking a comment line. 0 disables comments.
+func WithComment(c rune) ReaderOption {
+	return func(r *Reader) {
+		r.Comment = c
+	}
+}
+
+// WithInlineComment sets the rune marking a comment after a value. 0 disables inline comments.
+func WithInlineComment(c rune) ReaderOption {
+	return func(r *Reader) {
+		r.InlineComment = c
+	}
+}
+
+// WithLenient sets Reader.Lenient
+func WithLenient(lenient bool) ReaderOption {
+	return func(r *Reader) {
+		r.Lenient = lenient
+	}
+}
+
+// WithDefineKeyword sets Reader.DefineKeyword
+func WithDefineKeyword(keyword string) ReaderOption {
+	return func(r *Reader) {
+		r.DefineKeyword = keyword
+	}
+}
+
+// WithStripTrailingSemicolon sets Reader.StripTrailingSemicolon
+func WithStripTrailingSemicolon(strip bool) ReaderOption {
+	return func(r *Reader) {
+		r.StripTrailingSemicolon = strip
+	}
+}
+
+// NewMultiFileReaderWith works like NewMultiFileReader, but applies the given options to all readers
+func NewMultiFileReaderWith(paths []string, opts ...ReaderOption) MultiFileReader {
+	mfr := NewMultiFileReader(paths...)
+	for i := range mfr {
+		for _, opt := range opts {
+			opt(mfr[i].Reader)
+		}
+	}
+	return mfr
+}
+
 func NewMultiFileReader(paths ...string) MultiFileReader {
 	mfr := make(MultiFileReader, 0, len(paths))
 	for i := range paths {
@@ -107,10 +279,48 @@ func NewMultiFileReader(paths ...string) MultiFileReader {
 	return mfr
 }
 
+func NewWriter(ww io.Writer) *Writer {
+	return &Writer{
+		Indent:     DEF_INDENT,
+		Align:      DEF_ALIGN,
+		Sorted:     true,
+		LineEnding: "\n",
+		line:       1,
+		w:          bufio.NewWriter(ww),
+	}
+}
+
+// Close closes the file, and the gzip reader if the file is compressed
 func (fr *FileReader) Close() error {
+	if fr.gz != nil {
+		gzerr := fr.gz.Close()
+		err := fr.f.Close()
+		if gzerr != nil {
+			return gzerr
+		}
+		return err
+	}
 	return fr.f.Close()
 }
 
+// Order returns the UUIDs of the objects read so far, in the order they were read.
+// Only objects read with setUUID true are included.
+func (r *Reader) Order() UUIDs {
+	order := make(UUIDs, len(r.order))
+	copy(order, r.order)
+	return order
+}
+
+// Size returns the size of the file, for calculating progress along with BytesRead.
+// For compressed files, this is the compressed size, so it can only be used as a rough estimate.
+func (fr *FileReader) Size() (int64, error) {
+	fi, err := fr.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
 func (fr *FileReader) AbsPath() (string, error) {
 	return filepath.Abs(fr.f.Name())
 }
@@ -140,6 +350,7 @@ func (mfr MultiFileReader) Close() error {
 
 func (r *Reader) error(err error) error {
 	return &ParseError{
+		File:   r.file,
 		Line:   r.line,
 		Column: r.column,
 		Err:    err,
@@ -148,13 +359,18 @@ func (r *Reader) error(err error) error {
 
 // this is basically "dos2unix"
 func (r *Reader) readRune() (rune, error) {
-	r1, _, err := r.r.ReadRune()
+	r1, size, err := r.r.ReadRune()
+	r.countBytes(size)
 	if r1 == '\r' {
-		r1, _, err = r.r.ReadRune()
+		r1, size, err = r.r.ReadRune()
+		r.countBytes(size)
 		if err == nil {
 			if r1 != '\n' {
 				r.r.UnreadRune()
+				r.countBytes(-size)
 				r1 = '\r'
+			} else {
+				r.inputline++
 			}
 		}
 	} else if r1 == '\n' {
@@ -164,6 +380,187 @@ func (r *Reader) readRune() (rune, error) {
 	return r1, err
 }
 
+// countBytes adds n to the number of bytes read, and calls r.Progress each time another DEF_PROGRESS bytes are read
+func (r *Reader) countBytes(n int) {
+	before := r.nbytes / DEF_PROGRESS
+	r.nbytes += int64(n)
+	if r.Progress != nil && r.nbytes/DEF_PROGRESS > before {
+		r.Progress(r.nbytes)
+	}
+}
+
+// BytesRead returns the number of bytes read so far. For compressed files, this is the uncompressed size.
+func (r *Reader) BytesRead() int64 {
+	return r.nbytes
+}
+
+// isOddSpace returns true for whitespace that is not ASCII, including some that unicode.IsSpace does not consider
+// space, but that is invisible and would end up in keys or values, e.g. zero width space
+func isOddSpace(r1 rune) bool {
+	if r1 < utf8.RuneSelf {
+		return false
+	}
+	switch r1 {
+	case '\u200b', '\u2060', '\ufeff':
+		return true
+	}
+	return unicode.IsSpace(r1)
+}
+
+// readFieldRune reads a rune for parseFields, converting odd whitespace to a plain space if NormalizeSpaces is set
+func (r *Reader) readFieldRune() (rune, error) {
+	r1, err := r.readRune()
+	if err == nil && r1 == '\\' {
+		if r.escaped {
+			r.escaped = false // second half of an escaped backslash
+		} else if next, perr := r.r.Peek(1); perr == nil {
+			switch next[0] {
+			case '\\':
+				r.escaped = true
+			case '\n', '\r':
+				// line continuation, so the newline is just whitespace between fields
+				_, err = r.readRune()
+				r.line++ // errors further on are reported at the physical line
+				return ' ', err
+			}
+		}
+	}
+	if r1 == '\t' && len(r.fieldCols) < 2 {
+		r.lineTabs = true
+	}
+	if err == nil && r.NormalizeSpaces && isOddSpace(r1) {
+		r.warns = append(r.warns, &ParseError{
+			File:   r.file,
+			Line:   r.inputline + 1,
+			Column: r.column,
+			Err:    fmt.Errorf("%s %U", ErrOddSpace, r1),
+		})
+		r1 = ' '
+	}
+	return r1, err
+}
+
+// Stats returns statistics about what has been read so far
+func (r *Reader) Stats() ReadStats {
+	st := ReadStats{
+		LinesRead: r.inputline,
+		ByType:    make(map[CfgType]int, len(r.objcnt)),
+		Duration:  r.elapsed,
+	}
+	for k, v := range r.objcnt {
+		st.ByType[k] = v
+		st.ObjectsRead += v
+	}
+	return st
+}
+
+// Stats returns the sum of the statistics for all files
+func (mfr MultiFileReader) Stats() ReadStats {
+	st := ReadStats{
+		Files:  len(mfr),
+		ByType: make(map[CfgType]int),
+	}
+	for i := range mfr {
+		fst := mfr[i].Stats()
+		st.LinesRead += fst.LinesRead
+		st.ObjectsRead += fst.ObjectsRead
+		st.Duration += fst.Duration
+		for k, v := range fst.ByType {
+			st.ByType[k] += v
+		}
+	}
+	return st
+}
+
+// Warnings returns the locations of non-ASCII whitespace found when NormalizeSpaces is set,
+// and of duplicate directives, see DuplicateKeys
+func (r *Reader) Warnings() []error {
+	return r.warns
+}
+
+// readComment reads the rest of a comment line, and returns it with the comment char first
+func (r *Reader) readComment() (string, error) {
+	var buf bytes.Buffer
+	buf.WriteRune(r.Comment)
+	for {
+		r1, err := r.readRune()
+		if err != nil || r1 == '\n' {
+			return strings.TrimRightFunc(buf.String(), unicode.IsSpace), err
+		}
+		buf.WriteRune(r1)
+	}
+}
+
+// uncomment returns line without the leading comment rune
+func (r *Reader) uncomment(line string) string {
+	return strings.TrimPrefix(line, string(r.Comment))
+}
+
+// readDisabled checks if the last comment read starts a commented out object, and if so, reads the rest of it and
+// returns it with Disabled set. If it's not an object, or it fails to parse, the lines are left as comments and nil
+// is returned.
+func (r *Reader) readDisabled(setUUID bool, fileID string) *CfgObj {
+	start := len(r.comments) - 1
+	if start < 0 {
+		return nil
+	}
+	first := strings.TrimSpace(r.uncomment(r.comments[start]))
+	kw := r.defineKeyword()
+	if !strings.HasPrefix(first, kw) || !strings.Contains(first, "{") {
+		return nil
+	}
+	tname := strings.TrimSpace(strings.SplitN(first[len(kw):], "{", 2)[0])
+	if !CfgName(tname).Valid() {
+		return nil
+	}
+
+	lines := []string{r.uncomment(r.comments[start])}
+	for {
+		r1, size, err := r.r.ReadRune()
+		if err != nil {
+			return nil
+		}
+		if r1 != r.Comment {
+			r.r.UnreadRune()
+			return nil // not commented out all the way to the closing brace
+		}
+		r.countBytes(size)
+		r.line++
+		cmt, err := r.readComment()
+		r.comments = append(r.comments, cmt)
+		lines = append(lines, r.uncomment(cmt))
+		if strings.TrimSpace(r.uncomment(cmt)) == "}" {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+	}
+
+	sub := NewReader(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	sub.Comment = r.Comment
+	sub.InlineComment = r.InlineComment
+	sub.NormalizeSpaces = r.NormalizeSpaces
+	sub.DefineKeyword = r.DefineKeyword
+	sub.StripTrailingSemicolon = r.StripTrailingSemicolon
+	co, err := sub.read(false, fileID)
+	if err != nil {
+		log.Debugf("Not a disabled object: %s %s", err, dbgStr(false))
+		return nil
+	}
+	co.Disabled = true
+	if setUUID {
+		co.UUID = NewUUIDv1()
+		r.addOrder(co)
+	}
+	co.LeadingComments = nil
+	if start > 0 {
+		co.LeadingComments = r.comments[:start]
+	}
+	r.comments = nil
+	return co
+}
+
 // skip advances the reader until it reaches delim, ignoring everything it reads
 func (r *Reader) skip(delim rune) error {
 	for {
@@ -180,9 +577,9 @@ func (r *Reader) skip(delim rune) error {
 func (r *Reader) parseFields() (haveField bool, delim rune, err error) {
 	r.field.Reset() // clear buffer at each call
 
-	r1, err := r.readRune()
+	r1, err := r.readFieldRune()
 	for err == nil && r1 != '\n' && unicode.IsSpace(r1) {
-		r1, err = r.readRune()
+		r1, err = r.readFieldRune()
 	}
 	if err == io.EOF && r.column != 0 {
 		return true, 0, err
@@ -205,16 +602,23 @@ func (r *Reader) parseFields() (haveField bool, delim rune, err error) {
 		log.Debugf("Hit %q, line #%d col #%d %s", r1, r.line, r.column, dbgStr(false))
 		return false, r1, nil
 	case '}':
+		r.braceCol = r.column
 		if r.column > DEF_ALIGN {
 			log.Debugf("Hit %q, line #%d col #%d %s", r1, r.line, r.column, dbgStr(false))
 		}
 		return true, r1, nil
 	default:
+		r.fieldCols = append(r.fieldCols, r.column)
 		for {
-			if !unicode.IsSpace(r1) {
+			if r1 == '"' && !r.shellLine {
+				err = r.readQuoted()
+				if err != nil {
+					return false, 0, err
+				}
+			} else if !unicode.IsSpace(r1) {
 				r.field.WriteRune(r1)
 			}
-			r1, err = r.readRune()
+			r1, err = r.readFieldRune()
 			if err != nil {
 				log.Debug(err)
 				break
@@ -253,16 +657,57 @@ func (r *Reader) parseFields() (haveField bool, delim rune, err error) {
 	return true, r1, nil
 }
 
+// readQuoted reads up to and including the closing quote into the current field, keeping all whitespace.
+// The opening quote has already been read. Not used for command_line, as Nagios leaves its quotes to the shell.
+func (r *Reader) readQuoted() error {
+	col := r.column
+	r.field.WriteRune('"')
+	for {
+		r1, err := r.readFieldRune()
+		if err != nil || r1 == '\n' {
+			line := r.inputline + 1
+			if r1 == '\n' {
+				line-- // already counted
+			}
+			return &ParseError{
+				File:   r.file,
+				Line:   line,
+				Column: col,
+				Err:    ErrQuote,
+			}
+		}
+		r.field.WriteRune(r1)
+		if r1 == '"' {
+			return nil
+		}
+	}
+}
+
+// unquote removes the quotes from a value that is quoted as a whole
+func unquote(val string) string {
+	if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' && strings.Count(val, `"`) == 2 {
+		return val[1 : len(val)-1]
+	}
+	return val
+}
+
 func (r *Reader) parseLine() (fields []string, state IoState, err error) {
 	r.line++
 	r.column = -1
+	r.fieldCols = r.fieldCols[:0]
+	r.lineTabs = false
+	r.escaped = false
+	r.shellLine = false
 
-	r1, _, err := r.r.ReadRune()
+	r1, size, err := r.r.ReadRune()
 	if err != nil {
 		return nil, IO_OBJ_OUT, err
 	}
 	if r.Comment != 0 && r1 == r.Comment {
-		return nil, IO_OBJ_OUT, r.skip('\n')
+		r.countBytes(size)
+		cmt, err := r.readComment()
+		r.comments = append(r.comments, cmt)
+		return nil, IO_OBJ_OUT, err
 	}
 	r.r.UnreadRune()
 
@@ -270,9 +715,14 @@ func (r *Reader) parseLine() (fields []string, state IoState, err error) {
 		haveField, delim, err := r.parseFields()
 		if haveField {
 			if fields == nil {
-				fields = make([]string, 0, 6) // 6 is a random guess at what is suitable
+				hint := r.FieldHint
+				if hint < 1 {
+					hint = DEF_FIELDS
+				}
+				fields = make([]string, 0, hint)
 			}
 			fields = append(fields, r.field.String())
+			r.shellLine = fields[0] == "command_line"
 		}
 		// 2017-01-30 21:07:19
 		// we have some bugs with {} being part of command parameters
@@ -290,9 +740,128 @@ func (r *Reader) parseLine() (fields []string, state IoState, err error) {
 	}
 }
 
+// splitInlineComment splits the value of key on the first inline comment delimiter that is not within double quotes,
+// or escaped with a backslash, like "\;" in Nagios. As in Nagios, this includes command_line, so a semicolon meant
+// for the shell must be escaped. Escaped semicolons are unescaped in all values, see escapeValue.
+func (r *Reader) splitInlineComment(val string) (string, string) {
+	cmt := ""
+	if r.InlineComment != 0 {
+		quoted := false
+		prev := rune(0)
+		for i, r1 := range val {
+			if r1 == '"' {
+				quoted = !quoted
+			} else if r1 == r.InlineComment && !quoted && prev != '\\' {
+				val, cmt = strings.TrimSpace(val[:i]), strings.TrimSpace(val[i+utf8.RuneLen(r1):])
+				break
+			}
+			prev = r1
+		}
+	}
+	return strings.Replace(val, `\`+SEP_ICMT, SEP_ICMT, -1), cmt
+}
+
+// stripSemicolon removes a trailing ";" from val, unless it's within quotes
+func stripSemicolon(val string) string {
+	if !strings.HasSuffix(val, ";") || strings.Count(val, `"`)%2 != 0 {
+		return val
+	}
+	return strings.TrimSpace(val[:len(val)-1])
+}
+
+// defineKeyword returns r.DefineKeyword, or the default if not set
+func (r *Reader) defineKeyword() string {
+	if r.DefineKeyword == "" {
+		return DEF_DEFINE
+	}
+	return r.DefineKeyword
+}
+
+// Errors returns the parse errors for the objects that have been skipped in Lenient mode
+func (r *Reader) Errors() []error {
+	return r.errs
+}
+
+// dupKey records a directive ignored because the object being read already has it
+func (r *Reader) dupKey(key string) {
+	col := r.column
+	if len(r.fieldCols) > 0 {
+		col = r.fieldCols[0]
+	}
+	pe := ParseError{
+		File:   r.file,
+		Line:   r.inputline, // the newline ending the directive has been read
+		Column: col,
+		Err:    fmt.Errorf("duplicate directive %q, keeping the first value", key),
+	}
+	log.Warnf("%s %s", &pe, dbgStr(false))
+	r.DuplicateKeys = append(r.DuplicateKeys, pe)
+	r.warns = append(r.warns, &pe)
+}
+
+// skipErr logs and records a parse error in Lenient mode
+func (r *Reader) skipErr(err error) {
+	err = r.error(err)
+	log.Warnf("Skipping object: %s %s", err, dbgStr(false))
+	r.errs = append(r.errs, err)
+}
+
 // Read reads from a Nagios config stream and returns the next config object.
-// Should be called repeatedly. Returns err = io.EOF when done
+// Should be called repeatedly. Returns err = io.EOF when done.
+// If r.Lenient is set, objects that fail to parse are skipped up to the next "define", and the errors are
+// available from r.Errors().
 func (r *Reader) Read(setUUID bool, fileID string) (*CfgObj, error) {
+	var co *CfgObj
+	var err error
+	if r.peeked {
+		co, err = r.peekObj, r.peekErr
+		r.peeked, r.peekObj, r.peekErr = false, nil, nil
+		if co != nil {
+			if setUUID {
+				co.UUID = NewUUIDv1()
+				r.addOrder(co)
+			}
+			if fileID != "" {
+				co.FileID = fileID
+			}
+		}
+	} else {
+		start := time.Now()
+		co, err = r.read(setUUID, fileID)
+		r.elapsed += time.Since(start)
+	}
+	if co != nil {
+		if r.objcnt == nil {
+			r.objcnt = make(map[CfgType]int)
+		}
+		r.objcnt[co.Type]++
+	}
+	return co, err
+}
+
+// Peek reads ahead to the next object and returns its type, without consuming it.
+// The object, or the error from reading it, is returned by the next call to Read, which also sets its UUID
+// and FileID as asked. Returns false if there is no next object, because of EOF or an error.
+func (r *Reader) Peek() (CfgType, bool) {
+	if !r.peeked {
+		start := time.Now()
+		r.peekObj, r.peekErr = r.read(false, "")
+		r.elapsed += time.Since(start)
+		r.peeked = true
+	}
+	if r.peekObj == nil {
+		return T_INVALID, false
+	}
+	return r.peekObj.Type, true
+}
+
+// addOrder keeps track of the original order of objects read, both for the reader and in the object itself
+func (r *Reader) addOrder(co *CfgObj) {
+	r.order = append(r.order, co.UUID)
+	co.readSeq = atomic.AddUint64(&readSeq, 1)
+}
+
+func (r *Reader) read(setUUID bool, fileID string) (*CfgObj, error) {
 	var fields []string
 	var state IoState
 	var err error
@@ -301,29 +870,60 @@ func (r *Reader) Read(setUUID bool, fileID string) (*CfgObj, error) {
 
 	for {
 		fields, state, err = r.parseLine()
+		if fields == nil && state == IO_OBJ_OUT && err == nil && prevState == IO_OBJ_OUT && r.CaptureDisabled {
+			dco := r.readDisabled(setUUID, fileID) // the line was a comment, maybe starting a disabled object
+			if dco != nil {
+				return dco, nil
+			}
+		}
 		if fields != nil {
 			switch state {
 			case IO_OBJ_BEGIN:
 				if prevState != IO_OBJ_OUT {
-					//log.Debugf("prevState: %d, skipping a round", prevState)
-					// continue goes too far, need jump to label or something...
-					continue
+					if !r.Lenient {
+						//log.Debugf("prevState: %d, skipping a round", prevState)
+						// continue goes too far, need jump to label or something...
+						continue
+					}
+					if co != nil {
+						r.skipErr(ErrNotClosed) // drop the unclosed object and start over with this define
+					}
+				}
+				prevState = IO_OBJ_BEGIN
+				if fields[0] != r.defineKeyword() {
+					log.Debugf("Expected %q, got %q %s", r.defineKeyword(), fields[0], dbgStr(false))
+					if !r.Lenient {
+						return nil, r.error(ErrKeyword)
+					}
+					r.skipErr(ErrKeyword)
+					co = nil // ignore everything up to the next define
+					break
+				}
+				var ct CfgType = T_INVALID
+				if len(fields) > 1 {
+					ct = CfgName(fields[1]).Type()
 				}
-				ct := CfgName(fields[1]).Type()
 				if ct == T_INVALID {
 					log.Debugf("Invalid type (f#1): %q, Err: %q %s", fields, err, dbgStr(false))
-					return nil, r.error(ErrUnknown)
+					if !r.Lenient {
+						return nil, r.error(ErrUnknown)
+					}
+					r.skipErr(ErrUnknown)
+					co = nil // ignore everything up to the next define
+					break
 				}
 				if setUUID {
 					co = NewCfgObjWithUUID(ct)
-					uuidorder = append(uuidorder, co.UUID) // keep track of original order of objects read
 				} else {
 					co = NewCfgObj(ct)
 				}
 				if fileID != "" {
 					co.FileID = fileID
 				}
-				prevState = IO_OBJ_BEGIN
+				if len(r.comments) > 0 {
+					co.LeadingComments = r.comments
+					r.comments = nil
+				}
 			case IO_OBJ_IN:
 				//prevState = IO_OBJ_IN
 				fl := len(fields)
@@ -334,14 +934,58 @@ func (r *Reader) Read(setUUID bool, fileID string) (*CfgObj, error) {
 					continue
 				}
 				//log.Debugf("%q %q", fields[0], strings.Join(fields[1:fl], " "))
-				co.Add(fields[0], strings.Join(fields[1:fl], " "))
+				val, cmt := r.splitInlineComment(strings.Join(fields[1:fl], " "))
+				if r.StripTrailingSemicolon {
+					val = stripSemicolon(val)
+				}
+				val = unquote(val)
+				if len(co.Props) == 0 && !r.lineTabs && len(r.fieldCols) >= 2 {
+					// keep the layout of the first directive, so the object is written back the same way
+					co.Indent = r.fieldCols[0]
+					co.Align = r.fieldCols[1] - r.fieldCols[0]
+				}
+				if co.Type == T_TIMEPERIOD && !timeperiodKeys[fields[0]] {
+					tr := parseTimeRange(append([]string{fields[0]}, strings.Fields(val)...))
+					tr.Comment = cmt
+					co.TimeRanges = append(co.TimeRanges, tr)
+					break
+				}
+				if !co.addRaw(fields[0], val) {
+					r.dupKey(fields[0])
+				} else if cmt != "" {
+					co.SetInlineComment(fields[0], cmt)
+				}
 			case IO_OBJ_END:
-				//fmt.Printf("Obj size: %d\n", co.size()) // approx avg turned out to be ~362 bytes per declaration for our services.cfg file
+				r.comments = nil // comments within the object are not kept
+				//fmt.Printf("Obj size: %d\n", co.Size()) // approx avg turned out to be ~362 bytes per declaration for our services.cfg file
+				if co == nil && r.Lenient {
+					prevState = IO_OBJ_OUT // end of a skipped object
+					break
+				}
+				if co != nil && r.braceCol == 0 && co.Indent != 0 {
+					co.BraceStyle = BRACE_FLUSH_LEFT
+				}
+				if setUUID && co != nil {
+					r.addOrder(co)
+				}
 				return co, nil
 			default:
-				return nil, r.error(ErrUnknown)
+				if !r.Lenient {
+					return nil, r.error(ErrUnknown)
+				}
+				r.skipErr(ErrUnknown)
 			}
 		}
+		if fields == nil && state == IO_OBJ_IN && err == nil {
+			r.comments = nil // only keep comments directly above a define
+		}
+		pe, ok := err.(*ParseError)
+		if ok && r.Lenient {
+			log.Warnf("Skipping object: %s %s", pe, dbgStr(false))
+			r.errs = append(r.errs, pe)
+			co = nil // ignore the rest of the object
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -352,54 +996,100 @@ func (r *Reader) Read(setUUID bool, fileID string) (*CfgObj, error) {
 }
 
 func (r *Reader) ReadChan(setUUID bool, fileID string) <-chan *CfgObj {
-	objchan := make(chan *CfgObj, 2) // making the channel buffered seems to make the function slightly faster
+	return r.ReadChanContext(context.Background(), setUUID, fileID)
+}
+
+// ReadChanContext works like ReadChan, but stops reading and closes the channel when ctx is done
+func (r *Reader) ReadChanContext(ctx context.Context, setUUID bool, fileID string) <-chan *CfgObj {
+	return objsFromResults(ctx, r.ReadChanResults(ctx, setUUID, fileID))
+}
+
+// ReadChanResults works like ReadChanContext, but delivers errors as well as objects, so the caller can decide
+// whether to go on or give up, by cancelling ctx. Reading goes on after parse errors, but stops after any other error.
+func (r *Reader) ReadChanResults(ctx context.Context, setUUID bool, fileID string) <-chan ReadResult {
+	reschan := make(chan ReadResult, 2) // making the channel buffered seems to make the function slightly faster
 	go func() {
+		defer close(reschan)
 		for {
+			if ctx.Err() != nil {
+				return
+			}
 			obj, err := r.Read(setUUID, fileID)
-			if err == nil && obj != nil {
-				objchan <- obj
+			if err == io.EOF {
+				return
 			}
-			if err != nil {
-				if err != io.EOF {
-					log.Errorf("%q %s", err, dbgStr(true))
-					continue
-				}
-				break
+			if err == nil && obj == nil {
+				continue
+			}
+			select {
+			case reschan <- ReadResult{Obj: obj, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if _, ok := err.(*ParseError); err != nil && !ok {
+				return
+			}
+		}
+	}()
+	return reschan
+}
+
+// objsFromResults returns a channel with only the objects from results, logging the errors
+func objsFromResults(ctx context.Context, results <-chan ReadResult) <-chan *CfgObj {
+	objchan := make(chan *CfgObj, 2)
+	go func() {
+		defer close(objchan)
+		for res := range results {
+			if res.Err != nil {
+				log.Errorf("%q %s", res.Err, dbgStr(true))
+				continue
+			}
+			select {
+			case objchan <- res.Obj:
+			case <-ctx.Done():
+				return // the reader sees ctx as well, so we don't need to drain results
 			}
 		}
-		close(objchan)
 	}()
 	return objchan
 }
 
 func (mfr MultiFileReader) ReadChan(setUUID bool) <-chan *CfgObj {
+	return mfr.ReadChanContext(context.Background(), setUUID)
+}
+
+// ReadChanContext works like ReadChan, but stops all readers and closes the merged channel when ctx is done
+func (mfr MultiFileReader) ReadChanContext(ctx context.Context, setUUID bool) <-chan *CfgObj {
+	return objsFromResults(ctx, mfr.ReadChanResults(ctx, setUUID))
+}
+
+// ReadChanResults works like ReadChanContext, but delivers errors from all readers as well as objects,
+// see Reader.ReadChanResults
+func (mfr MultiFileReader) ReadChanResults(ctx context.Context, setUUID bool) <-chan ReadResult {
 	// Need to do some fan-out, fan-in stuff here
 	var wg sync.WaitGroup
-	out := make(chan *CfgObj)
+	out := make(chan ReadResult)
 	mfrlen := len(mfr)
 
-	output := func(c <-chan *CfgObj) {
+	output := func(c <-chan ReadResult) {
 		defer wg.Done()
 		for v := range c {
-			out <- v
-			// The variant below tends to fail now and then
-			//select {
-			//case out <- v:
-			//default:
-			//	log.Errorf("%s.MultiFileReader.ReadChan().output(): Unable to copy to new channel", PKGNAME)
-			//	return
-			//}
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return // the reader for c sees ctx as well, so we don't need to drain it
+			}
 		}
 	}
 
-	fcs := make([]<-chan *CfgObj, mfrlen)
+	fcs := make([]<-chan ReadResult, mfrlen)
 	for i := range mfr {
 		fileID, err := mfr[i].AbsPath()
 		if err != nil {
 			log.Errorf("%q %s", err, dbgStr(true))
 			fileID = mfr[i].f.Name()
 		}
-		fcs[i] = mfr[i].ReadChan(setUUID, fileID)
+		fcs[i] = mfr[i].ReadChanResults(ctx, setUUID, fileID)
 	}
 
 	wg.Add(mfrlen)
@@ -416,7 +1106,40 @@ func (mfr MultiFileReader) ReadChan(setUUID bool) <-chan *CfgObj {
 	return out
 }
 
-// ReadAllList does the same as ReadAll, but returns a list instead of a slice
+// Transform applies fn to each object from in, and forwards the objects it returns on the returned channel,
+// dropping those where it returns false. The returned channel is closed when in is closed or ctx is cancelled, so a
+// consumer that stops reading should cancel ctx to end the pipeline. Use with Writer.WriteChan to process configs of
+// any size without holding them all in memory.
+func Transform(ctx context.Context, in <-chan *CfgObj, fn func(*CfgObj) (*CfgObj, bool)) <-chan *CfgObj {
+	out := make(chan *CfgObj, 2)
+	go func() {
+		defer close(out)
+		for {
+			var co *CfgObj
+			var ok bool
+			select {
+			case co, ok = <-in:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+			if co, ok = fn(co); !ok {
+				continue
+			}
+			select {
+			case out <- co:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// ReadAllList does the same as ReadAll, but returns a list instead of a slice.
+// In Lenient mode, objects that fail to parse are left out, and their errors can be had from r.Errors().
 func (r *Reader) ReadAllList(setUUID bool, fileID string) (*list.List, error) {
 	l := list.New()
 	for {
@@ -435,6 +1158,9 @@ func (r *Reader) ReadAllList(setUUID bool, fileID string) (*list.List, error) {
 	return l, nil
 }
 
+// ReadAllMap reads all objects into a CfgMap, with UUIDs set.
+// In Lenient mode, objects that fail to parse are left out, and their errors can be had from r.Errors().
+// Duplicate directives, where only the first value is kept, are reported by r.Warnings().
 func (r *Reader) ReadAllMap(fileID string) (CfgMap, error) {
 	m := make(CfgMap)
 	for {
@@ -454,6 +1180,24 @@ func (r *Reader) ReadAllMap(fileID string) (CfgMap, error) {
 	return m, nil
 }
 
+// Order returns the UUIDs of all objects read so far by all readers, in the order they were read, file by file
+func (mfr MultiFileReader) Order() UUIDs {
+	var order UUIDs
+	for i := range mfr {
+		order = append(order, mfr[i].order...)
+	}
+	return order
+}
+
+// Errors returns the parse errors for objects skipped by all readers in Lenient mode
+func (mfr MultiFileReader) Errors() []error {
+	var errs []error
+	for i := range mfr {
+		errs = append(errs, mfr[i].Errors()...)
+	}
+	return errs
+}
+
 func (mfr MultiFileReader) ReadAllMap() (CfgMap, error) {
 	cm := make(CfgMap)
 	errcnt := 0
@@ -480,45 +1224,419 @@ func (mfr MultiFileReader) ReadAllMap() (CfgMap, error) {
 	return cm, nil
 }
 
-// PrintProps prints a CfgObj's properties in random order
-func (co *CfgObj) PrintProps(w io.Writer, format string) {
-	for k, v := range co.Props {
-		fmt.Fprintf(w, format, k, v)
+func (w *Writer) error(err error) error {
+	return &WriteError{
+		Line:   w.line,
+		Column: w.column,
+		Err:    err,
 	}
 }
 
-// PrintPropsSorted prints a CfgObj's properties acording to sort order found here:
-// https://assets.nagios.com/downloads/nagioscore/docs/nagioscore/3/en/objectdefinitions.html
-func (co *CfgObj) PrintPropsSorted(w io.Writer, format string) {
-	keypri := make(map[int]string)
-	for k := range co.Props {
-		keypri[CfgKeySortOrder[k][co.Type]] = k // should have error checking for non-existing keys/types
+// writeString writes s to the underlying buffer, keeping track of line and column
+func (w *Writer) writeString(s string) error {
+	if w.linePrefix != "" {
+		var buf strings.Builder
+		col := w.column
+		for _, r1 := range s {
+			if col == 0 {
+				buf.WriteString(w.linePrefix)
+			}
+			buf.WriteRune(r1)
+			if r1 == '\n' {
+				col = 0
+			} else {
+				col++
+			}
+		}
+		s = buf.String()
 	}
-	keys := make([]int, len(keypri))
-	i := 0
-	for k := range keypri {
-		keys[i] = k
-		i++
+	out := s
+	if w.LineEnding != "" && w.LineEnding != "\n" {
+		out = strings.Replace(s, "\n", w.LineEnding, -1)
 	}
-	sort.Ints(keys)
-	for _, k := range keys {
-		fmt.Fprintf(w, format, keypri[k], co.Props[keypri[k]])
+	_, err := w.w.WriteString(out)
+	if err != nil {
+		return w.error(err)
+	}
+	for _, r1 := range s {
+		if r1 == '\n' {
+			w.line++
+			w.column = 0
+		} else {
+			w.column++
+		}
 	}
+	return nil
 }
 
-// Print prints out a CfgObj in Nagios format
-func (co *CfgObj) Print(w io.Writer, sorted bool) {
-	prefix := strings.Repeat(" ", co.Indent)
-	fstr := fmt.Sprintf("%s%s%d%s", prefix, "%-", co.Align, "s%s\n")
-	co.generateComment() // this might fail, but don't care yet
-	fmt.Fprintf(w, "%s\n", co.Comment)
-	fmt.Fprintf(w, "define %s{\n", co.Type.String())
-	if sorted {
-		co.PrintPropsSorted(w, fstr)
+// indent returns the Writers indent, unless the object has set its own
+func (w *Writer) indent(co *CfgObj) int {
+	if co.Indent != DEF_INDENT && !w.Override {
+		return co.Indent
+	}
+	return w.Indent
+}
+
+// align returns the Writers alignment, unless the object has set its own
+func (w *Writer) align(co *CfgObj) int {
+	if co.Align != DEF_ALIGN && !w.Override {
+		return co.Align
+	}
+	return w.Align
+}
+
+// WriteObj writes a single CfgObj in Nagios format. Output is buffered, so call Flush when done.
+func (w *Writer) WriteObj(co *CfgObj, sorted bool) error {
+	prefix := strings.Repeat(" ", w.indent(co))
+	fstr := fmt.Sprintf("%s%s%d%s", prefix, "%-", w.align(co), "s%s\n")
+	var err error
+	if len(co.LeadingComments) > 0 && !w.Regen {
+		for i := range co.LeadingComments {
+			err = w.writeString(co.LeadingComments[i] + "\n")
+			if err != nil {
+				return err
+			}
+		}
 	} else {
-		co.PrintProps(w, fstr)
+		cmt, _ := co.comment()
+		if cmt == defaultComment(co.Type) {
+			cmt = "# " + co.Type.String() // no name to fill in, e.g. an object without directives
+		}
+		err = w.writeString(cmt + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	if co.Disabled {
+		w.linePrefix = "#"
+		defer func() { w.linePrefix = "" }()
+	}
+	err = w.writeString(fmt.Sprintf("define %s{\n", co.Type.String()))
+	if err != nil {
+		return err
+	}
+	for _, k := range co.propKeys(sorted) {
+		if len(k) >= w.align(co) {
+			err = w.writeString(fmt.Sprintf("%s%s %s\n", prefix, k, co.propValue(k))) // keep at least one space
+		} else {
+			err = w.writeString(fmt.Sprintf(fstr, k, co.propValue(k)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, tr := range co.TimeRanges {
+		val := tr.Ranges
+		if tr.Comment != "" {
+			val = fmt.Sprintf("%s %s %s", val, SEP_ICMT, tr.Comment)
+		}
+		if len(tr.Day) >= w.align(co) {
+			err = w.writeString(fmt.Sprintf("%s%s %s\n", prefix, tr.Day, val))
+		} else {
+			err = w.writeString(fmt.Sprintf(fstr, tr.Day, val))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if co.BraceStyle != BRACE_SAME_AS_INDENT {
+		prefix = ""
+	}
+	return w.writeString(fmt.Sprintf("%s}\n", prefix))
+}
+
+// WriteAll writes all given objects, separated by a blank line, and flushes the output
+func (w *Writer) WriteAll(cos CfgObjs) error {
+	for i := range cos {
+		err := w.WriteObj(cos[i], w.Sorted)
+		if err != nil {
+			return err
+		}
+		err = w.writeString("\n")
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// WriteChan writes each object from in as it arrives, like WriteAll, until in is closed.
+// Output is flushed after each object. On error, WriteChan returns without draining in, so when reading from
+// ReadChanContext, cancel the context and drain in to let everything upstream exit.
+func (w *Writer) WriteChan(in <-chan *CfgObj) error {
+	for co := range in {
+		err := w.WriteObj(co, w.Sorted)
+		if err == nil {
+			err = w.writeString("\n")
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying io.Writer
+func (w *Writer) Flush() error {
+	err := w.w.Flush()
+	if err != nil {
+		return w.error(err)
+	}
+	return nil
+}
+
+// propKeys returns the keys of co.Props, either in Nagios sort order or the order they were added in
+func (co *CfgObj) propKeys(sorted bool) []string {
+	if sorted {
+		return co.sortedKeys()
 	}
-	fmt.Fprintf(w, "%s}\n", prefix)
+	return co.originalKeys()
+}
+
+// sortedKeys returns the keys of co.Props in the order defined by CfgKeySortOrder for the objects type.
+// Keys without a defined order for the type are placed last, alphabetically.
+func (co *CfgObj) sortedKeys() []string {
+	keys := make([]string, 0, len(co.Props))
+	for k := range co.Props {
+		keys = append(keys, k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		pi, iok := CfgKeySortOrder[keys[i]][co.Type]
+		pj, jok := CfgKeySortOrder[keys[j]][co.Type]
+		if iok != jok {
+			return iok // known keys before unknown
+		}
+		if iok && pi != pj {
+			return pi < pj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// PrintProps prints a CfgObj's properties in the order they are stored, which is the order they were added,
+// unless changed by CanonicalizeOrder
+func (co *CfgObj) PrintProps(w io.Writer, format string) {
+	for _, k := range co.originalKeys() {
+		fmt.Fprintf(w, format, k, co.propValue(k))
+	}
+}
+
+// originalKeys returns the keys of co.Props in the order they were added.
+// Keys that were put directly into Props, bypassing Set/Add, come last, alphabetically.
+func (co *CfgObj) originalKeys() []string {
+	keys := make([]string, 0, len(co.Props))
+	seen := make(map[string]bool, len(co.Props))
+	for _, k := range co.keyOrder {
+		_, exists := co.Props[k]
+		if exists && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
+	}
+	if len(keys) < len(co.Props) {
+		rest := make([]string, 0, len(co.Props)-len(keys))
+		for k := range co.Props {
+			if !seen[k] {
+				rest = append(rest, k)
+			}
+		}
+		sort.Strings(rest)
+		keys = append(keys, rest...)
+	}
+	return keys
+}
+
+// PrintPropsOriginal prints a CfgObj's properties in the order they were read or added
+func (co *CfgObj) PrintPropsOriginal(w io.Writer, format string) {
+	for _, k := range co.originalKeys() {
+		fmt.Fprintf(w, format, k, co.propValue(k))
+	}
+}
+
+// PrintPropsSorted prints a CfgObj's properties acording to sort order found here:
+// https://assets.nagios.com/downloads/nagioscore/docs/nagioscore/3/en/objectdefinitions.html
+func (co *CfgObj) PrintPropsSorted(w io.Writer, format string) {
+	for _, k := range co.sortedKeys() {
+		fmt.Fprintf(w, format, k, co.propValue(k))
+	}
+}
+
+// Print prints out a CfgObj in Nagios format. Use a Writer directly if you need to know about errors.
+func (co *CfgObj) Print(w io.Writer, sorted bool) {
+	ow := NewWriter(w)
+	ow.WriteObj(co, sorted)
+	ow.Flush()
+}
+
+// WriteCSV writes the values of the given columns for each object as CSV, with a header row first.
+// Missing keys give empty cells.
+func (cos CfgObjs) WriteCSV(w io.Writer, columns ...string) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(columns)
+	if err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for i := range cos {
+		for j := range columns {
+			row[j] = cos[i].Props[columns[j]]
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteCSV writes the objects as CSV, in the order given by Keys(). See CfgObjs.WriteCSV.
+func (cm CfgMap) WriteCSV(w io.Writer, columns ...string) error {
+	keys := cm.Keys()
+	cos := make(CfgObjs, 0, len(keys))
+	for i := range keys {
+		cos = append(cos, cm[keys[i]])
+	}
+	return cos.WriteCSV(w, columns...)
+}
+
+// ParseResourceFile reads a Nagios resource file, with lines like "$USER1$=/usr/lib/nagios/plugins",
+// and returns a map from each macro, e.g. "$USER1$", to its value. Empty lines and comments are skipped.
+func ParseResourceFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || txt[0] == '#' || txt[0] == ';' {
+			continue
+		}
+		eq := strings.IndexByte(txt, '=')
+		if eq == -1 || !isUserMacro(strings.TrimSpace(txt[:eq])) {
+			return nil, fmt.Errorf("%s:%d: expected $USERn$=value, got %q", path, line, txt)
+		}
+		res[strings.TrimSpace(txt[:eq])] = strings.TrimSpace(txt[eq+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MainConfigFiles returns the object config files listed in a main config file like nagios.cfg, in the order listed.
+// Files are given by "cfg_file", and "cfg_dir" adds all files ending in ".cfg" below a directory, in lexical order.
+// Relative paths are relative to the directory of the main config file, and files listed more than once are
+// only returned the first time. Other directives are ignored.
+func MainConfigFiles(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	base := filepath.Dir(path)
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	add := func(fname string) {
+		if !seen[fname] {
+			seen[fname] = true
+			files = append(files, fname)
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || txt[0] == '#' || txt[0] == ';' {
+			continue
+		}
+		eq := strings.IndexByte(txt, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("%s:%d: expected key=value, got %q", path, line, txt)
+		}
+		key := strings.TrimSpace(txt[:eq])
+		val := strings.TrimSpace(txt[eq+1:])
+		if key != "cfg_file" && key != "cfg_dir" {
+			continue
+		}
+		if !filepath.IsAbs(val) {
+			val = filepath.Join(base, val)
+		}
+		if key == "cfg_file" {
+			add(val)
+			continue
+		}
+		err = filepath.Walk(val, func(fname string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && strings.HasSuffix(fname, ".cfg") {
+				add(fname)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ToYAML writes the objects to w as a YAML sequence, see CfgObj.MarshalYAML
+func (cos CfgObjs) ToYAML(w io.Writer) error {
+	b, err := yaml.Marshal(cos)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// byteCounter is an io.Writer that only counts the bytes written to it
+type byteCounter int
+
+func (bc *byteCounter) Write(p []byte) (int, error) {
+	*bc += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Size returns the number of bytes the object takes when written by Print. The object is not modified.
+func (co *CfgObj) Size() int {
+	var bc byteCounter
+	co.Print(&bc, false)
+	return int(bc)
+}
+
+// TotalSize returns the number of bytes the map takes when written by Print, including the blank line after each object
+func (cm CfgMap) TotalSize() int {
+	size := 0
+	for _, v := range cm {
+		size += v.Size() + 1
+	}
+	return size
+}
+
+// String returns the object in Nagios format, with properties sorted. The object is not modified.
+func (co *CfgObj) String() string {
+	var buf bytes.Buffer
+	co.Print(&buf, true)
+	return buf.String()
 }
 
 // Print writes a collection of CfgObj to a given stream
@@ -544,6 +1662,82 @@ func (cm CfgMap) Print(w io.Writer, sorted bool) {
 	}
 }
 
+// PrintInReadOrder works like Print, but writes objects in the given order, e.g. from Reader.Order,
+// so that rewriting a file gives minimal diffs. UUIDs not in cm are skipped, and objects not in order are written last.
+func (cm CfgMap) PrintInReadOrder(w io.Writer, order UUIDs, sorted bool) {
+	seen := make(map[UUID]bool, len(order))
+	for i := range order {
+		co, ok := cm[order[i]]
+		if !ok || seen[order[i]] {
+			continue
+		}
+		seen[order[i]] = true
+		co.Print(w, sorted)
+		fmt.Fprintf(w, "\n")
+	}
+	keys := cm.Keys()
+	for i := range keys {
+		if !seen[keys[i]] {
+			cm[keys[i]].Print(w, sorted)
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+// PrintAligned works like Print, but formats all objects with the given indent and alignment, regardless of the
+// objects own settings. If align is 0, it's calculated from the longest key in the map.
+func (cm CfgMap) PrintAligned(w io.Writer, indent, align int, sorted bool) {
+	if align == 0 {
+		align = cm.LongestKey() + 2
+	}
+	ww := NewWriter(w)
+	ww.Indent = indent
+	ww.Align = align
+	ww.Override = true
+	var keys UUIDs
+	if sorted {
+		keys = cm.Keys()
+	} else {
+		keys = make(UUIDs, 0, len(cm))
+		for k := range cm {
+			keys = append(keys, k)
+		}
+	}
+	for i := range keys {
+		ww.WriteObj(cm[keys[i]], sorted)
+		ww.writeString("\n")
+	}
+	ww.Flush()
+}
+
+// WriteStream works like Print, but flushes each object to w as soon as it's formatted, and stops at the first
+// write error, which is returned
+func (cm CfgMap) WriteStream(w io.Writer, sorted bool) error {
+	var keys UUIDs
+	if sorted {
+		keys = cm.Keys()
+	} else {
+		keys = make(UUIDs, 0, len(cm))
+		for k := range cm {
+			keys = append(keys, k)
+		}
+	}
+	ww := NewWriter(w)
+	for i := range keys {
+		err := ww.WriteObj(cm[keys[i]], sorted)
+		if err == nil {
+			err = ww.writeString("\n")
+		}
+		if err == nil {
+			err = ww.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (cm CfgMap) PrintUUIDs(w io.Writer, u UUIDs, sorted bool) {
 	for _, v := range u {
 		obj, ok := cm.GetByUUID(v)
@@ -573,6 +1767,11 @@ func (nc *NagiosCfg) PrintMatches(w io.Writer, sorted bool) {
 	}
 }
 
+// WriteStream writes the whole config to w, see CfgMap.WriteStream
+func (nc *NagiosCfg) WriteStream(w io.Writer, sorted bool) error {
+	return nc.Config.WriteStream(w, sorted)
+}
+
 func (nc *NagiosCfg) DumpString() string {
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
@@ -581,60 +1780,407 @@ func (nc *NagiosCfg) DumpString() string {
 	return buf.String()
 }
 
+// SaveToOrigin writes all objects back to the files they were read from. See CfgMap.WriteByFileIDBackup.
 func (nc *NagiosCfg) SaveToOrigin(sorted bool) error {
-	return nc.Config.WriteByFileID(sorted)
+	return nc.Config.writeFiles(nc.Config.SplitByFileID(sorted), sorted, nc.Backup, nc.WriteConcurrency)
+}
+
+// DiffAgainstOrigin returns a unified diff for each file SaveToOrigin would write, between the file on disk and
+// what would be written to it, keyed by filename. An empty diff means the file would not change.
+func (nc *NagiosCfg) DiffAgainstOrigin(sorted bool) (map[string]string, error) {
+	fmap := nc.Config.SplitByFileID(sorted)
+	diffs := make(map[string]string, len(fmap))
+	for fname, ids := range fmap {
+		old, err := ioutil.ReadFile(fname)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = nc.Config.writeIDs(&buf, ids, sorted)
+		if err != nil {
+			return nil, err
+		}
+		diffs[fname] = unifiedDiff(fname, fname, splitLines(string(old)), splitLines(buf.String()), DIFF_CONTEXT)
+	}
+	return diffs, nil
 }
 
 func (nc *NagiosCfg) WriteFile(filename string, sort bool) error {
 	return nc.Config.WriteFile(filename, sort)
 }
 
+func (nc *NagiosCfg) WriteFileMode(filename string, sort bool, mode os.FileMode) error {
+	return nc.Config.WriteFileMode(filename, sort, mode)
+}
+
+// WriteFile writes all objects to filename, in the order given by Keys(). An existing file keeps its mode and ownership,
+// new files get mode 0644.
 func (cm CfgMap) WriteFile(filename string, sort bool) error {
-	fhnd, err := os.Create(filename)
+	return cm.WriteFileMode(filename, sort, 0)
+}
+
+// WriteFileMode is like WriteFile, but sets the mode of filename to mode, regardless of umask.
+// A mode of 0 keeps the mode of an existing file.
+func (cm CfgMap) WriteFileMode(filename string, sort bool, mode os.FileMode) error {
+	_, _, err := cm.writeFile(filename, sort, mode)
+	return err
+}
+
+// WriteFileN works like WriteFile, but also returns the number of objects and bytes written, e.g. for logging,
+// or for catching output that is suspiciously small. The counts are of what was written before any error.
+func (cm CfgMap) WriteFileN(filename string, sort bool) (objs int, bytes int64, err error) {
+	return cm.writeFile(filename, sort, 0)
+}
+
+// AppendToFile works like WriteFile, but adds the objects to the end of filename instead of replacing its content.
+// If the file is not empty, a blank line is written first, to separate the new objects from what's already there.
+func (cm CfgMap) AppendToFile(filename string, sort bool) error {
+	return cm.AppendToFileMode(filename, sort, 0)
+}
+
+// AppendToFileMode is like AppendToFile, but sets the mode of filename to mode, as WriteFileMode does.
+func (cm CfgMap) AppendToFileMode(filename string, sort bool, mode os.FileMode) error {
+	fhnd, err := openFileMode(filename, os.O_APPEND, mode)
 	if err != nil {
 		return err
 	}
 	defer fhnd.Close()
-	w := bufio.NewWriter(fhnd)
-	for k := range cm {
-		cm[k].Print(w, sort)
+	fi, err := fhnd.Stat()
+	if err != nil {
+		return err
 	}
-	w.Flush()
-	return nil
+	w := NewWriter(fhnd)
+	if fi.Size() > 0 {
+		err = w.writeString("\n")
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range cm.Keys() {
+		err = w.WriteObj(cm[k], sort)
+		if err != nil {
+			w.Flush()
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// openFileMode opens filename for writing with the given flags. A new file is created with mode, or 0644 if mode is 0,
+// so it's never more permissive than asked for. A mode other than 0 is then also set on the file, regardless of umask
+// and of whether the file existed.
+func openFileMode(filename string, flag int, mode os.FileMode) (*os.File, error) {
+	perm := os.FileMode(0644)
+	if mode != 0 {
+		perm = mode.Perm()
+	}
+	fhnd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		err = fhnd.Chmod(perm)
+		if err != nil {
+			fhnd.Close()
+			return nil, err
+		}
+	}
+	return fhnd, nil
+}
+
+// writeFile does the work for WriteFileMode and WriteFileN
+func (cm CfgMap) writeFile(filename string, sort bool, mode os.FileMode) (int, int64, error) {
+	fhnd, err := openFileMode(filename, os.O_TRUNC, mode)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fhnd.Close()
+	return cm.writeCounted(fhnd, cm.Keys(), sort)
+}
+
+// writeCounted writes the objects with the given ids to out, returning the number of objects and bytes out accepted.
+// An object only counts once all of it is flushed, as the rest may still be buffered when a write fails.
+func (cm CfgMap) writeCounted(out io.Writer, ids UUIDs, sort bool) (int, int64, error) {
+	var bc byteCounter
+	w := NewWriter(io.MultiWriter(out, &bc)) // bc only sees what out accepted
+	ends := make([]int64, 0, len(ids))       // offset of the end of each object
+	var err error
+	for _, id := range ids {
+		err = w.WriteObj(cm[id], sort)
+		if err != nil {
+			break
+		}
+		ends = append(ends, int64(bc)+int64(w.w.Buffered()))
+	}
+	ferr := w.Flush()
+	if err == nil {
+		err = ferr
+	}
+	objs := len(ends)
+	for objs > 0 && ends[objs-1] > int64(bc) {
+		objs--
+	}
+	return objs, int64(bc), err
 }
 
 func (cm CfgMap) WriteByFileID(sort bool) error {
-	var wg sync.WaitGroup
-	fmap := cm.SplitByFileID(sort) // sorted and ready
-	schan := make(chan error)
+	return cm.WriteByFileIDBackup(sort, false)
+}
+
+// writeIDs writes the objects with the given ids to w, the same way for all functions writing files
+func (cm CfgMap) writeIDs(w io.Writer, ids UUIDs, sort bool) error {
+	ww := NewWriter(w)
+	for i := range ids {
+		err := ww.WriteObj(cm[ids[i]], sort)
+		if err == nil {
+			err = ww.writeString("\n") // add extra blank line between each object
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ww.Flush()
+}
 
+// writeTemp writes the objects with the given ids to a temporary file in the same directory as filename,
+// syncs it to disk, and returns the name of the temporary file
+func (cm CfgMap) writeTemp(filename string, ids UUIDs, sort bool) (string, error) {
+	fhnd, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpname := fhnd.Name()
+	fail := func(err error) (string, error) {
+		fhnd.Close()
+		os.Remove(tmpname)
+		return "", fmt.Errorf("%s: %s", filename, err)
+	}
 
-	// debug dups
-	//log.Debugf("fmap length: %d (in: %s)", len(fmap), oddebug.DebugInfoMedium(PROJECT_PREFIX))
-	//for k := range fmap {
-	//	dups := findDups(fmap[k])
-	//	if dups != nil {
-	//		log.Debugf("Dups in fmap[%s]: %q (in: %s)", k, fmap[k], oddebug.DebugInfoMedium(PROJECT_PREFIX))
-	//	}
-	//}
+	// TempFile creates files with mode 0600 owned by us, so use the mode and owner of the original, if any
+	var mode os.FileMode = 0644
+	fi, err := os.Stat(filename)
+	if err == nil {
+		mode = fi.Mode().Perm()
+		chownLike(fhnd, fi)
+	}
+	err = fhnd.Chmod(mode)
+	if err != nil {
+		return fail(err)
+	}
+
+	err = cm.writeIDs(fhnd, ids, sort)
+	if err != nil {
+		return fail(err)
+	}
+	err = fhnd.Sync()
+	if err != nil {
+		return fail(err)
+	}
+	err = fhnd.Close()
+	if err != nil {
+		os.Remove(tmpname)
+		return "", fmt.Errorf("%s: %s", filename, err)
+	}
+	return tmpname, nil
+}
+
+// backupFile copies the contents of filename to filename.bak, if filename exists.
+// The backup gets the mode and owner of the original, before anything is copied, as config may hold credentials.
+func backupFile(filename string) error {
+	_, err := copyFile(filename, filename+".bak")
+	return err
+}
+
+// copyFile copies the contents of src to dst, giving dst the mode and owner of src before anything is copied.
+// Returns false if src does not exist.
+func copyFile(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return true, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return true, err
+	}
+	chownLike(out, fi)
+	err = out.Chmod(fi.Mode().Perm()) // also for an existing file, which OpenFile leaves as it was
+	if err != nil {
+		out.Close()
+		return true, err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return true, err
+	}
+	return true, out.Close()
+}
+
+// keepOriginal saves the content of filename before it's replaced, in filename.bak if backup is true, or else in a
+// temporary file, and returns the name of the copy. An empty name means filename does not exist.
+func keepOriginal(filename string, backup bool) (string, error) {
+	if backup {
+		err := backupFile(filename)
+		if err != nil {
+			return "", err
+		}
+		if _, err = os.Stat(filename); os.IsNotExist(err) {
+			return "", nil
+		}
+		return filename + ".bak", nil
+	}
+	fhnd, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".orig")
+	if err != nil {
+		return "", err
+	}
+	orig := fhnd.Name()
+	fhnd.Close()
+	exists, err := copyFile(filename, orig)
+	if err != nil || !exists {
+		os.Remove(orig)
+		return "", err
+	}
+	return orig, nil
+}
+
+// restoreOriginal puts back the content of filename saved by keepOriginal, or removes filename if orig is empty,
+// as it did not exist before. A backup is copied back, so it's still there afterwards, other copies are renamed.
+func restoreOriginal(filename, orig string, backup bool) error {
+	if orig == "" {
+		return os.Remove(filename)
+	}
+	if backup {
+		fhnd, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".orig")
+		if err != nil {
+			return err
+		}
+		tmpname := fhnd.Name()
+		fhnd.Close()
+		_, err = copyFile(orig, tmpname)
+		if err != nil {
+			os.Remove(tmpname)
+			return err
+		}
+		orig = tmpname
+	}
+	return os.Rename(orig, filename)
+}
+
+// WriteByFileIDBackup writes each object back to the file given by its FileID.
+// All files are first written to temporary files, and only if all of them succeed are the originals replaced,
+// by renaming the temporary files. Should that fail for a file, the ones already replaced are restored.
+// If backup is true, the previous content of each file is kept in <file>.bak.
+// At most runtime.NumCPU() * DEF_WRITERS_PER_CPU files are written at once, see NagiosCfg.WriteConcurrency to change it.
+func (cm CfgMap) WriteByFileIDBackup(sort, backup bool) error {
+	return cm.writeFiles(cm.SplitByFileID(sort), sort, backup, 0)
+}
+
+// WriteByType writes the objects of each type into its own file in dir, named after the type, e.g. "hosts.cfg".
+// Objects of an invalid type are written to "unknown.cfg". Files are replaced the same way as in WriteByFileIDBackup.
+func (cm CfgMap) WriteByType(dir string, sort bool) error {
+	fmap := make(map[string]UUIDs)
+	for ct, ids := range cm.SplitByType() {
+		fmap[filepath.Join(dir, ct.Plural()+".cfg")] = ids
+	}
+	return cm.writeFiles(fmap, sort, false, 0)
+}
+
+// WriteChunks writes all objects to as few files as possible in dir, each no larger than maxBytes, and returns the
+// names of the files written, named prefix followed by a sequence number, e.g. "services_001.cfg" for prefix "services_".
+// Objects larger than maxBytes get a file of their own. Within each file, objects are in the order given by Keys.
+func (cm CfgMap) WriteChunks(dir, prefix string, maxBytes int, sorted bool) ([]string, error) {
+	if maxBytes < 1 {
+		return nil, fmt.Errorf("Invalid chunk size %d %s", maxBytes, dbgStr(true))
+	}
+	keys := cm.Keys()
+	sizes := make(map[UUID]int, len(keys))
+	bysize := make(UUIDs, len(keys))
+	copy(bysize, keys)
+	for i := range keys {
+		sizes[keys[i]] = cm[keys[i]].Size() + 1 // with the blank line after each object
+	}
+	sort.SliceStable(bysize, func(i, j int) bool {
+		return sizes[bysize[i]] > sizes[bysize[j]]
+	})
+
+	// first fit decreasing, which is simple and gets close to the fewest files possible
+	type chunk struct {
+		free int
+		ids  map[UUID]bool
+	}
+	var chunks []*chunk
+	for _, id := range bysize {
+		if sizes[id] > maxBytes {
+			log.Warnf("%s is %d bytes, more than the chunk size of %d, writing it to a file of its own", cm[id].Summary(), sizes[id], maxBytes)
+		}
+		var c *chunk
+		for i := range chunks {
+			if chunks[i].free >= sizes[id] {
+				c = chunks[i]
+				break
+			}
+		}
+		if c == nil {
+			c = &chunk{free: maxBytes, ids: make(map[UUID]bool)}
+			chunks = append(chunks, c)
+		}
+		c.free -= sizes[id]
+		c.ids[id] = true
+	}
+
+	fmap := make(map[string]UUIDs, len(chunks))
+	fnames := make([]string, 0, len(chunks))
+	for i := range chunks {
+		fname := filepath.Join(dir, fmt.Sprintf("%s%03d.cfg", prefix, i+1))
+		ids := make(UUIDs, 0, len(chunks[i].ids))
+		for _, k := range keys {
+			if chunks[i].ids[k] {
+				ids = append(ids, k)
+			}
+		}
+		fmap[fname] = ids
+		fnames = append(fnames, fname)
+	}
+	err := cm.writeFiles(fmap, sorted, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return fnames, nil
+}
+
+// writeFiles writes the objects with the given ids to each file in fmap, via temporary files.
+// No more than limit files are written at once, to not run out of file descriptors. A limit < 1 means the default.
+// If replacing a file fails, the files already replaced are restored, and the error names any that could not be.
+func (cm CfgMap) writeFiles(fmap map[string]UUIDs, sorted, backup bool, limit int) error {
+	var wg sync.WaitGroup
+	if limit < 1 {
+		limit = runtime.NumCPU() * DEF_WRITERS_PER_CPU
+	}
+	sem := make(chan struct{}, limit)
+
+	type result struct {
+		filename string
+		tmpname  string
+		err      error
+	}
+	schan := make(chan result)
 
 	for fname := range fmap {
 		wg.Add(1)
 		go func(filename string) {
 			defer wg.Done()
-			fhnd, err := os.Create(filename)
-			if err != nil {
-				schan <- err
-				return
-			}
-			defer fhnd.Close()
-			w := bufio.NewWriter(fhnd)
-			for i := range fmap[filename] {
-				cm[fmap[filename][i]].Print(w, sort)
-				fmt.Fprintf(w, "\n") // add extra blank line between each object
-			}
-			w.Flush()
-			schan <- nil
+			sem <- struct{}{}
+			tmpname, err := cm.writeTemp(filename, fmap[filename], sorted)
+			<-sem // release before sending the result, so waiting for it to be read doesn't hold up other writes
+			schan <- result{filename, tmpname, err}
 		}(fname)
 	}
 
@@ -644,17 +2190,65 @@ func (cm CfgMap) WriteByFileID(sort bool) error {
 	}()
 
 	var errcnt int
-	for e := range schan {
-		if e != nil {
-			log.Error(e)
+	tmpfiles := make(map[string]string)
+	for res := range schan {
+		if res.err != nil {
+			log.Error(res.err)
 			errcnt++
+			continue
 		}
+		tmpfiles[res.filename] = res.tmpname
 	}
 
 	if errcnt > 0 {
-		return fmt.Errorf("Error writing to %d files %s", errcnt, dbgStr(true))
+		for _, tmpname := range tmpfiles {
+			os.Remove(tmpname)
+		}
+		return fmt.Errorf("Error writing to %d files, no files changed %s", errcnt, dbgStr(true))
 	}
 
+	// replace the files in a fixed order, and on the first failure, put back the ones already replaced
+	fnames := make([]string, 0, len(tmpfiles))
+	for filename := range tmpfiles {
+		fnames = append(fnames, filename)
+	}
+	sort.Strings(fnames)
+
+	origs := make([]string, 0, len(fnames))
+	for i, filename := range fnames {
+		orig, err := keepOriginal(filename, backup)
+		if err == nil {
+			err = os.Rename(tmpfiles[filename], filename)
+			if err != nil && !backup && orig != "" {
+				os.Remove(orig)
+			}
+		}
+		if err == nil {
+			origs = append(origs, orig)
+			continue
+		}
+		log.Errorf("%s: %s", filename, err)
+		for _, name := range fnames[i:] {
+			os.Remove(tmpfiles[name])
+		}
+		changed := make([]string, 0)
+		for j := len(origs) - 1; j >= 0; j-- {
+			rerr := restoreOriginal(fnames[j], origs[j], backup)
+			if rerr != nil {
+				log.Errorf("%s: %s", fnames[j], rerr)
+				changed = append(changed, fnames[j])
+			}
+		}
+		if len(changed) > 0 {
+			return fmt.Errorf("Error replacing %s, and failed to restore %s %s", filename, strings.Join(changed, ", "), dbgStr(true))
+		}
+		return fmt.Errorf("Error replacing %s, no files changed %s", filename, dbgStr(true))
+	}
+
+	for _, orig := range origs {
+		if !backup && orig != "" {
+			os.Remove(orig)
+		}
+	}
 	return nil
 }
-
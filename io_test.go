@@ -17,11 +17,20 @@
 package nagioscfg
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 var cfgobjstr string = `# some comment
@@ -208,6 +217,22 @@ func BenchmarkReadFileChan(b *testing.B) {
 	}
 }
 
+func benchmarkReadFieldHint(b *testing.B, hint int) {
+	cfg := strings.Repeat(querycfgstr, 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewReader(strings.NewReader(cfg))
+		r.FieldHint = hint
+		_, err := r.ReadAllList(false, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFieldHintDefault(b *testing.B) { benchmarkReadFieldHint(b, DEF_FIELDS) }
+func BenchmarkReadFieldHint16(b *testing.B)      { benchmarkReadFieldHint(b, 16) }
+
 func TestWriteByFileID(t *testing.T) {
 	path := "../op5_automation/cfg/etc/services-mini.cfg"
 	file, err := os.Open(path)
@@ -421,3 +446,1960 @@ func TestNcfgMarshalJSON(t *testing.T) {
 func TestNcfgUnmarshalJSON(t *testing.T) {
 	//jbytes := []byte(`{"sessionid":"02e67b59-7193-11e7-82f9-0800279d8583","date":"2017-07-26T01:43:08.08799836+02:00","version":"2017-07-26","cfg":{"02e67853-7193-11e7-82f9-0800279d8583":{"uuid":"02e67853-7193-11e7-82f9-0800279d8583","fileid":"../op5_automation/cfg/etc/services-mini.cfg","type":8,"props":{"check_command":"check_snmpif_traffic_v2!wcar_supervision!224!1000mbit!70!90","servicegroups":"VGT_Infrastructure_Services","use":"linux-prod","host_name":"vgt-cn-sha-lb-02","service_description":"Interface 224 Traffic"}},"02e678f5-7193-11e7-82f9-0800279d8583":{"uuid":"02e678f5-7193-11e7-82f9-0800279d8583","fileid":"../op5_automation/cfg/etc/services-mini.cfg","type":8,"props":{"use":"linux-prod","host_name":"vgt-cn-sha-lb-02","service_description":"PING","check_command":"check_ping!100,20%!500,60%","servicegroups":"VGT_Infrastructure_Services"}},"02e67951-7193-11e7-82f9-0800279d8583":{"uuid":"02e67951-7193-11e7-82f9-0800279d8583","fileid":"../op5_automation/cfg/etc/services-mini.cfg","type":8,"props":{"check_command":"vgt_check_f5_psu!wcar_supervision!5","servicegroups":"PROD_VOC_CN_Services,VGT_Infrastructure_Services","contact_groups":"wcar_jour_got_sms,wcar_network","use":"linux-prod","host_name":"vgt-cn-sha-lb-02","service_description":"PSU Status"}}}}`)
 }
+
+func TestWriterWriteObj(t *testing.T) {
+	co := NewCfgObj(T_COMMAND)
+	co.Add("command_name", "gris")
+	co.Add("command_line", "$USER1$/check_gris")
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Indent = 2
+	w.Align = 14
+	err := w.WriteObj(co, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "# command 'gris'\ndefine command{\n  command_name  gris\n  command_line  $USER1$/check_gris\n  }\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%q\nGot:\n%q", exp, buf.String())
+	}
+
+	// object specific alignment should win over the Writers
+	buf.Reset()
+	co.Align = 13
+	w.WriteObj(co, true)
+	w.Flush()
+	if !strings.Contains(buf.String(), "  command_name gris\n") {
+		t.Errorf("Object alignment not respected:\n%s", buf.String())
+	}
+}
+
+type failWriter struct{}
+
+func (fw failWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func TestWriterWriteAllError(t *testing.T) {
+	cos := CfgObjs{NewCfgObj(T_HOST), NewCfgObj(T_HOST)}
+	cos[0].Add("host_name", "localhost")
+	w := NewWriter(failWriter{})
+	err := w.WriteAll(cos)
+	if err == nil {
+		t.Fatal("Expected error from WriteAll, got nil")
+	}
+	_, ok := err.(*WriteError)
+	if !ok {
+		t.Errorf("Expected *WriteError, got %T", err)
+	}
+}
+
+func TestReadInlineComments(t *testing.T) {
+	objstr := `define command{
+	command_name check_gris ; temporary override
+	command_line $USER1$/check_gris -s "a;b" -w 1;another comment
+	}`
+	rdr := NewReader(strings.NewReader(objstr))
+	co, err := rdr.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, _ := co.Get("command_name")
+	if val != "check_gris" {
+		t.Errorf("Expected value %q, got %q", "check_gris", val)
+	}
+	cmt, ok := co.GetInlineComment("command_name")
+	if !ok || cmt != "temporary override" {
+		t.Errorf("Expected inline comment %q, got %q", "temporary override", cmt)
+	}
+	val, _ = co.Get("command_line")
+	exp := `$USER1$/check_gris -s "a;b" -w 1` // split like any other directive, but not within quotes
+	if val != exp {
+		t.Errorf("Expected value %q, got %q", exp, val)
+	}
+	if cmt, ok = co.GetInlineComment("command_line"); !ok || cmt != "another comment" {
+		t.Errorf("Expected inline comment %q for command_line, got %q", "another comment", cmt)
+	}
+
+	var buf bytes.Buffer
+	co.PrintPropsSorted(&buf, "%s %s\n")
+	if !strings.Contains(buf.String(), "command_name check_gris ; temporary override\n") {
+		t.Errorf("Inline comment not printed:\n%s", buf.String())
+	}
+}
+
+func TestInlineCommentRoundTrip(t *testing.T) {
+	objstr := `define service{
+	host_name           web01
+	service_description Disk\; root ; checks /
+	notes               a\\;b
+	check_command       check_disk!'-p /;-w 10%'
+	}
+define command{
+	command_name check_both
+	command_line $USER1$/check_a 'x\;y'\; $USER1$/check_b ; temporary note
+	}
+`
+	cm := readTestMap(t, objstr)
+	svc := findByKey(cm, "host_name", "web01")
+	exp := map[string]string{
+		"service_description": "Disk; root",
+		"notes":               `a\;b`,
+		"check_command":       "check_disk!'-p /", // split like Nagios does
+	}
+	for k, v := range exp {
+		if svc.Props[k] != v {
+			t.Errorf("Expected %s %q, got %q", k, v, svc.Props[k])
+		}
+	}
+	if cmt, _ := svc.GetInlineComment("service_description"); cmt != "checks /" {
+		t.Errorf("Expected inline comment %q, got %q", "checks /", cmt)
+	}
+	cmd := findByKey(cm, "command_name", "check_both")
+	if cmd.Props["command_line"] != `$USER1$/check_a 'x;y'; $USER1$/check_b` {
+		t.Errorf("Expected escaped semicolons in command_line to be kept, got %q", cmd.Props["command_line"])
+	}
+	if cmt, _ := cmd.GetInlineComment("command_line"); cmt != "temporary note" {
+		t.Errorf("Expected inline comment %q for command_line, got %q", "temporary note", cmt)
+	}
+
+	svc.Set("notes", "x;y")
+	var buf bytes.Buffer
+	cm.Print(&buf, true)
+	if !strings.Contains(buf.String(), `x\;y`) {
+		t.Errorf("Expected semicolons to be escaped when written:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `$USER1$/check_b ; temporary note`) {
+		t.Errorf("Expected the command_line comment to be written as a comment:\n%s", buf.String())
+	}
+	cm2 := readTestMap(t, buf.String())
+	pairs := [][2]*CfgObj{
+		{svc, findByKey(cm2, "host_name", "web01")},
+		{cmd, findByKey(cm2, "command_name", "check_both")},
+	}
+	for _, p := range pairs {
+		if p[1] == nil || !reflect.DeepEqual(p[0].Props, p[1].Props) || !reflect.DeepEqual(p[0].InlineComments, p[1].InlineComments) {
+			t.Errorf("Object changed by writing and reading back:\n%v\n%v", p[0], p[1])
+		}
+	}
+}
+
+func TestPrintPropsOriginal(t *testing.T) {
+	objstr := `define service{
+	service_description PigInABlanket
+	use generic-service
+	host_name pighost04
+	contacts odd
+	}`
+	rdr := NewReader(strings.NewReader(objstr))
+	co, err := rdr.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	co.PrintPropsOriginal(&buf, "%s %s\n")
+	exp := "service_description PigInABlanket\nuse generic-service\nhost_name pighost04\ncontacts odd\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+	}
+
+	co.Del("use")
+	co.Set("host_name", "pighost05")
+	co.Add("notes", "oink")
+	buf.Reset()
+	co.PrintPropsOriginal(&buf, "%s %s\n")
+	exp = "service_description PigInABlanket\nhost_name pighost05\ncontacts odd\nnotes oink\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+	}
+}
+
+func TestReadChanContext(t *testing.T) {
+	objstr := strings.Repeat("define host{\n\thost_name gris\n\t}\n", 100)
+	rdr := NewReader(strings.NewReader(objstr))
+	ctx, cancel := context.WithCancel(context.Background())
+	ochan := rdr.ReadChanContext(ctx, false, "")
+	<-ochan
+	cancel()
+	cnt := 0
+	for range ochan {
+		cnt++
+	}
+	if cnt >= 99 {
+		t.Errorf("Expected reading to stop after cancel, but got %d more objects", cnt)
+	}
+}
+
+func TestParseErrorFile(t *testing.T) {
+	e := &ParseError{Line: 12, Column: 4, Err: ErrUnknown}
+	exp := "line 12, column 4: unknown parsing error"
+	if e.Error() != exp {
+		t.Errorf("Expected %q, got %q", exp, e.Error())
+	}
+	e.File = "file.cfg"
+	exp = "file.cfg:line 12, column 4: unknown parsing error"
+	if e.Error() != exp {
+		t.Errorf("Expected %q, got %q", exp, e.Error())
+	}
+}
+
+func TestCfgObjJSONRoundTrip(t *testing.T) {
+	rdr := NewReader(strings.NewReader(cfgobjstr))
+	co, err := rdr.Read(true, "/opt/monitor/etc/services.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jval, err := json.Marshal(co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(jval), `"type":"service"`) || !strings.Contains(string(jval), `"file_id":`) {
+		t.Errorf("Unexpected JSON format: %s", jval)
+	}
+	co2 := &CfgObj{}
+	err = json.Unmarshal(jval, co2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co2.Type != co.Type || !co2.UUID.Equals(co.UUID) || co2.FileID != co.FileID || !reflect.DeepEqual(co2.Props, co.Props) {
+		t.Errorf("Round trip mismatch:\n%+v\n%+v", co, co2)
+	}
+
+	err = json.Unmarshal([]byte(`{"type":"gris","props":{}}`), co2)
+	if err == nil {
+		t.Error("Expected error for invalid type")
+	}
+}
+
+func TestWriteByFileIDBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/services.cfg"
+	err = ioutil.WriteFile(fname, []byte("original\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := readTestMap(t, querycfgstr)
+	for k := range cm {
+		cm[k].FileID = fname
+	}
+	err = cm.WriteByFileIDBackup(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bak, err := ioutil.ReadFile(fname + ".bak")
+	if err != nil || string(bak) != "original\n" {
+		t.Errorf("Backup not written correctly: %q %v", bak, err)
+	}
+	bfi, err := os.Stat(fname + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bfi.Mode().Perm() != 0640 {
+		t.Errorf("Expected backup with mode 0640, got %v", bfi.Mode().Perm())
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %v", fi.Mode().Perm())
+	}
+	m2 := readTestMap(t, mustReadFile(t, fname))
+	if m2.Len() != 3 {
+		t.Errorf("Expected 3 objects in written file, got %d", m2.Len())
+	}
+
+	// one file that can't be written should leave the other untouched
+	for k := range cm {
+		cm[k].FileID = dir + "/nonexistent/hosts.cfg"
+		break
+	}
+	err = cm.WriteByFileIDBackup(true, false)
+	if err == nil {
+		t.Fatal("Expected error writing to nonexistent dir")
+	}
+	m2 = readTestMap(t, mustReadFile(t, fname))
+	if m2.Len() != 3 {
+		t.Errorf("Expected original file untouched with 3 objects, got %d", m2.Len())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected temp files to be cleaned up, got %d files", len(files))
+	}
+}
+
+func TestWriteFilesRestore(t *testing.T) {
+	for _, backup := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "ncfg-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err = ioutil.WriteFile(dir+"/a.cfg", []byte("original\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Mkdir(dir+"/b.cfg", 0755); err != nil { // can't be replaced by a file
+			t.Fatal(err)
+		}
+
+		// files are replaced in order, so a.cfg and the new aa.cfg are done before b.cfg fails
+		cm := readTestMap(t, querycfgstr)
+		ids := cm.Keys()
+		fmap := map[string]UUIDs{
+			dir + "/a.cfg":  ids[:1],
+			dir + "/aa.cfg": ids[1:2],
+			dir + "/b.cfg":  ids[2:],
+		}
+		err = cm.writeFiles(fmap, true, backup, 0)
+		if err == nil || !strings.Contains(err.Error(), "no files changed") {
+			t.Errorf("backup %v: expected error with all files restored, got %v", backup, err)
+		}
+		if data := mustReadFile(t, dir+"/a.cfg"); data != "original\n" {
+			t.Errorf("backup %v: expected a.cfg to be restored, got %q", backup, data)
+		}
+		if _, err = os.Stat(dir + "/aa.cfg"); !os.IsNotExist(err) {
+			t.Errorf("backup %v: expected new file aa.cfg to be removed, got %v", backup, err)
+		}
+		files, _ := ioutil.ReadDir(dir)
+		for _, fi := range files {
+			if strings.HasPrefix(fi.Name(), ".") {
+				t.Errorf("backup %v: expected temp files to be cleaned up, found %s", backup, fi.Name())
+			}
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, fname string) string {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGzipFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeGz := func(fname string) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte(querycfgstr))
+		gw.Close()
+		err := ioutil.WriteFile(fname, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{dir + "/a.cfg.gz", dir + "/b.cfg", dir + "/c.cfg"}
+	writeGz(files[0])
+	writeGz(files[1]) // compressed, but without the suffix
+	err = ioutil.WriteFile(files[2], []byte(querycfgstr), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfr := NewMultiFileReader(files...)
+	if len(mfr) != len(files) {
+		t.Fatalf("Expected %d readers, got %d", len(files), len(mfr))
+	}
+	cnt := 0
+	for range mfr.ReadChan(false) {
+		cnt++
+	}
+	if cnt != 9 {
+		t.Errorf("Expected 9 objects from 3 files, got %d", cnt)
+	}
+	err = mfr.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+var brokencfgstr string = `define service{
+	host_name           ok1
+	service_description first
+	}
+define bogus{
+	host_name           bad1
+	}
+define service{
+	host_name           bad2
+	service_description never closed
+define service{
+	host_name           ok2
+	service_description second
+	}
+`
+
+func TestReadLenient(t *testing.T) {
+	r := NewReader(strings.NewReader(brokencfgstr))
+	_, err := r.ReadAllMap("")
+	if err == nil {
+		t.Errorf("Expected error in strict mode")
+	}
+
+	r = NewReader(strings.NewReader(brokencfgstr))
+	r.Lenient = true
+	cm, err := r.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Len() != 2 {
+		t.Errorf("Expected 2 objects, got %d", cm.Len())
+	}
+	for _, co := range cm {
+		hn, _ := co.Get("host_name")
+		if hn != "ok1" && hn != "ok2" {
+			t.Errorf("Unexpected object with host_name %q", hn)
+		}
+	}
+	errs := r.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	pe, ok := errs[0].(*ParseError)
+	if !ok || pe.Err != ErrUnknown {
+		t.Errorf("Unexpected first error: %v", errs[0])
+	}
+	pe, ok = errs[1].(*ParseError)
+	if !ok || pe.Err != ErrNotClosed {
+		t.Errorf("Unexpected second error: %v", errs[1])
+	}
+}
+
+func TestWriteByType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := readTestMap(t, querycfgstr)
+	h := NewCfgObjWithUUID(T_HOST)
+	h.Add("host_name", "web01")
+	cm[h.UUID] = h
+	bad := NewCfgObjWithUUID(T_INVALID)
+	cm[bad.UUID] = bad
+
+	err = cm.WriteByType(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"services.cfg": 3, "hosts.cfg": 1, "unknown.cfg": 1}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != len(expected) {
+		t.Errorf("Expected %d files, got %d", len(expected), len(files))
+	}
+	for fname, cnt := range expected {
+		data := mustReadFile(t, dir+"/"+fname)
+		if n := strings.Count(data, "define "); n != cnt {
+			t.Errorf("Expected %d objects in %s, got %d", cnt, fname, n)
+		}
+	}
+}
+
+// countWriter counts calls to Write, and fails after limit calls
+type countWriter struct {
+	calls int
+	limit int
+	buf   bytes.Buffer
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.calls++
+	if cw.calls > cw.limit {
+		return 0, fmt.Errorf("broken pipe")
+	}
+	return cw.buf.Write(p)
+}
+
+func TestWriteStream(t *testing.T) {
+	cm := readTestMap(t, querycfgstr)
+
+	cw := &countWriter{limit: 100}
+	err := cm.WriteStream(cw, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw.calls != cm.Len() {
+		t.Errorf("Expected one write per object, got %d writes for %d objects", cw.calls, cm.Len())
+	}
+	if n := strings.Count(cw.buf.String(), "define service{"); n != cm.Len() {
+		t.Errorf("Expected %d objects in output, got %d", cm.Len(), n)
+	}
+
+	cw = &countWriter{limit: 1}
+	err = cm.WriteStream(cw, true)
+	if err == nil {
+		t.Fatal("Expected error from WriteStream")
+	}
+	if cw.calls != 2 {
+		t.Errorf("Expected WriteStream to stop at first error, got %d writes", cw.calls)
+	}
+}
+
+func TestPrintAligned(t *testing.T) {
+	cm := readTestMap(t, querycfgstr)
+	for _, v := range cm {
+		v.Indent = 8 // should be ignored
+		v.Align = 40
+	}
+	var buf bytes.Buffer
+	cm.PrintAligned(&buf, 2, 0, true)
+	align := len("service_description") + 2
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(line, "  host_name") {
+			continue
+		}
+		if !strings.HasPrefix(line, "  host_name"+strings.Repeat(" ", align-len("host_name"))+"db_") &&
+			!strings.HasPrefix(line, "  host_name"+strings.Repeat(" ", align-len("host_name"))+"web") {
+			t.Errorf("Unexpected formatting: %q", line)
+		}
+	}
+}
+
+var leadcmtcfgstr string = `# not attached, as it's followed by a blank line
+
+# Web server
+# owner: ops
+define host{
+	host_name           web01
+	# embedded comment
+	}
+define host{
+	host_name           web02
+	}
+`
+
+func TestLeadingComments(t *testing.T) {
+	r := NewReader(strings.NewReader(leadcmtcfgstr))
+	o1, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o2, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"# Web server", "# owner: ops"}
+	if !reflect.DeepEqual(o1.LeadingComments, expected) {
+		t.Errorf("Expected %q, got %q", expected, o1.LeadingComments)
+	}
+	if o2.LeadingComments != nil {
+		t.Errorf("Expected no leading comments for second object, got %q", o2.LeadingComments)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteObj(o1, true)
+	w.Flush()
+	if !strings.HasPrefix(buf.String(), "# Web server\n# owner: ops\ndefine host{\n") {
+		t.Errorf("Leading comments not preserved: %q", buf.String())
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Regen = true
+	w.WriteObj(o1, true)
+	w.Flush()
+	if !strings.HasPrefix(buf.String(), "# host 'web01'\ndefine host{\n") {
+		t.Errorf("Expected generated comment: %q", buf.String())
+	}
+}
+
+func TestNormalizeSpaces(t *testing.T) {
+	cfg := "define host{\n\thost_name\u00a0web01\u200b\n\talias  Web\u00a0server\n\t}\n"
+
+	r := NewReader(strings.NewReader(cfg))
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hn, _ := co.Get("host_name"); hn != "web01\u200b" {
+		t.Errorf("Expected zero width space to be kept without NormalizeSpaces, got %q", hn)
+	}
+	if len(r.Warnings()) != 0 {
+		t.Errorf("Expected no warnings without NormalizeSpaces")
+	}
+
+	r = NewReader(strings.NewReader(cfg))
+	r.NormalizeSpaces = true
+	co, err = r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hn, _ := co.Get("host_name"); hn != "web01" {
+		t.Errorf("Expected %q, got %q", "web01", hn)
+	}
+	if alias, _ := co.Get("alias"); alias != "Web server" {
+		t.Errorf("Expected %q, got %q", "Web server", alias)
+	}
+	warns := r.Warnings()
+	if len(warns) != 3 {
+		t.Fatalf("Expected 3 warnings, got %d: %v", len(warns), warns)
+	}
+	pe, ok := warns[0].(*ParseError)
+	if !ok || pe.Line != 2 || !strings.Contains(pe.Error(), "U+00A0") {
+		t.Errorf("Unexpected warning: %v", warns[0])
+	}
+}
+
+func TestReadQuoted(t *testing.T) {
+	cfg := "define host{\n\thost_name  web01\n\tnotes      \"hello   world\t!\"\n\tnotes_url  http://x/?a=\"b  c\"\n\t}\n"
+	r := NewReader(strings.NewReader(cfg))
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := co.Get("notes"); v != "hello   world\t!" {
+		t.Errorf("Expected spacing preserved and quotes removed, got %q", v)
+	}
+	if v, _ := co.Get("notes_url"); v != `http://x/?a="b  c"` {
+		t.Errorf("Expected quotes within value to be kept, got %q", v)
+	}
+
+	var buf bytes.Buffer
+	co.Print(&buf, true)
+	co2, err := NewReader(&buf).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !co.Equal(co2) {
+		t.Errorf("Round trip failed: %v", co.Diff(co2))
+	}
+
+	cfg = "define host{\n\thost_name  web01\n\tnotes      \"hello\n\t}\n"
+	_, err = NewReader(strings.NewReader(cfg)).Read(false, "")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Err != ErrQuote || pe.Line != 3 || pe.Column != 12 {
+		t.Errorf("Expected unterminated quote error at line 3, column 12, got %v", err)
+	}
+	_, err = NewReader(strings.NewReader("define host{\n\tnotes      \"hello")).Read(false, "")
+	if pe, ok = err.(*ParseError); !ok || pe.Err != ErrQuote || pe.Line != 2 {
+		t.Errorf("Expected unterminated quote error at line 2, got %v", err)
+	}
+
+	// quotes in command_line are for the shell
+	cfg = "define command{\n\tcommand_name  check_quote\n\tcommand_line  /bin/echo '\"' \\\" \"a  b\"\n\t}\n"
+	co, err = NewReader(strings.NewReader(cfg)).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := co.Get("command_line"); v != `/bin/echo '"' \" "a b"` {
+		t.Errorf("Expected command_line quotes to be kept as is, got %q", v)
+	}
+}
+
+func TestAdditive(t *testing.T) {
+	cfg := "define host{\n\thost_name       web01\n\tcontact_groups  +admins\n\tnotes           +46 555 123\n\t}\n"
+	co, err := NewReader(strings.NewReader(cfg)).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := co.Get("contact_groups"); v != "admins" || !co.IsAdditive("contact_groups") {
+		t.Errorf("Expected additive contact_groups %q, got %q", "admins", v)
+	}
+	if v, _ := co.Get("notes"); v != "+46 555 123" || co.IsAdditive("notes") {
+		t.Errorf("Expected notes to be kept as is, got %q", v)
+	}
+
+	co.AppendToList("contact_groups", SEP_LST, "ops", "dba")
+	if v, _ := co.Get("contact_groups"); v != "admins,ops,dba" {
+		t.Errorf("Unexpected value after AppendToList: %q", v)
+	}
+	co.AppendToList("hostgroups", SEP_LST, "web")
+	if v, _ := co.Get("hostgroups"); v != "web" {
+		t.Errorf("Unexpected value after AppendToList on new key: %q", v)
+	}
+
+	var buf bytes.Buffer
+	co.Print(&buf, true)
+	if !strings.Contains(buf.String(), "+admins,ops,dba\n") {
+		t.Errorf("Expected additive marker in output: %q", buf.String())
+	}
+	co2, err := NewReader(&buf).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !co.Equal(co2) || !co2.IsAdditive("contact_groups") {
+		t.Errorf("Round trip failed")
+	}
+
+	data, err := json.Marshal(co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co3 := &CfgObj{}
+	err = json.Unmarshal(data, co3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !co3.IsAdditive("contact_groups") {
+		t.Errorf("Additive flag lost in JSON round trip: %s", data)
+	}
+
+	// the additive flag is part of the value when comparing
+	co4 := co.Clone()
+	co4.SetAdditive("contact_groups", false)
+	if co.Equal(co4) || co4.Equal(co) {
+		t.Errorf("Expected objects differing only in additive flag to not be Equal")
+	}
+	exp := []PropDiff{{Key: "contact_groups", Old: "+admins,ops,dba", New: "admins,ops,dba", Change: DIFF_MODIFIED}}
+	if diffs := co.Diff(co4); !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("Expected %v, got %v", exp, diffs)
+	}
+
+	// replacing in the value keeps it additive, setting a new one does not
+	m := CfgMap{co.UUID: co}
+	if m.ReplaceInValues("contact_groups", regexp.MustCompile(`^admins`), "root") != 1 || !co.IsAdditive("contact_groups") {
+		t.Errorf("Expected ReplaceInValues to keep contact_groups additive")
+	}
+	co.Set("contact_groups", "admins")
+	if co.IsAdditive("contact_groups") {
+		t.Errorf("Expected Set to clear the additive flag")
+	}
+}
+
+func TestBraceStyle(t *testing.T) {
+	co := NewCfgObj(T_HOST)
+	co.Add("host_name", "web01")
+	co.Comment = "# web"
+
+	expected := map[BraceStyle]string{
+		BRACE_SAME_AS_INDENT: "# web\ndefine host{\n    host_name                      web01\n    }\n",
+		BRACE_FLUSH_LEFT:     "# web\ndefine host{\n    host_name                      web01\n}\n",
+	}
+	for style, exp := range expected {
+		co.BraceStyle = style
+		var buf bytes.Buffer
+		co.Print(&buf, true)
+		if buf.String() != exp {
+			t.Errorf("Brace style %d: expected %q, got %q", style, exp, buf.String())
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	cos := CfgObjs{NewCfgObj(T_SERVICE), NewCfgObj(T_SERVICE)}
+	cos[0].Add("host_name", "web01")
+	cos[0].Add("service_description", "HTTP, port 80")
+	cos[0].Add("check_interval", "5")
+	cos[1].Add("host_name", "db01")
+	cos[1].Add("check_command", "check_mysql")
+
+	var buf bytes.Buffer
+	err := cos.WriteCSV(&buf, "host_name", "service_description", "check_command", "check_interval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "host_name,service_description,check_command,check_interval\n" +
+		"web01,\"HTTP, port 80\",,5\n" +
+		"db01,,check_mysql,\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+	}
+
+	err = cos.WriteCSV(failWriter{}, "host_name")
+	if err == nil {
+		t.Errorf("Expected write error")
+	}
+
+	m := readTestMap(t, querycfgstr)
+	// rows follow the read order, the same on every call
+	exp = "host_name\ndb_dummy_gso\ndb_dummy_test\nweb01\n"
+	for i := 0; i < 5; i++ {
+		buf.Reset()
+		if err = m.WriteCSV(&buf, "host_name"); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != exp {
+			t.Fatalf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+		}
+	}
+}
+
+func TestNewMultiFileReaderWith(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := "; legacy comment\ndefine host{\n\thost_name  web01\n\t}\n"
+	files := []string{dir + "/a.cfg", dir + "/b.cfg"}
+	for _, f := range files {
+		err = ioutil.WriteFile(f, []byte(cfg), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfr := NewMultiFileReaderWith(files, WithComment(';'), WithInlineComment(0))
+	defer mfr.Close()
+	cnt := 0
+	for co := range mfr.ReadChan(false) {
+		cnt++
+		if len(co.LeadingComments) != 1 || co.LeadingComments[0] != "; legacy comment" {
+			t.Errorf("Expected legacy comment, got %q", co.LeadingComments)
+		}
+	}
+	if cnt != 2 {
+		t.Errorf("Expected 2 objects, got %d", cnt)
+	}
+	for i := range mfr {
+		if mfr[i].Comment != ';' || mfr[i].InlineComment != 0 {
+			t.Errorf("Options not applied to reader #%d", i)
+		}
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	r := NewReader(strings.NewReader(hgcfgstr))
+	_, err := r.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := r.Stats()
+	if st.ObjectsRead != 5 || st.ByType[T_HOSTGROUP] != 2 || st.ByType[T_HOST] != 1 || st.ByType[T_SERVICE] != 2 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+	if exp := strings.Count(hgcfgstr, "\n"); st.LinesRead != exp {
+		t.Errorf("Expected %d lines read, got %d", exp, st.LinesRead)
+	}
+	if st.Duration <= 0 {
+		t.Errorf("Expected duration to be set")
+	}
+}
+
+var layoutcfgstr string = `# web server
+define host{
+  host_name     web01
+  address       10.0.0.1 ; primary
+  contact_groups +admins
+}
+
+# database
+define service{
+        host_name                 db01
+        service_description       MySQL
+        check_command             check_mysql!"-u  nagios"
+        }
+
+`
+
+func TestReadWriteLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/layout.cfg"
+	err = ioutil.WriteFile(fname, []byte(layoutcfgstr), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := NewFileReader(fname)
+	if fr == nil {
+		t.Fatalf("Failed to open %q", fname)
+	}
+	defer fr.Close()
+	var cos CfgObjs
+	for co := range fr.ReadChan(false, fname) {
+		cos = append(cos, co)
+	}
+	if len(cos) != 2 {
+		t.Fatalf("Expected 2 objects, got %d", len(cos))
+	}
+	if cos[0].Indent != 2 || cos[0].Align != 14 || cos[0].BraceStyle != BRACE_FLUSH_LEFT {
+		t.Errorf("Unexpected layout for first object: %d %d %d", cos[0].Indent, cos[0].Align, cos[0].BraceStyle)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Sorted = false
+	err = w.WriteAll(cos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != layoutcfgstr {
+		t.Errorf("Round trip differs.\nExpected:\n%s\nGot:\n%s", layoutcfgstr, buf.String())
+	}
+}
+
+func TestReadProgress(t *testing.T) {
+	var sb strings.Builder
+	for sb.Len() < int(DEF_PROGRESS)*3 {
+		sb.WriteString(querycfgstr)
+	}
+	cfg := sb.String()
+
+	r := NewReader(strings.NewReader(cfg))
+	var calls []int64
+	r.Progress = func(n int64) {
+		calls = append(calls, n)
+	}
+	for range r.ReadChan(false, "") {
+	}
+	if r.BytesRead() != int64(len(cfg)) {
+		t.Errorf("Expected %d bytes read, got %d", len(cfg), r.BytesRead())
+	}
+	if len(calls) != 3 {
+		t.Errorf("Expected 3 progress calls, got %d", len(calls))
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i] <= calls[i-1] {
+			t.Errorf("Expected increasing progress, got %v", calls)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/a.cfg"
+	ioutil.WriteFile(fname, []byte(querycfgstr), 0644)
+	fr := NewFileReader(fname)
+	defer fr.Close()
+	size, err := fr.Size()
+	if err != nil || size != int64(len(querycfgstr)) {
+		t.Errorf("Expected size %d, got %d (%v)", len(querycfgstr), size, err)
+	}
+}
+
+func TestReaderOrder(t *testing.T) {
+	r := NewReader(strings.NewReader(querycfgstr))
+	cm, err := r.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := r.Order()
+	if len(order) != len(cm) {
+		t.Fatalf("Expected %d UUIDs in order, got %d", len(cm), len(order))
+	}
+	want := []string{"db_dummy_gso", "db_dummy_test", "web01"}
+	for i := range order {
+		if name := cm[order[i]].Props["host_name"]; name != want[i] {
+			t.Errorf("Expected object %d to be %q, got %q", i, want[i], name)
+		}
+	}
+
+	var buf bytes.Buffer
+	cm.PrintInReadOrder(&buf, order, false)
+	out := buf.String()
+	prev := -1
+	for _, name := range want {
+		idx := strings.Index(out, name)
+		if idx <= prev {
+			t.Errorf("Expected %q after position %d, got %d", name, prev, idx)
+		}
+		prev = idx
+	}
+}
+
+func TestKeysReadOrder(t *testing.T) {
+	r := NewReader(strings.NewReader(querycfgstr))
+	cm, err := r.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewCfgObjWithUUID(T_HOST)
+	b := NewCfgObjWithUUID(T_HOST)
+	cm[a.UUID] = a
+	cm[b.UUID] = b
+	delete(cm, r.Order()[1])
+
+	first, second := a.UUID, b.UUID
+	if bytes.Compare(first.Bytes(), second.Bytes()) > 0 {
+		first, second = second, first
+	}
+	exp := UUIDs{r.Order()[0], r.Order()[2], first, second}
+	for i := 0; i < 5; i++ {
+		if keys := cm.Keys(); !reflect.DeepEqual(keys, exp) {
+			t.Fatalf("Expected keys %v, got %v", exp, keys)
+		}
+	}
+
+	// objects from a later read come after
+	r2 := NewReader(strings.NewReader("define host{\n\thost_name x\n\t}\ndefine host{\n\thost_name y\n\t}\n"))
+	cm2, err := r2.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range cm2 {
+		cm[k] = v
+	}
+	if keys := cm.Keys(); !reflect.DeepEqual(keys[2:4], r2.Order()) {
+		t.Errorf("Expected objects from the second read after the first, got %v", keys)
+	}
+}
+
+func TestToYAML(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	keys := m.Keys()
+	cos := make(CfgObjs, 0, len(keys))
+	for i := range keys {
+		cos = append(cos, m[keys[i]])
+	}
+	var buf bytes.Buffer
+	if err := cos.ToYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if n := strings.Count(out, "- type: service\n"); n != len(cos) {
+		t.Errorf("Expected %d objects in YAML, got %d:\n%s", len(cos), n, out)
+	}
+	// props must be in sort order, and all be present
+	objs := strings.Split(out, "- type: ")[1:]
+	for i, co := range cos {
+		prev := -1
+		for _, k := range co.sortedKeys() {
+			idx := strings.Index(objs[i], "    "+k+": "+co.Props[k]+"\n")
+			if idx <= prev {
+				t.Errorf("Expected %q with value %q after position %d, got %d:\n%s", k, co.Props[k], prev, idx, objs[i])
+			}
+			prev = idx
+		}
+	}
+}
+
+func TestParseResourceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := dir + "/resource.cfg"
+	ioutil.WriteFile(fname, []byte("# plugins\n$USER1$=/usr/lib/nagios/plugins\n\n$USER3$ = secret=word\n"), 0644)
+	res, err := ParseResourceFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{"$USER1$": "/usr/lib/nagios/plugins", "$USER3$": "secret=word"}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("Expected %v, got %v", exp, res)
+	}
+
+	o := NewCfgObj(T_COMMAND)
+	o.Add("command_name", "check_http")
+	o.Add("command_line", "$USER1$/check_http -a $USER3$ -H $HOSTADDRESS$ -x $USER2$ -p $$USER1$")
+	cl := o.ExpandMacros(res)
+	if cl != "/usr/lib/nagios/plugins/check_http -a secret=word -H $HOSTADDRESS$ -x $USER2$ -p $$USER1$" {
+		t.Errorf("Unexpected expansion: %q", cl)
+	}
+
+	ioutil.WriteFile(fname, []byte("$USER1$=/usr/lib\n$HOSTNAME$=foo\n"), 0644)
+	_, err = ParseResourceFile(fname)
+	if err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("Expected error on line 2, got %v", err)
+	}
+}
+
+func TestReadTimeperiod(t *testing.T) {
+	cfg := `define timeperiod{
+  timeperiod_name  holidays
+  alias            Holidays, 08:00-17:00 on weekdays
+  monday           08:00-17:00
+  day 1            00:00-24:00 ; first of every month
+  day 15           00:00-24:00
+  2009-01-01       00:00-00:00
+  monday 3 january - thursday 4 february / 5  00:00-09:00, 17:00-24:00
+  }
+`
+	r := NewReader(strings.NewReader(cfg))
+	r.InlineComment = ';'
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(co.Props) != 2 {
+		t.Errorf("Expected 2 regular properties, got %v", co.Props)
+	}
+	exp := []TimeRange{
+		{Day: "monday", Ranges: "08:00-17:00"},
+		{Day: "day 1", Ranges: "00:00-24:00", Comment: "first of every month"},
+		{Day: "day 15", Ranges: "00:00-24:00"},
+		{Day: "2009-01-01", Ranges: "00:00-00:00"},
+		{Day: "monday 3 january - thursday 4 february / 5", Ranges: "00:00-09:00, 17:00-24:00"},
+	}
+	if !reflect.DeepEqual(co.TimeRanges, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, co.TimeRanges)
+	}
+
+	var buf bytes.Buffer
+	co.Print(&buf, false)
+	r = NewReader(strings.NewReader(buf.String()))
+	r.InlineComment = ';'
+	co2, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !co.Equal(co2) || !reflect.DeepEqual(co2.TimeRanges, exp) {
+		t.Errorf("Round trip failed:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "  day 15           00:00-24:00\n") {
+		t.Errorf("Expected time range to keep alignment:\n%s", buf.String())
+	}
+
+	jb, err := json.Marshal(co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co3 := &CfgObj{}
+	if err = json.Unmarshal(jb, co3); err != nil {
+		t.Fatal(err)
+	}
+	if !co.Equal(co3) {
+		t.Errorf("JSON round trip lost time ranges: %s", jb)
+	}
+	if co.Clone().TimeRanges[4] != exp[4] {
+		t.Errorf("Clone lost time ranges")
+	}
+}
+
+func TestEditTimeperiod(t *testing.T) {
+	cfg := "define timeperiod{\n  timeperiod_name  workhours\n  monday           00:00-24:00\n  day 1            00:00-24:00\n  }\n"
+	co, err := NewReader(strings.NewReader(cfg)).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := co.Get("monday"); !ok || v != "00:00-24:00" {
+		t.Errorf("Expected monday to be found, got %q, %v", v, ok)
+	}
+	if co.Add("monday", "09:00-17:00") {
+		t.Error("Expected Add to not overwrite monday")
+	}
+	if !co.Set("monday", "00:00-12:00") {
+		t.Error("Expected Set to report monday as overwritten")
+	}
+	if co.Set("tuesday", "09:00-17:00") {
+		t.Error("Expected Set to report tuesday as added")
+	}
+	if !co.Del("day 1") || co.Del("day 1") {
+		t.Error("Expected day 1 to be deleted once")
+	}
+	if len(co.Props) != 1 {
+		t.Errorf("Expected days to be kept out of Props, got %v", co.Props)
+	}
+
+	var buf bytes.Buffer
+	co.Print(&buf, false)
+	exp := []TimeRange{{Day: "monday", Ranges: "00:00-12:00"}, {Day: "tuesday", Ranges: "09:00-17:00"}}
+	co2, err := NewReader(strings.NewReader(buf.String())).Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "monday") != 1 || !reflect.DeepEqual(co2.TimeRanges, exp) {
+		t.Errorf("Expected %v, got:\n%s", exp, buf.String())
+	}
+}
+
+func TestSize(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	var buf bytes.Buffer
+	m.Print(&buf, false)
+	if m.TotalSize() != buf.Len() {
+		t.Errorf("Expected total size %d, got %d", buf.Len(), m.TotalSize())
+	}
+	for _, co := range m {
+		if co.Size() != len(co.String()) {
+			t.Errorf("Expected size %d, got %d", len(co.String()), co.Size())
+		}
+	}
+}
+
+func TestStringSizeReadOnly(t *testing.T) {
+	co := NewCfgObj(T_SERVICE)
+	co.Add("host_name", "web01")
+	co.Add("service_description", "HTTP")
+	cmt := co.Comment
+	_ = co.String()
+	_ = co.Size()
+	_ = fmt.Sprintf("%v", co)
+	if co.Comment != cmt {
+		t.Errorf("Expected comment %q to be left as is, got %q", cmt, co.Comment)
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := readTestMap(t, querycfgstr)
+	max := cm.TotalSize()
+	h := NewCfgObjWithUUID(T_HOST)
+	h.Add("host_name", "web01")
+	h.Add("alias", strings.Repeat("x", max))
+	cm[h.UUID] = h
+
+	files, err := cm.WriteChunks(dir, "chunk_", max, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %v", files)
+	}
+	total := 0
+	for _, fname := range files {
+		data := mustReadFile(t, fname)
+		n := strings.Count(data, "define ")
+		total += n
+		if len(data) > max && n > 1 {
+			t.Errorf("Expected %s to be at most %d bytes, got %d", fname, max, len(data))
+		}
+	}
+	if total != len(cm) {
+		t.Errorf("Expected %d objects written, got %d", len(cm), total)
+	}
+
+	files, err = cm.WriteChunks(dir, "one_", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(cm) || files[0] != dir+"/one_001.cfg" {
+		t.Errorf("Expected one file per object, got %v", files)
+	}
+	if _, err = cm.WriteChunks(dir, "bad_", 0, true); err == nil {
+		t.Error("Expected error for chunk size 0")
+	}
+}
+
+func TestReadChanResults(t *testing.T) {
+	cfg := querycfgstr + "define bogus{\n\tfoo bar\n\t}\n" + querycfgstr
+	r := NewReader(strings.NewReader(cfg))
+	var objs, errs int
+	for res := range r.ReadChanResults(context.Background(), false, "") {
+		if res.Err != nil {
+			errs++
+			if _, ok := res.Err.(*ParseError); !ok {
+				t.Errorf("Expected a ParseError, got %T: %v", res.Err, res.Err)
+			}
+			continue
+		}
+		objs++
+	}
+	if errs == 0 {
+		t.Error("Expected an error for the invalid object")
+	}
+	if objs < 3 {
+		t.Errorf("Expected objects before the error to be delivered, got %d", objs)
+	}
+
+	r = NewReader(io.MultiReader(strings.NewReader(querycfgstr), failReader{}))
+	errs = 0
+	for res := range r.ReadChanResults(context.Background(), false, "") {
+		if res.Err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("Expected reading to stop after one I/O error, got %d errors", errs)
+	}
+}
+
+type failReader struct{}
+
+func (fr failReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("read failed")
+}
+
+func TestReadDefineKeyword(t *testing.T) {
+	cfg := "object host {\n  host_name  web01\n  }\n"
+	r := NewReader(strings.NewReader(cfg))
+	r.DefineKeyword = "object"
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.Type != T_HOST || co.Props["host_name"] != "web01" {
+		t.Errorf("Unexpected object: %v", co)
+	}
+
+	r = NewReader(strings.NewReader(cfg))
+	_, err = r.Read(false, "")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Err != ErrKeyword {
+		t.Errorf("Expected ParseError with ErrKeyword, got %v", err)
+	}
+
+	r = NewReader(strings.NewReader(cfg + "define host{\n  host_name  web02\n  }\n"))
+	r.Lenient = true
+	co, err = r.Read(false, "")
+	if err != nil || co.Props["host_name"] != "web02" {
+		t.Errorf("Expected to skip to the next define, got %v, %v", co, err)
+	}
+	if len(r.Errors()) != 1 {
+		t.Errorf("Expected 1 skipped object, got %v", r.Errors())
+	}
+}
+
+func TestDiffAgainstOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := dir + "/services.cfg"
+	cm := readTestMap(t, querycfgstr)
+	for _, co := range cm {
+		co.FileID = fname
+	}
+	nc := NewNagiosCfg()
+	nc.Config = cm
+	if err = nc.SaveToOrigin(true); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := nc.DiffAgainstOrigin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := diffs[fname]; !ok || d != "" {
+		t.Errorf("Expected empty diff for %s, got %q (%v)", fname, d, diffs)
+	}
+
+	var web *CfgObj
+	for _, co := range cm {
+		if co.Props["host_name"] == "web01" {
+			web = co
+		}
+	}
+	web.Set("check_command", "check_https")
+	diffs, err = nc.DiffAgainstOrigin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := diffs[fname]
+	if !strings.Contains(d, "\n-    check_command ") || !strings.Contains(d, "\n+    check_command ") || !strings.Contains(d, " check_https\n") {
+		t.Errorf("Unexpected diff:\n%s", d)
+	}
+	if data := mustReadFile(t, fname); strings.Contains(data, "check_https") {
+		t.Error("DiffAgainstOrigin should not write anything")
+	}
+}
+
+func TestWriterLineEnding(t *testing.T) {
+	m := readTestMap(t, querycfgstr)
+	keys := m.Keys()
+	cos := CfgObjs{m[keys[0]], m[keys[1]]}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.LineEnding = "\r\n"
+	if err := w.WriteAll(cos); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Count(out, "\n") != strings.Count(out, "\r\n") {
+		t.Errorf("Expected only CRLF line endings, got %q", out)
+	}
+	if !strings.Contains(out, "}\r\n\r\n") {
+		t.Errorf("Expected CRLF after closing brace and blank line, got %q", out)
+	}
+
+	// reading back gives the same objects
+	r := NewReader(strings.NewReader(out))
+	for i := range cos {
+		co, err := r.Read(false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !co.Equal(cos[i]) {
+			t.Errorf("Expected %v, got %v", cos[i], co)
+		}
+	}
+}
+
+func TestReadStripTrailingSemicolon(t *testing.T) {
+	cfg := `define host{
+  host_name           web01;
+  max_check_attempts  5 ;
+  notes               "ends with;"
+  }
+`
+	r := NewReader(strings.NewReader(cfg))
+	r.InlineComment = 0
+	r.StripTrailingSemicolon = true
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		"host_name":          "web01",
+		"max_check_attempts": "5",
+		"notes":              "ends with;",
+	}
+	for k, v := range exp {
+		if co.Props[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, co.Props[k])
+		}
+	}
+
+	r = NewReader(strings.NewReader(cfg))
+	r.InlineComment = 0
+	co, err = r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.Props["host_name"] != "web01;" {
+		t.Errorf("Expected semicolon to be kept by default, got %q", co.Props["host_name"])
+	}
+}
+
+func TestReadLineContinuation(t *testing.T) {
+	cfg := "define command{\n" +
+		"  command_name  check_long\n" +
+		"  command_line  $USER1$/check_long -H $HOSTADDRESS$ \\\n" +
+		"                -w 80 \\\r\n" +
+		"                -c 90\n" +
+		"  notes         C:\\\\\n" +
+		"  }\n"
+	r := NewReader(strings.NewReader(cfg))
+	co, err := r.Read(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		"command_name": "check_long",
+		"command_line": "$USER1$/check_long -H $HOSTADDRESS$ -w 80 -c 90",
+		"notes":        `C:\\`,
+	}
+	for k, v := range exp {
+		if co.Props[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, co.Props[k])
+		}
+	}
+	if len(co.Props) != len(exp) {
+		t.Errorf("Expected %d keys, got %d: %v", len(exp), len(co.Props), co.Props)
+	}
+
+	// line numbers in errors count each physical line, so continuing a line moves later errors down
+	lineOf := func(cfg string) int {
+		_, err := NewReader(strings.NewReader(cfg)).Read(false, "")
+		pe, ok := err.(*ParseError)
+		if !ok || pe.Err != ErrQuote {
+			t.Fatalf("Expected unterminated quote, got %v", err)
+		}
+		return pe.Line
+	}
+	joined := lineOf("define host{\n  host_name  web01 web02 web03\n  notes      \"oops\n  }\n")
+	continued := lineOf("define host{\n" +
+		"  host_name  web01 \\\n" +
+		"             web02 \\\r\n" +
+		"             web03\n" +
+		"  notes      \"oops\n" +
+		"  }\n")
+	if continued != joined+2 {
+		t.Errorf("Expected error 2 lines after %d, got %d", joined, continued)
+	}
+}
+
+func TestWriteFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/services.cfg"
+	cm := readTestMap(t, querycfgstr)
+
+	err = cm.WriteFileMode(fname, true, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %v", fi.Mode().Perm())
+	}
+
+	// WriteFile should leave the mode alone
+	err = os.Chmod(fname, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.WriteFile(fname, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600 to be kept, got %v", fi.Mode().Perm())
+	}
+	m2 := readTestMap(t, mustReadFile(t, fname))
+	if m2.Len() != 3 {
+		t.Errorf("Expected 3 objects in written file, got %d", m2.Len())
+	}
+}
+
+func TestTransform(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewReader(strings.NewReader(querycfgstr))
+	in := r.ReadChanContext(ctx, true, "")
+	out := Transform(ctx, in, func(co *CfgObj) (*CfgObj, bool) {
+		if co.Props["host_name"] == "web01" {
+			return nil, false
+		}
+		co.Set("notes", "transformed")
+		return co, true
+	})
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Sorted = true
+	err := w.WriteChan(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := readTestMap(t, buf.String())
+	if cm.Len() != 2 {
+		t.Fatalf("Expected 2 objects after Transform, got %d", cm.Len())
+	}
+	for _, co := range cm {
+		if co.Props["notes"] != "transformed" {
+			t.Errorf("Expected object to be transformed: %v", co.Props)
+		}
+	}
+}
+
+func TestTransformCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *CfgObj) // never closed, like an endless producer
+	go func() {
+		for {
+			select {
+			case in <- NewCfgObj(T_HOST):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out := Transform(ctx, in, func(co *CfgObj) (*CfgObj, bool) { return co, true })
+	<-out
+	cancel() // stop reading, leaving the sender blocked
+
+	done := make(chan bool)
+	go func() {
+		for range out {
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected output to be closed after cancel")
+	}
+}
+
+func TestReaderPeek(t *testing.T) {
+	r := NewReader(strings.NewReader(querycfgstr + "define host{\n\thost_name web01\n\t}\n"))
+	for i := 0; i < 3; i++ {
+		ct, ok := r.Peek()
+		if !ok || ct != T_SERVICE {
+			t.Fatalf("Expected to peek a service, got %v %v", ct, ok)
+		}
+		ct, ok = r.Peek() // peeking again should not read further
+		if !ok || ct != T_SERVICE {
+			t.Fatalf("Expected to peek the same service again, got %v %v", ct, ok)
+		}
+		co, err := r.Read(true, "test.cfg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if co.Type != T_SERVICE || co.FileID != "test.cfg" || co.UUID.Equals(UUID{}) {
+			t.Errorf("Peeked object not returned as expected: %v", co)
+		}
+	}
+	ct, ok := r.Peek()
+	if !ok || ct != T_HOST {
+		t.Errorf("Expected to peek a host, got %v %v", ct, ok)
+	}
+	co, err := r.Read(false, "")
+	if err != nil || co.Props["host_name"] != "web01" {
+		t.Errorf("Expected host web01, got %v %v", co, err)
+	}
+	if _, ok := r.Peek(); ok {
+		t.Error("Expected Peek to fail at EOF")
+	}
+	if _, err = r.Read(false, ""); err != io.EOF {
+		t.Errorf("Expected io.EOF after Peek at EOF, got %v", err)
+	}
+	if len(r.Order()) != 3 {
+		t.Errorf("Expected 3 objects in read order, got %d", len(r.Order()))
+	}
+	if r.Stats().ObjectsRead != 4 {
+		t.Errorf("Expected 4 objects read, got %d", r.Stats().ObjectsRead)
+	}
+}
+
+func TestReadWriteEmptyObj(t *testing.T) {
+	tests := map[string]string{
+		"define host{\n}\n":      "# host\ndefine host{\n}\n", // the brace style is kept
+		"define host{ }\n":       "# host\ndefine host{\n    }\n",
+		"define host {\n    }\n": "# host\ndefine host{\n    }\n",
+	}
+	for cfg, exp := range tests {
+		r := NewReader(strings.NewReader(cfg))
+		co, err := r.Read(true, "")
+		if err != nil {
+			t.Fatalf("%q: %s", cfg, err)
+		}
+		if co.Type != T_HOST || len(co.Props) != 0 {
+			t.Errorf("%q: expected an empty host, got %v", cfg, co)
+		}
+		var buf bytes.Buffer
+		co.Print(&buf, true)
+		if buf.String() != exp {
+			t.Errorf("%q: expected %q, got %q", cfg, exp, buf.String())
+		}
+
+		// and it should read back the same
+		co2, err := NewReader(strings.NewReader(buf.String())).Read(true, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !co.Equal(co2) {
+			t.Errorf("%q: empty object changed on round trip: %v", cfg, co2)
+		}
+	}
+}
+
+func TestLoadFromMainConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(dir+"/conf.d/sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "define host{\n\thost_name %s\n\t}\n"
+	files := map[string]string{
+		"/services.cfg":         querycfgstr,
+		"/conf.d/web.cfg":       fmt.Sprintf(host, "web01"),
+		"/conf.d/sub/db.cfg":    fmt.Sprintf(host, "db01"),
+		"/conf.d/README":        "not a config file",
+		"/conf.d/notes.cfg.bak": "not a config file either",
+	}
+	for fname, content := range files {
+		err = ioutil.WriteFile(dir+fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := dir + "/nagios.cfg"
+	err = ioutil.WriteFile(main, []byte(`# main config
+log_file=/var/log/nagios/nagios.log
+cfg_file=services.cfg
+cfg_dir=`+dir+`/conf.d
+cfg_file=conf.d/web.cfg
+resource_file=resource.cfg
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := MainConfigFiles(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{dir + "/services.cfg", dir + "/conf.d/sub/db.cfg", dir + "/conf.d/web.cfg"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected files %q, got %q", exp, got)
+	}
+
+	nc, err := LoadFromMainConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.Config.Len() != 5 {
+		t.Errorf("Expected 5 objects, got %d", nc.Config.Len())
+	}
+
+	err = ioutil.WriteFile(main, []byte("cfg_file=missing.cfg\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadFromMainConfig(main)
+	if err == nil {
+		t.Error("Expected error for missing cfg_file")
+	}
+}
+
+func TestSourceFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f1, f2 := dir+"/services.cfg", dir+"/hosts.cfg"
+	ioutil.WriteFile(f1, []byte(querycfgstr), 0644)
+	ioutil.WriteFile(f2, []byte("define host{\n\thost_name web01\n\t}\n"), 0644)
+
+	nc := NewNagiosCfg()
+	err = nc.LoadFiles(f1, f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{f2, f1}
+	if !reflect.DeepEqual(nc.SourceFiles(), exp) {
+		t.Errorf("Expected source files %q, got %q", exp, nc.SourceFiles())
+	}
+
+	cos := nc.ObjectsInFile(f1)
+	if len(cos) != 3 {
+		t.Fatalf("Expected 3 objects in %s, got %d", f1, len(cos))
+	}
+	if cos[0].Props["host_name"] != "db_dummy_gso" || cos[2].Props["host_name"] != "web01" {
+		t.Errorf("Expected objects in the order read, got %v", cos)
+	}
+	if len(nc.ObjectsInFile(dir+"/nonexistent.cfg")) != 0 {
+		t.Error("Expected no objects for a file not loaded")
+	}
+}
+
+func TestReadCaptureDisabled(t *testing.T) {
+	cfg := `define host{
+    host_name                      web01
+    }
+
+# old web server, disabled until fixed
+#define host{
+#    host_name                      web02
+#    alias                          Web 2 ; not in use
+#    }
+
+#define this is just a comment {
+define host{
+    host_name                      web03
+    }
+`
+	r := NewReader(strings.NewReader(cfg))
+	r.CaptureDisabled = true
+	cos, err := r.ReadAllList(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cos.Len() != 3 {
+		t.Fatalf("Expected 3 objects, got %d", cos.Len())
+	}
+	objs := make(CfgObjs, 0, 3)
+	for e := cos.Front(); e != nil; e = e.Next() {
+		objs = append(objs, e.Value.(*CfgObj))
+	}
+	dis := objs[1]
+	if !dis.Disabled || objs[0].Disabled || objs[2].Disabled {
+		t.Fatalf("Expected only the second object to be disabled")
+	}
+	if dis.Props["host_name"] != "web02" || dis.Props["alias"] != "Web 2" || dis.InlineComments["alias"] != "not in use" {
+		t.Errorf("Disabled object not parsed correctly: %v", dis.Props)
+	}
+	if !reflect.DeepEqual(dis.LeadingComments, []string{"# old web server, disabled until fixed"}) {
+		t.Errorf("Unexpected leading comments %q", dis.LeadingComments)
+	}
+	if !reflect.DeepEqual(objs[2].LeadingComments, []string{"#define this is just a comment {"}) {
+		t.Errorf("Unexpected leading comments %q", objs[2].LeadingComments)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	err = w.WriteAll(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "# old web server, disabled until fixed\n#define host{\n#    host_name                      web02\n#    alias                          Web 2 ; not in use\n#    }\n"
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("Expected disabled object written as\n%s\ngot\n%s", exp, buf.String())
+	}
+	if !strings.Contains(buf.String(), "\ndefine host{\n    host_name                      web03\n") {
+		t.Errorf("Object after the disabled one should not be commented out:\n%s", buf.String())
+	}
+
+	// without CaptureDisabled, the lines are comments for the next object
+	r = NewReader(strings.NewReader(cfg))
+	cos, err = r.ReadAllList(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cos.Len() != 2 {
+		t.Errorf("Expected 2 objects without CaptureDisabled, got %d", cos.Len())
+	}
+}
+
+func TestWriteFileN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/services.cfg"
+	cm := readTestMap(t, querycfgstr)
+
+	objs, n, err := cm.WriteFileN(fname, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objs != 3 {
+		t.Errorf("Expected 3 objects written, got %d", objs)
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != fi.Size() || n == 0 {
+		t.Errorf("Expected %d bytes written, got %d", fi.Size(), n)
+	}
+
+	_, _, err = cm.WriteFileN(dir+"/nonexistent/services.cfg", true)
+	if err == nil {
+		t.Error("Expected error writing to a nonexistent directory")
+	}
+
+	// nothing counts until it's flushed, and everything fits in the buffer here
+	objs, n, err = cm.writeCounted(&countWriter{limit: 0}, cm.Keys(), true)
+	if err == nil || objs != 0 || n != 0 {
+		t.Errorf("Expected error with nothing written, got %d objects, %d bytes, err: %v", objs, n, err)
+	}
+}
+
+func TestWriteFilesLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := make(CfgMap)
+	fmap := make(map[string]UUIDs)
+	for i := 0; i < 20; i++ {
+		co := NewCfgObj(T_HOST)
+		co.Set("host_name", fmt.Sprintf("host%02d", i))
+		co.FileID = fmt.Sprintf("%s/host%02d.cfg", dir, i)
+		cm[co.UUID] = co
+		fmap[co.FileID] = UUIDs{co.UUID}
+	}
+	if err = cm.writeFiles(fmap, true, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 20 {
+		t.Errorf("Expected 20 files, got %d", len(files))
+	}
+
+	// errors are still collected from all files when writes wait on each other
+	bad := make(map[string]UUIDs)
+	for fname, ids := range fmap {
+		bad[dir+"/nonexistent/"+filepath.Base(fname)] = ids
+	}
+	err = cm.writeFiles(bad, true, false, 2)
+	if err == nil || !strings.Contains(err.Error(), "20 files") {
+		t.Errorf("Expected error for 20 files, got %v", err)
+	}
+}
+
+func TestAppendToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := dir + "/local.cfg"
+	cm := readTestMap(t, "define host{\n\thost_name web01\n\t}\n")
+
+	// new file, no separator
+	if err = cm.AppendToFile(fname, true); err != nil {
+		t.Fatal(err)
+	}
+	if data := mustReadFile(t, fname); strings.HasPrefix(data, "\n") {
+		t.Errorf("Expected no leading blank line in a new file, got:\n%s", data)
+	}
+
+	if err = ioutil.WriteFile(fname, []byte("# local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = cm.AppendToFile(fname, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := mustReadFile(t, fname)
+	if !strings.HasPrefix(data, "# local\n\n") {
+		t.Errorf("Expected existing content followed by a blank line, got:\n%s", data)
+	}
+	res := readTestMap(t, data)
+	if len(res) != 2 {
+		t.Errorf("Expected 2 objects after appending twice, got %d", len(res))
+	}
+
+	// objects are appended in read order, and the mode is set as for WriteFileMode
+	fname = dir + "/services.cfg"
+	cm = readTestMap(t, querycfgstr)
+	if err = cm.AppendToFileMode(fname, true, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", fi.Mode().Perm())
+	}
+	data = mustReadFile(t, fname)
+	gso, test, web := strings.Index(data, "db_dummy_gso"), strings.Index(data, "db_dummy_test"), strings.Index(data, "web01")
+	if gso == -1 || gso > test || test > web {
+		t.Errorf("Expected objects in read order, got:\n%s", data)
+	}
+}
+
+func TestReadDuplicateKeys(t *testing.T) {
+	cfg := `define host{
+    host_name   web01
+    address     10.0.0.1
+    address     10.0.0.2
+    }
+`
+	r := NewReader(strings.NewReader(cfg))
+	cm, err := r.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, co := range cm {
+		if co.Props["address"] != "10.0.0.1" {
+			t.Errorf("Expected the first value to be kept, got %q", co.Props["address"])
+		}
+	}
+	if len(r.DuplicateKeys) != 1 {
+		t.Fatalf("Expected 1 duplicate key, got %v", r.DuplicateKeys)
+	}
+	dk := r.DuplicateKeys[0]
+	if dk.Line != 4 || dk.Column != 4 || !strings.Contains(dk.Error(), `"address"`) {
+		t.Errorf("Unexpected duplicate key error: %s", &dk)
+	}
+	if len(r.Warnings()) != 1 {
+		t.Errorf("Expected the duplicate in Warnings, got %v", r.Warnings())
+	}
+}
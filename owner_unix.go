@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+import (
+	"os"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// chownLike sets the owner and group of f to those in fi, when permitted.
+// Only root can give files away, so failing here is logged but not an error.
+func chownLike(f *os.File, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	err := f.Chown(int(st.Uid), int(st.Gid))
+	if err != nil {
+		log.Debugf("Unable to keep ownership of %s: %s", fi.Name(), err)
+	}
+}
@@ -0,0 +1,404 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+/*
+Template inheritance, following the "use" directive, and expansion of hostgroups.
+See: https://assets.nagios.com/downloads/nagioscore/docs/nagioscore/3/en/objectinheritance.html
+*/
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+// Keys that are never inherited from a template
+var nonInheritedKeys = []string{
+	"name",
+	"register",
+	"use",
+}
+
+// templateIndex maps the "name" of every template to its object, per type, as "use" only refers to templates of the same type.
+// Disabled templates are left out, as Nagios never sees them.
+func (cm CfgMap) templateIndex() map[CfgType]map[string]*CfgObj {
+	idx := make(map[CfgType]map[string]*CfgObj)
+	for _, v := range cm {
+		name, ok := v.Get("name")
+		if !ok || v.Disabled {
+			continue
+		}
+		_, ok = idx[v.Type]
+		if !ok {
+			idx[v.Type] = make(map[string]*CfgObj)
+		}
+		idx[v.Type][name] = v
+	}
+	return idx
+}
+
+// objID returns something that identifies an object in error messages
+func objID(co *CfgObj) string {
+	name, ok := co.Get("name")
+	if ok {
+		return name
+	}
+	name, ok = co.GetName()
+	if ok {
+		return name
+	}
+	return co.UUID.String()
+}
+
+// templateChain returns the initial chain of template names for co, used for detecting cycles
+func templateChain(co *CfgObj) []string {
+	name, ok := co.Get("name")
+	if ok {
+		return []string{name}
+	}
+	return []string{}
+}
+
+func isInherited(key string) bool {
+	for i := range nonInheritedKeys {
+		if nonInheritedKeys[i] == key {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns a new object with all inherited properties for co, and the UUID of the object that supplied each
+// property. chain is the list of templates visited so far.
+func (cm CfgMap) resolve(co *CfgObj, idx map[CfgType]map[string]*CfgObj, chain []string) (*CfgObj, map[string]UUID, error) {
+	res := NewCfgObj(co.Type)
+	res.UUID = co.UUID
+	res.FileID = co.FileID
+	res.Indent = co.Indent
+	res.Align = co.Align
+	res.BraceStyle = co.BraceStyle
+	prov := make(map[string]UUID)
+
+	for _, k := range co.originalKeys() {
+		if k == "use" {
+			continue
+		}
+		if res.Add(k, co.Props[k]) {
+			res.SetAdditive(k, co.IsAdditive(k))
+			prov[k] = co.UUID
+		}
+	}
+
+	// the first template listed in "use" has precedence over the next, as MergeFrom won't overwrite
+	for _, tname := range co.GetList("use", SEP_LST) {
+		tname = strings.TrimSpace(tname)
+		if tname == "" {
+			continue
+		}
+		for i := range chain {
+			if chain[i] == tname {
+				return nil, nil, fmt.Errorf("Cyclic template reference in %s %q: %s -> %s %s", co.Type.String(), objID(co), strings.Join(chain, " -> "), tname, dbgStr(true))
+			}
+		}
+		tmpl, ok := idx[co.Type][tname]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s %q uses undefined template %q %s", co.Type.String(), objID(co), tname, dbgStr(true))
+		}
+		parent, pprov, err := cm.resolve(tmpl, idx, append(chain, tname))
+		if err != nil {
+			return nil, nil, err
+		}
+		res.MergeFrom(parent, false)
+		for k := range res.Props {
+			if _, found := prov[k]; !found {
+				prov[k] = pprov[k]
+			}
+		}
+	}
+
+	// "null" is the Nagios way of saying "don't inherit this", and nothing is left to add to
+	for _, k := range res.originalKeys() {
+		if res.Props[k] == "null" {
+			res.Del(k)
+			delete(prov, k)
+		}
+	}
+	res.Additive = nil
+
+	return res, prov, nil
+}
+
+// Resolve returns a new object with all properties inherited via "use" merged in, with the objects own properties
+// taking precedence. Additive values ("+" prefixed) are appended to the inherited value. The returned object has the same
+// UUID as the original, but no "use" directive.
+func (cm CfgMap) Resolve(uuid UUID) (*CfgObj, error) {
+	co, ok := cm.GetByUUID(uuid)
+	if !ok {
+		return nil, fmt.Errorf("No object with UUID %q %s", uuid, dbgStr(true))
+	}
+	res, _, err := cm.resolve(co, cm.templateIndex(), templateChain(co))
+	return res, err
+}
+
+// ResolveWithProvenance works like Resolve, but also returns the UUID of the object that supplied each property
+// of the resolved object, i.e. the object itself or one of its templates. Additive values are attributed to the
+// last object appending to the value.
+func (cm CfgMap) ResolveWithProvenance(uuid UUID) (*CfgObj, map[string]UUID, error) {
+	co, ok := cm.GetByUUID(uuid)
+	if !ok {
+		return nil, nil, fmt.Errorf("No object with UUID %q %s", uuid, dbgStr(true))
+	}
+	return cm.resolve(co, cm.templateIndex(), templateChain(co))
+}
+
+// ResolveAll returns a new CfgMap where every object has been resolved. Objects that fail to resolve are left out.
+func (cm CfgMap) ResolveAll() (CfgMap, error) {
+	idx := cm.templateIndex()
+	res := make(CfgMap, len(cm))
+	errcnt := 0
+	for k, v := range cm {
+		o, _, err := cm.resolve(v, idx, templateChain(v))
+		if err != nil {
+			log.Errorf("%s %s", err, dbgStr(false))
+			errcnt++
+			continue
+		}
+		res[k] = o
+	}
+	if errcnt > 0 {
+		return res, fmt.Errorf("Failed to resolve %d of %d objects %s", errcnt, len(cm), dbgStr(true))
+	}
+	return res, nil
+}
+
+// splitNames splits a list of names, skipping empty entries
+func splitNames(val string) []string {
+	names := make([]string, 0, 1)
+	for _, name := range strings.Split(val, SEP_LST) {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// hostgroupExpander resolves the member hosts of hostgroups
+type hostgroupExpander struct {
+	groups  map[string]*CfgObj         // hostgroup_name -> hostgroup
+	hostsIn map[string][]string        // hostgroup_name -> hosts listing the group in "hostgroups"
+	cache   map[string]map[string]bool // hostgroup_name -> expanded set of hosts
+}
+
+func (cm CfgMap) newHostgroupExpander() *hostgroupExpander {
+	hge := &hostgroupExpander{
+		groups:  make(map[string]*CfgObj),
+		hostsIn: make(map[string][]string),
+		cache:   make(map[string]map[string]bool),
+	}
+	for _, v := range cm {
+		if v.IsTemplate() || v.Disabled {
+			continue
+		}
+		switch v.Type {
+		case T_HOSTGROUP:
+			name, ok := v.Get("hostgroup_name")
+			if ok {
+				hge.groups[name] = v
+			}
+		case T_HOST:
+			name, ok := v.Get("host_name")
+			if !ok {
+				continue
+			}
+			for _, g := range splitNames(v.Props["hostgroups"]) {
+				hge.hostsIn[g] = append(hge.hostsIn[g], name)
+			}
+		}
+	}
+	return hge
+}
+
+// hosts returns the set of hosts in the given group, including hosts from nested groups in "hostgroup_members"
+func (hge *hostgroupExpander) hosts(group string, chain []string) (map[string]bool, error) {
+	for i := range chain {
+		if chain[i] == group {
+			return nil, fmt.Errorf("Cyclic hostgroup membership: %s -> %s %s", strings.Join(chain, " -> "), group, dbgStr(true))
+		}
+	}
+	res, ok := hge.cache[group]
+	if ok {
+		return res, nil
+	}
+	hg, ok := hge.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("Undefined hostgroup %q %s", group, dbgStr(true))
+	}
+
+	res = make(map[string]bool)
+	for _, h := range splitNames(hg.Props["members"]) {
+		res[h] = true
+	}
+	for _, h := range hge.hostsIn[group] {
+		res[h] = true
+	}
+	for _, sub := range splitNames(hg.Props["hostgroup_members"]) {
+		subhosts, err := hge.hosts(sub, append(chain, group))
+		if err != nil {
+			return nil, err
+		}
+		for h := range subhosts {
+			res[h] = true
+		}
+	}
+	hge.cache[group] = res
+	return res, nil
+}
+
+// serviceHosts returns the sorted list of hosts a service applies to, from both "host_name" and "hostgroup_name".
+// Names prefixed with "!" are excluded.
+func (hge *hostgroupExpander) serviceHosts(co *CfgObj) ([]string, error) {
+	res, err := hge.expandHosts(co.Props["host_name"], co.Props["hostgroup_name"])
+	if err != nil {
+		return nil, fmt.Errorf("%s %q: %s", co.Type.String(), objID(co), err)
+	}
+	return res, nil
+}
+
+// expandHosts returns the sorted list of hosts from a list of host names and a list of hostgroup names,
+// as found in "host_name" and "hostgroup_name". Names prefixed with "!" are excluded.
+func (hge *hostgroupExpander) expandHosts(hostNames, groupNames string) ([]string, error) {
+	incl := make(map[string]bool)
+	excl := make(map[string]bool)
+	for _, g := range splitNames(groupNames) {
+		set := incl
+		if strings.HasPrefix(g, "!") {
+			set = excl
+			g = g[1:]
+		}
+		hosts, err := hge.hosts(g, []string{})
+		if err != nil {
+			return nil, err
+		}
+		for h := range hosts {
+			set[h] = true
+		}
+	}
+	for _, h := range splitNames(hostNames) {
+		if strings.HasPrefix(h, "!") {
+			excl[h[1:]] = true
+		} else {
+			incl[h] = true
+		}
+	}
+	res := make([]string, 0, len(incl))
+	for h := range incl {
+		if !excl[h] {
+			res = append(res, h)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// ExpandHostgroups replaces each service that uses "hostgroup_name" with one copy of the service per member host,
+// with "host_name" set to that host, and without "hostgroup_name". Hosts are found from the hostgroups "members"
+// and "hostgroup_members", and from the hosts own "hostgroups". Templates are left as they are.
+// If any group is undefined or part of a cycle, an error is returned and cm is not changed.
+func (cm CfgMap) ExpandHostgroups() error {
+	hge := cm.newHostgroupExpander()
+	expanded := make(map[UUID][]string)
+	for k, v := range cm {
+		if v.Type != T_SERVICE || v.IsTemplate() {
+			continue
+		}
+		_, ok := v.Get("hostgroup_name")
+		if !ok {
+			continue
+		}
+		hosts, err := hge.serviceHosts(v)
+		if err != nil {
+			return err
+		}
+		expanded[k] = hosts
+	}
+
+	for k, hosts := range expanded {
+		orig := cm[k]
+		for _, h := range hosts {
+			o := orig.Clone()
+			o.Del("hostgroup_name")
+			o.Set("host_name", h)
+			cm[o.UUID] = o
+		}
+		delete(cm, k)
+	}
+	return nil
+}
+
+// HostgroupsOf returns the sorted names of all hostgroups the given host is a member of, whether from the hosts
+// own "hostgroups", or from the "members" of the hostgroup, directly or through "hostgroup_members"
+func (cm CfgMap) HostgroupsOf(hostName string) []string {
+	hge := cm.newHostgroupExpander()
+	set := make(map[string]bool)
+	for g, hosts := range hge.hostsIn {
+		for _, h := range hosts {
+			if h == hostName {
+				set[g] = true
+			}
+		}
+	}
+	for g := range hge.groups {
+		hosts, err := hge.hosts(g, []string{})
+		if err != nil {
+			log.Debugf("%s %s", err, dbgStr(false))
+			continue
+		}
+		if hosts[hostName] {
+			set[g] = true
+		}
+	}
+	res := make([]string, 0, len(set))
+	for g := range set {
+		res = append(res, g)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// MembersOf returns the sorted names of all hosts in the given hostgroup, the same way as HostgroupsOf finds them.
+// If the group, or any group nested in it, is undefined or part of a cycle, only the hosts listing the group in
+// their own "hostgroups" are returned.
+func (cm CfgMap) MembersOf(hostgroupName string) []string {
+	hge := cm.newHostgroupExpander()
+	hosts, err := hge.hosts(hostgroupName, []string{})
+	if err != nil {
+		log.Debugf("%s %s", err, dbgStr(false))
+		hosts = make(map[string]bool)
+		for _, h := range hge.hostsIn[hostgroupName] {
+			hosts[h] = true
+		}
+	}
+	res := make([]string, 0, len(hosts))
+	for h := range hosts {
+		res = append(res, h)
+	}
+	sort.Strings(res)
+	return res
+}
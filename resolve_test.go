@@ -0,0 +1,310 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nagioscfg
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var tmplcfgstr string = `define service{
+	name                generic-service
+	check_interval      5
+	contact_groups      ops
+	notes               generic
+	register            0
+	}
+
+define service{
+	name                linux-service
+	use                 generic-service
+	check_interval      2
+	register            0
+	}
+
+define service{
+	use                 linux-service
+	host_name           localhost
+	service_description PING
+	contact_groups      +devs
+	notes               null
+	}
+`
+
+func readTestMap(t *testing.T, cfg string) CfgMap {
+	rdr := NewReader(strings.NewReader(cfg))
+	m, err := rdr.ReadAllMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func findByKey(cm CfgMap, key, val string) *CfgObj {
+	for _, v := range cm {
+		if v.Props[key] == val {
+			return v
+		}
+	}
+	return nil
+}
+
+func TestResolve(t *testing.T) {
+	m := readTestMap(t, tmplcfgstr)
+	svc := findByKey(m, "service_description", "PING")
+	if svc == nil {
+		t.Fatal("Service not found")
+	}
+	res, err := m.Resolve(svc.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		"host_name":           "localhost",
+		"service_description": "PING",
+		"check_interval":      "2",
+		"contact_groups":      "ops,devs",
+	}
+	for k, v := range exp {
+		got, _ := res.Get(k)
+		if got != v {
+			t.Errorf("Expected %s = %q, got %q", k, v, got)
+		}
+	}
+	for _, k := range []string{"use", "register", "name", "notes"} {
+		_, found := res.Get(k)
+		if found {
+			t.Errorf("Key %q should not be in the resolved object", k)
+		}
+	}
+	if res.IsAdditive("contact_groups") {
+		t.Error("Resolved object should have no additive values left")
+	}
+	if !res.UUID.Equals(svc.UUID) {
+		t.Error("Resolved object should keep the UUID of the original")
+	}
+	_, found := svc.Get("use")
+	if !found {
+		t.Error("Original object should not be modified")
+	}
+}
+
+func TestResolveWithProvenance(t *testing.T) {
+	m := readTestMap(t, tmplcfgstr)
+	svc := findByKey(m, "service_description", "PING")
+	generic := findByKey(m, "name", "generic-service")
+	linux := findByKey(m, "name", "linux-service")
+
+	res, prov, err := m.ResolveWithProvenance(svc.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]UUID{
+		"check_interval":      linux.UUID,
+		"contact_groups":      svc.UUID,
+		"host_name":           svc.UUID,
+		"service_description": svc.UUID,
+	}
+	if !reflect.DeepEqual(prov, exp) {
+		t.Errorf("Expected provenance %v, got %v", exp, prov)
+	}
+	for k := range res.Props {
+		if _, ok := prov[k]; !ok {
+			t.Errorf("No provenance for %q", k)
+		}
+	}
+
+	_, prov, err = m.ResolveWithProvenance(linux.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prov["contact_groups"].Equals(generic.UUID) || !prov["check_interval"].Equals(linux.UUID) {
+		t.Errorf("Unexpected provenance for template: %v", prov)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	m := readTestMap(t, `define service{
+	name                generic-service
+	check_interval      5
+	contact_groups      ops
+	notes               generic
+	register            0
+	}
+
+define service{
+	host_name           web01
+	service_description HTTP
+	check_interval      1
+	contact_groups      +web
+	}
+`)
+	parent := findByKey(m, "name", "generic-service")
+	child := findByKey(m, "service_description", "HTTP")
+
+	co := child.Clone()
+	co.MergeFrom(parent, false)
+	exp := map[string]string{
+		"host_name":           "web01",
+		"service_description": "HTTP",
+		"check_interval":      "1",
+		"contact_groups":      "ops,web",
+		"notes":               "generic",
+	}
+	if !reflect.DeepEqual(co.Props, exp) {
+		t.Errorf("Expected %v, got %v", exp, co.Props)
+	}
+	if co.IsAdditive("contact_groups") {
+		t.Error("Expected contact_groups to no longer be additive after merge")
+	}
+
+	co = child.Clone()
+	co.MergeFrom(parent, true)
+	exp["check_interval"] = "5"
+	if !reflect.DeepEqual(co.Props, exp) {
+		t.Errorf("Expected %v with overwrite, got %v", exp, co.Props)
+	}
+	if child.Props["check_interval"] != "1" || !child.IsAdditive("contact_groups") {
+		t.Error("Clone was not independent of the original")
+	}
+}
+
+func TestResolveCycle(t *testing.T) {
+	m := readTestMap(t, `define host{
+	name a
+	use b
+	}
+define host{
+	name b
+	use a
+	}
+define host{
+	host_name gris
+	use a
+	}
+`)
+	h := findByKey(m, "host_name", "gris")
+	_, err := m.Resolve(h.UUID)
+	if err == nil {
+		t.Fatal("Expected error for cyclic use")
+	}
+	t.Log(err)
+
+	_, err = m.ResolveAll()
+	if err == nil {
+		t.Error("Expected error from ResolveAll")
+	}
+}
+
+var hgcfgstr string = `define hostgroup{
+	hostgroup_name      web
+	members             web01,web02
+	}
+define hostgroup{
+	hostgroup_name      all
+	hostgroup_members   web
+	members             db01
+	}
+define host{
+	host_name           web03
+	hostgroups          web
+	}
+define service{
+	hostgroup_name      all
+	host_name           !web02
+	service_description PING
+	}
+define service{
+	host_name           db01
+	service_description MySQL
+	}
+`
+
+func TestExpandHostgroups(t *testing.T) {
+	cm := readTestMap(t, hgcfgstr)
+	err := cm.ExpandHostgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]string, 0)
+	for _, v := range cm {
+		desc, _ := v.Get("service_description")
+		if desc != "PING" {
+			continue
+		}
+		if _, ok := v.Get("hostgroup_name"); ok {
+			t.Errorf("Expanded service should not have hostgroup_name")
+		}
+		hn, _ := v.Get("host_name")
+		hosts = append(hosts, hn)
+	}
+	sort.Strings(hosts)
+	expected := []string{"db01", "web01", "web03"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+	if findByKey(cm, "service_description", "MySQL") == nil {
+		t.Errorf("Service without hostgroup_name should be left as is")
+	}
+
+	cyclic := strings.Replace(hgcfgstr, "members             web01,web02", "hostgroup_members   all", 1)
+	cm = readTestMap(t, cyclic)
+	clen := cm.Len()
+	err = cm.ExpandHostgroups()
+	if err == nil || !strings.Contains(err.Error(), "Cyclic") {
+		t.Errorf("Expected error for cyclic hostgroups, got %v", err)
+	}
+	if cm.Len() != clen {
+		t.Errorf("Map should not change on error")
+	}
+
+	missing := strings.Replace(hgcfgstr, "hostgroup_members   web", "hostgroup_members   nope", 1)
+	cm = readTestMap(t, missing)
+	err = cm.ExpandHostgroups()
+	if err == nil || !strings.Contains(err.Error(), `"nope"`) {
+		t.Errorf("Expected error for undefined hostgroup, got %v", err)
+	}
+}
+
+func TestHostgroupMembership(t *testing.T) {
+	cm := readTestMap(t, hgcfgstr)
+	tests := map[string][]string{
+		"web01": {"all", "web"},
+		"web03": {"all", "web"},
+		"db01":  {"all"},
+		"none":  {},
+	}
+	for host, exp := range tests {
+		if got := cm.HostgroupsOf(host); !reflect.DeepEqual(got, exp) {
+			t.Errorf("Expected %s to be in %v, got %v", host, exp, got)
+		}
+	}
+	exp := []string{"db01", "web01", "web02", "web03"}
+	if got := cm.MembersOf("all"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected members %v, got %v", exp, got)
+	}
+
+	cm = readTestMap(t, hgcfgstr+"define host{\n\thost_name  db02\n\thostgroups  undefined\n\t}\n")
+	if got := cm.MembersOf("undefined"); !reflect.DeepEqual(got, []string{"db02"}) {
+		t.Errorf("Expected back-reference from host to undefined group, got %v", got)
+	}
+	if got := cm.HostgroupsOf("db02"); !reflect.DeepEqual(got, []string{"undefined"}) {
+		t.Errorf("Expected db02 to be in undefined group, got %v", got)
+	}
+}
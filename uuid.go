@@ -25,6 +25,7 @@ adjusted to only cater for my specific needs here.
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -34,6 +35,9 @@ import (
 	"time"
 )
 
+// namespace for UUIDs from NewCfgObjDeterministic, itself derived from the RFC 4122 URL namespace
+var objNamespace = NewUUIDv5(UUID{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}, PROJECT_PREFIX+PKGNAME)
+
 var (
 	sMutex   sync.Mutex
 	sOnce    sync.Once
@@ -86,6 +90,21 @@ func NewUUIDv1() UUID {
 	return u
 }
 
+// NewUUIDv5 returns a name based UUID, derived from the namespace and name with SHA-1, as in RFC 4122.
+// The same namespace and name always give the same UUID.
+func NewUUIDv5(ns UUID, name string) UUID {
+	u := UUID{}
+	h := sha1.New()
+	h.Write(ns[:])
+	h.Write([]byte(name))
+	copy(u[:], h.Sum(nil))
+
+	u[6] = (u[6] & 0x0f) | (5 << 4) // set version 5
+	u[8] = (u[8] & 0xbf) | 0x80     // set variant
+
+	return u
+}
+
 func (u UUID) Equals(u2 UUID) bool {
 	return bytes.Equal(u[:], u2[:])
 }
@@ -293,3 +312,46 @@ func (u UUIDs) Sorted() UUIDs {
 	sort.Sort(s)
 	return s
 }
+
+// Intersect returns the UUIDs found in both u and other, in the order of u, without duplicates
+func (u UUIDs) Intersect(other UUIDs) UUIDs {
+	in := uuidSet(other)
+	return u.filterDedup(func(id UUID) bool { return in[id] })
+}
+
+// Union returns the UUIDs found in either u or other, in the order of u followed by other, without duplicates
+func (u UUIDs) Union(other UUIDs) UUIDs {
+	all := make(UUIDs, 0, len(u)+len(other))
+	all = append(all, u...)
+	all = append(all, other...)
+	return all.filterDedup(func(UUID) bool { return true })
+}
+
+// Difference returns the UUIDs in u that are not in other, in the order of u, without duplicates
+func (u UUIDs) Difference(other UUIDs) UUIDs {
+	in := uuidSet(other)
+	return u.filterDedup(func(id UUID) bool { return !in[id] })
+}
+
+// uuidSet returns the UUIDs in u as a set
+func uuidSet(u UUIDs) map[UUID]bool {
+	set := make(map[UUID]bool, len(u))
+	for i := range u {
+		set[u[i]] = true
+	}
+	return set
+}
+
+// filterDedup returns the UUIDs in u for which keep returns true, keeping only the first of any duplicates
+func (u UUIDs) filterDedup(keep func(UUID) bool) UUIDs {
+	seen := make(map[UUID]bool, len(u))
+	res := make(UUIDs, 0, len(u))
+	for i := range u {
+		if seen[u[i]] || !keep(u[i]) {
+			continue
+		}
+		seen[u[i]] = true
+		res = append(res, u[i])
+	}
+	return res
+}
@@ -17,6 +17,7 @@
 package nagioscfg
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -52,3 +53,67 @@ func TestUUIDFromString(t *testing.T) {
 	t.Logf("s1: %s", s1)
 	t.Logf("u1: %s", u1)
 }
+
+func TestUUIDsSetOps(t *testing.T) {
+	a, b, c, d := NewUUIDv1(), NewUUIDv1(), NewUUIDv1(), NewUUIDv1()
+	u1 := UUIDs{a, b, c, a}
+	u2 := UUIDs{d, c, b, d}
+
+	tests := []struct {
+		name string
+		got  UUIDs
+		exp  UUIDs
+	}{
+		{"Intersect", u1.Intersect(u2), UUIDs{b, c}},
+		{"Union", u1.Union(u2), UUIDs{a, b, c, d}},
+		{"Difference", u1.Difference(u2), UUIDs{a}},
+		{"Difference reversed", u2.Difference(u1), UUIDs{d}},
+		{"Intersect empty", u1.Intersect(nil), UUIDs{}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.exp) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.exp, tt.got)
+		}
+	}
+}
+
+func TestNewUUIDv5(t *testing.T) {
+	nsDNS := UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	exp := "2ed6657d-e927-568b-95e1-2665a8aea6a2" // from RFC 4122 implementations
+	u := NewUUIDv5(nsDNS, "www.example.com")
+	if u.String() != exp {
+		t.Errorf("Expected %s, got %s", exp, u)
+	}
+}
+
+func TestNewCfgObjDeterministic(t *testing.T) {
+	props := map[string]string{
+		"host_name":           "web01",
+		"service_description": "HTTP",
+		"check_command":       "check_http",
+	}
+	co1 := NewCfgObjDeterministic(T_SERVICE, props)
+	co2 := NewCfgObjDeterministic(T_SERVICE, map[string]string{
+		"check_command":       "check_http",
+		"host_name":           "web01",
+		"service_description": "HTTP",
+	})
+	if !co1.UUID.Equals(co2.UUID) {
+		t.Errorf("Expected identical UUIDs, got %s and %s", co1.UUID, co2.UUID)
+	}
+	if co1.UUID[6]>>4 != 5 {
+		t.Errorf("Expected a version 5 UUID, got %s", co1.UUID)
+	}
+	if !reflect.DeepEqual(co1.Props, props) {
+		t.Errorf("Expected props %v, got %v", props, co1.Props)
+	}
+
+	props["host_name"] = "web02"
+	co3 := NewCfgObjDeterministic(T_SERVICE, props)
+	if co3.UUID.Equals(co1.UUID) {
+		t.Error("Expected different UUIDs for different props")
+	}
+	if NewCfgObjDeterministic(T_HOST, props).UUID.Equals(co3.UUID) {
+		t.Error("Expected different UUIDs for different types")
+	}
+}